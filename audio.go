@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// listAudioTracks outputs every audio group of a manifest with the LANGUAGE,
+// NAME and DEFAULT attributes of its tracks
+func listAudioTracks(ctx context.Context, input, format string) {
+	video := openVideo(ctx, input)
+
+	tracks, err := video.AudioTracks()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if format != FORMAT_TEXT {
+		if err := printFormatted(format, tracks); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	fmt.Printf("🔊 Listing all audio tracks for video UID: %s\n\n", video.VideoUID)
+	group := ""
+	for _, track := range tracks {
+		if track.Group != group {
+			group = track.Group
+			fmt.Printf("%s:\n", group)
+		}
+		defaultTrack := ""
+		if track.Default {
+			defaultTrack = " (default)"
+		}
+		fmt.Printf("  %-8s %s%s\n", track.Language, track.Name, defaultTrack)
+	}
+	if len(tracks) == 0 {
+		fmt.Println("The audio is part of the video renditions")
+	}
+	fmt.Println()
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Schachte/cloudflare-stream-downloader/stream"
+)
+
+// BATCH_STATUS_WIDTH caps the status shown on the line of a batch job so the
+// lines don't wrap when they are redrawn
+const BATCH_STATUS_WIDTH = 80
+
+// batchJob is a video of a batch along with the outcome of its download
+type batchJob struct {
+	input   string
+	output  []string
+	err     error
+	elapsed time.Duration
+	// duplicateOf is the number of the job downloading the same video, 0
+	// when the job downloads its own
+	duplicateOf int
+}
+
+// batchRun downloads the jobs of a batch with the same options
+type batchRun struct {
+	opts  stream.DownloadOptions
+	board *batchBoard
+
+	// videos maps the videos being downloaded to their job, inputs resolving
+	// to the same video would write the same directory and journal
+	videosMu sync.Mutex
+	videos   map[string]int
+}
+
+// readBatchInputs reads the video URLs or UIDs of a batch from listPath, or
+// from stdin when listPath is "-". Blank lines, lines starting with # and
+// repeated lines are skipped
+func readBatchInputs(listPath string) ([]string, error) {
+	var input io.Reader = os.Stdin
+	if listPath != "-" {
+		file, err := os.Open(listPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	inputs := []string{}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || seen[line] {
+			continue
+		}
+		seen[line] = true
+		inputs = append(inputs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("%s doesn't list any video", listPath)
+	}
+	return inputs, nil
+}
+
+// runBatch downloads every input with a pool of workers. Every video is
+// downloaded into its own <uid>/ directory unless an output template is given.
+// A failing video doesn't stop the others, the outcome of each is listed once
+// all of them are done
+func runBatch(ctx context.Context, inputs []string, workers int, opts stream.DownloadOptions) error {
+	if workers < 1 {
+		return fmt.Errorf("--workers must be at least 1, got %d", workers)
+	}
+	if workers > len(inputs) {
+		workers = len(inputs)
+	}
+
+	if opts.Template == "" {
+		opts.Template = stream.VIDEO_OUTPUT_TEMPLATE
+	}
+
+	jobs := make([]*batchJob, len(inputs))
+	for idx, input := range inputs {
+		jobs[idx] = &batchJob{input: input}
+	}
+	run := &batchRun{
+		opts:   opts,
+		board:  newBatchBoard(inputs),
+		videos: make(map[string]int),
+	}
+
+	fmt.Printf("📦 Downloading %d videos with %d workers\n", len(jobs), workers)
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range queue {
+				run.download(ctx, idx, jobs[idx])
+			}
+		}()
+	}
+	for idx := range jobs {
+		queue <- idx
+	}
+	close(queue)
+	wg.Wait()
+
+	failed := printBatchSummary(jobs)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d batch downloads failed", failed, len(jobs))
+	}
+	return nil
+}
+
+// download runs a single job and records its outcome on the job
+func (b *batchRun) download(ctx context.Context, idx int, job *batchJob) {
+	if err := ctx.Err(); err != nil {
+		job.err = err
+		b.board.update(idx, "⏸ not started, the batch was interrupted")
+		return
+	}
+	started := time.Now()
+	b.board.update(idx, "🔎 resolving the video")
+
+	source, err := downloader.Resolve(ctx, job.input)
+	if err != nil {
+		job.err = err
+		b.board.update(idx, fmt.Sprintf("❌ failed: %v", err))
+		return
+	}
+	if first := b.claimVideo(source, idx); first != idx {
+		job.duplicateOf = first + 1
+		b.board.update(idx, fmt.Sprintf("⏭ skipped, the same video as #%d", job.duplicateOf))
+		return
+	}
+
+	job.output, job.err = b.downloadVideo(ctx, idx, source)
+	job.elapsed = time.Since(started).Round(time.Second)
+	if job.err != nil {
+		b.board.update(idx, fmt.Sprintf("❌ failed after %s: %v", job.elapsed, job.err))
+		return
+	}
+	b.board.update(idx, fmt.Sprintf("✅ done in %s: %s", job.elapsed, displayPaths(job.output)))
+}
+
+// claimVideo reserves the video of source for job idx and returns the job
+// downloading it, which is idx unless an earlier job claimed it
+func (b *batchRun) claimVideo(source *stream.Source, idx int) int {
+	b.videosMu.Lock()
+	defer b.videosMu.Unlock()
+
+	// the UID names the video whatever URL form the input used
+	key := source.UID
+	if key == "" {
+		key = source.ManifestURL
+		if parsed, err := url.Parse(source.ManifestURL); err == nil {
+			parsed.RawQuery, parsed.Fragment = "", ""
+			key = parsed.String()
+		}
+	}
+	if first, claimed := b.videos[key]; claimed {
+		return first
+	}
+	b.videos[key] = idx
+	return idx
+}
+
+// downloadVideo opens the resolved video and downloads it, reporting the
+// progress on the line of the job
+func (b *batchRun) downloadVideo(ctx context.Context, idx int, source *stream.Source) ([]string, error) {
+	opts := b.opts
+	logged := time.Now()
+	opts.OnEvent = func(event stream.Event) {
+		switch event.Type {
+		case stream.EVENT_MESSAGE, stream.EVENT_SELECTED:
+			b.board.update(idx, event.Message)
+		case stream.EVENT_PROGRESS:
+			if time.Since(logged) >= PROGRESS_LOG_INTERVAL {
+				logged = time.Now()
+				b.board.update(idx, progressLine(event.Progress))
+			}
+		case stream.EVENT_TRANSFER_DONE:
+			b.board.update(idx, transferSummary(event.Progress))
+		}
+	}
+	video, err := downloader.OpenSource(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	return video.Download(ctx, opts)
+}
+
+// displayPaths formats the output directories of a job
+func displayPaths(directories []string) string {
+	paths := make([]string, len(directories))
+	for idx, directory := range directories {
+		paths[idx] = displayPath(directory)
+	}
+	return strings.Join(paths, ", ")
+}
+
+// batchBoard shows a status line per job. On a terminal the lines are
+// redrawn in place, otherwise every status change is printed on a new line
+type batchBoard struct {
+	mu          sync.Mutex
+	labels      []string
+	lines       []string
+	interactive bool
+	drawn       bool
+}
+
+// newBatchBoard creates a board with a queued line for every input
+func newBatchBoard(inputs []string) *batchBoard {
+	board := &batchBoard{
+		labels: make([]string, len(inputs)),
+		lines:  make([]string, len(inputs)),
+	}
+	for idx, input := range inputs {
+		board.labels[idx] = fmt.Sprintf("[%d/%d] %s", idx+1, len(inputs), truncate(input, 40))
+		board.lines[idx] = "⏳ queued"
+	}
+	if stat, err := os.Stdout.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		board.interactive = true
+	}
+	return board
+}
+
+// update sets the status of a job
+func (b *batchBoard) update(idx int, status string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lines[idx] = truncate(strings.ReplaceAll(status, "\n", " "), BATCH_STATUS_WIDTH)
+	if !b.interactive {
+		fmt.Printf("%s %s\n", b.labels[idx], b.lines[idx])
+		return
+	}
+
+	if b.drawn {
+		fmt.Printf("\033[%dA", len(b.lines))
+	}
+	for line := range b.lines {
+		fmt.Printf("\r\033[2K%s %s\n", b.labels[line], b.lines[line])
+	}
+	b.drawn = true
+}
+
+// truncate shortens text to at most width runes
+func truncate(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) <= width {
+		return text
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// printBatchSummary lists the outcome of every job and returns the number of
+// failed jobs
+func printBatchSummary(jobs []*batchJob) int {
+	failed, duplicates := 0, 0
+	for _, job := range jobs {
+		switch {
+		case job.err != nil:
+			failed++
+		case job.duplicateOf > 0:
+			duplicates++
+		}
+	}
+
+	fmt.Printf("\n📋 Batch finished: %d succeeded, %d failed, %d duplicates skipped\n\n", len(jobs)-failed-duplicates, failed, duplicates)
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "#\tSTATUS\tTIME\tINPUT\tRESULT")
+	for idx, job := range jobs {
+		status, result := "ok", displayPaths(job.output)
+		if job.duplicateOf > 0 {
+			status, result = "duplicate", fmt.Sprintf("same video as #%d", job.duplicateOf)
+		} else if errors.Is(job.err, context.Canceled) {
+			status, result = "interrupted", job.err.Error()
+		} else if job.err != nil {
+			status, result = "failed", job.err.Error()
+		}
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\n", idx+1, status, job.elapsed, job.input, result)
+	}
+	writer.Flush()
+	return failed
+}
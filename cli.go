@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Schachte/cloudflare-stream-downloader/stream"
+)
+
+const (
+	COMMAND_DOWNLOAD     = "download"
+	COMMAND_LIST         = "list"
+	COMMAND_COUNT        = "count"
+	COMMAND_MANIFEST_URL = "manifest-url"
+	COMMAND_UPLOAD       = "upload"
+	COMMAND_RECORD       = "record"
+	COMMAND_AUDIO        = "audio"
+	COMMAND_BATCH        = "batch"
+	COMMAND_MIRROR       = "mirror"
+	COMMAND_SERVE        = "serve"
+	COMMAND_INSPECT      = "inspect"
+)
+
+// commandDescriptions is the ordered list of subcommands shown in the usage output
+var commandDescriptions = [][2]string{
+	{COMMAND_DOWNLOAD, "Download video and segments for a resolution"},
+	{COMMAND_BATCH, "Download every video listed in a file (or stdin) with a pool of workers"},
+	{COMMAND_MIRROR, "Save the playlists and segments with local URIs so the video plays offline"},
+	{COMMAND_LIST, "List available resolutions"},
+	{COMMAND_AUDIO, "List audio tracks with their group, language, name and default flag"},
+	{COMMAND_COUNT, "Count number of segments for a resolution"},
+	{COMMAND_INSPECT, "Report segments, durations, encryption and estimated size of every rendition"},
+	{COMMAND_MANIFEST_URL, "Output m3u8 manifest URL for a specific resolution"},
+	{COMMAND_UPLOAD, "Upload video from local file"},
+	{COMMAND_SERVE, "Serve mirrored or downloaded videos over HTTP with a player page"},
+	{COMMAND_RECORD, "Record a live stream or DVR window until it ends, the duration limit or Ctrl-C"},
+}
+
+// commandOptions holds the flags shared by the non-interactive subcommands
+type commandOptions struct {
+	stream.DownloadOptions
+	manifestURL  string
+	client       clientOptions
+	jsonOutput   bool
+	format       string
+	duration     time.Duration
+	listPath     string
+	workers      int
+	headRequests bool
+}
+
+// isCommand reports whether name is one of the non-interactive subcommands
+func isCommand(name string) bool {
+	for _, description := range commandDescriptions {
+		if description[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runCommand parses the flags for a subcommand and runs it without opening
+// the interactive menu
+func runCommand(ctx context.Context, name string, args []string) error {
+	opts := commandOptions{}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+
+	switch name {
+	case COMMAND_UPLOAD:
+		var filePath, uploadURL string
+		flags.StringVar(&filePath, "file", "", "absolute path of the video file to upload")
+		flags.StringVar(&uploadURL, "resume", "", "upload URL printed by an interrupted upload of the same file, the upload continues where it stopped")
+		opts.client.register(flags)
+		positional := parseFlags(flags, args)
+		if filePath == "" && len(positional) > 0 {
+			filePath = positional[0]
+		}
+		if filePath == "" {
+			return errors.New("upload requires a file path")
+		}
+		if err := opts.client.apply(); err != nil {
+			return err
+		}
+		initUpload(ctx, filePath, uploadURL)
+		return nil
+	case COMMAND_SERVE:
+		var directory, address string
+		flags.StringVar(&directory, "dir", "", "directory holding the mirrored or downloaded videos, e.g. the --output of mirror (the working directory when omitted). Can also be passed as the first argument")
+		flags.StringVar(&address, "addr", DEFAULT_SERVE_ADDRESS, "address to listen on, use :8080 to accept connections from other machines")
+		positional := parseFlags(flags, args)
+		if directory == "" && len(positional) > 0 {
+			directory = positional[0]
+		}
+		if directory == "" {
+			directory = "."
+		}
+		return serveDirectory(ctx, directory, address)
+	case COMMAND_DOWNLOAD, COMMAND_BATCH, COMMAND_COUNT, COMMAND_MIRROR:
+		registerOutputFlags(flags, &opts.DownloadOptions)
+		registerRetryFlags(flags)
+		if name == COMMAND_BATCH {
+			flags.StringVar(&opts.listPath, "file", "", "file listing a video URL or UID per line, - reads the list from stdin. Can also be passed as the first argument")
+			flags.IntVar(&opts.workers, "workers", 2, "number of videos downloaded at the same time")
+		}
+		if name == COMMAND_MIRROR {
+			registerAudioFlags(flags, &opts.Audio)
+			flags.IntVar(&downloader.Concurrency, "concurrency", downloader.Concurrency, "number of segments downloaded at the same time across all renditions")
+		} else if name != COMMAND_COUNT {
+			registerAudioFlags(flags, &opts.Audio)
+			registerClipFlags(flags, &opts.Clip)
+			flags.BoolVar(&opts.AllRenditions, "all-renditions", false, "download every resolution into <uid>/<resolution>/, fetching each audio group only once")
+			flags.IntVar(&downloader.Concurrency, "concurrency", downloader.Concurrency, "number of segments downloaded at the same time across all renditions")
+			flags.StringVar(&opts.Subtitles, "subtitles", stream.SUBTITLES_SIDECAR, "how to store WebVTT subtitles: sidecar (.vtt files), embed (mov_text tracks in merged.mp4) or none")
+			flags.StringVar(&downloader.Muxer, "muxer", downloader.Muxer, "how to merge the renditions into merged.mp4: native or ffmpeg, ffmpeg by default when it is installed")
+		}
+	case COMMAND_INSPECT:
+		flags.BoolVar(&opts.headRequests, "head", true, "size the renditions with HEAD requests on every segment, BANDWIDTH × duration is used when disabled or when a request fails")
+		flags.IntVar(&downloader.Concurrency, "concurrency", downloader.Concurrency, "number of HEAD requests sent at the same time")
+	case COMMAND_RECORD:
+		registerOutputFlags(flags, &opts.DownloadOptions)
+		registerAudioFlags(flags, &opts.Audio)
+		flags.IntVar(&downloader.Concurrency, "concurrency", downloader.Concurrency, "number of segments downloaded at the same time across all renditions")
+		flags.StringVar(&downloader.Muxer, "muxer", downloader.Muxer, "how to merge the renditions into merged.mp4: native or ffmpeg, ffmpeg by default when it is installed")
+		flags.DurationVar(&opts.duration, "duration", 0, "stop after recording this much media, e.g. 90m (records until the stream ends when omitted)")
+	}
+
+	if name != COMMAND_BATCH {
+		flags.StringVar(&opts.manifestURL, "manifestUrl", "", "HLS or DASH manifest, embed, watch or thumbnail URL, page embedding the video, or video UID. Can also be passed as the first argument")
+	}
+	flags.StringVar(&downloader.Customer, "customer", "", "customer subdomain (customer-<code>.cloudflarestream.com) used for bare video UIDs and iframe embeds")
+	registerTokenFlags(flags, &downloader.Tokens)
+	opts.client.register(flags)
+	if name != COMMAND_LIST && name != COMMAND_AUDIO && name != COMMAND_INSPECT {
+		help := "resolution to use, e.g. 1280x720, or selection rules such as best, worst, <=720p, bandwidth<=3m, fps<=30 and avc1 or hvc1, comma separated (prompts when omitted)"
+		if name == COMMAND_MIRROR {
+			help = "resolution or selection rules of the only rendition to mirror, every rendition with every audio track is mirrored when omitted"
+		}
+		flags.StringVar(&opts.Resolution, "resolution", "", help)
+	}
+	if name != COMMAND_DOWNLOAD && name != COMMAND_BATCH && name != COMMAND_RECORD && name != COMMAND_MIRROR {
+		flags.StringVar(&opts.format, "format", FORMAT_TEXT, "output format: text, json or yaml")
+		flags.BoolVar(&opts.jsonOutput, "json", false, "alias for --format json")
+	}
+	positional := parseFlags(flags, args)
+
+	switch opts.Subtitles {
+	case "", stream.SUBTITLES_SIDECAR, stream.SUBTITLES_EMBED, stream.SUBTITLES_NONE:
+	default:
+		return fmt.Errorf("unknown subtitles mode %s, choose one of: %s, %s, %s", opts.Subtitles, stream.SUBTITLES_SIDECAR, stream.SUBTITLES_EMBED, stream.SUBTITLES_NONE)
+	}
+	if err := opts.client.apply(); err != nil {
+		return err
+	}
+	if opts.jsonOutput {
+		opts.format = FORMAT_JSON
+	}
+	if opts.format != "" {
+		if err := validateFormat(opts.format); err != nil {
+			return err
+		}
+	}
+	if err := opts.Clip.Validate(); err != nil {
+		return err
+	}
+	if err := stream.ValidateOutputTemplate(opts.Template, name == COMMAND_BATCH); err != nil {
+		return err
+	}
+	if opts.AllRenditions && opts.Resolution != "" {
+		return errors.New("--all-renditions downloads every resolution and can't be combined with --resolution")
+	}
+	if downloader.Muxer != stream.MUXER_NATIVE && downloader.Muxer != stream.MUXER_FFMPEG {
+		return fmt.Errorf("unknown muxer %s, choose one of: %s, %s", downloader.Muxer, stream.MUXER_NATIVE, stream.MUXER_FFMPEG)
+	}
+
+	if opts.OutputPath != "" && !fileExists(opts.OutputPath) {
+		return fmt.Errorf("absolute path %s does not exist", opts.OutputPath)
+	}
+
+	if name == COMMAND_BATCH {
+		if opts.listPath == "" && len(positional) > 0 {
+			opts.listPath = positional[0]
+		}
+		if opts.listPath == "" {
+			return errors.New("batch requires a file listing the videos, or - to read them from stdin")
+		}
+		inputs, err := readBatchInputs(opts.listPath)
+		if err != nil {
+			return err
+		}
+		// jobs can't prompt for a resolution
+		if opts.Resolution == "" && !opts.AllRenditions {
+			opts.Resolution = stream.SELECT_BEST
+		}
+		if err := runBatch(ctx, inputs, opts.workers, opts.DownloadOptions); err != nil {
+			exitIfInterrupted(ctx, RESUME_DOWNLOAD_HINT)
+			return err
+		}
+		return nil
+	}
+
+	if opts.manifestURL == "" && len(positional) > 0 {
+		opts.manifestURL = positional[0]
+	}
+	if opts.manifestURL == "" {
+		return fmt.Errorf("%s requires a video URL or UID", name)
+	}
+
+	switch name {
+	case COMMAND_DOWNLOAD:
+		initializeVideoDownloadProcess(ctx, openVideo(ctx, opts.manifestURL), opts.DownloadOptions)
+	case COMMAND_LIST:
+		listAvailableResolutions(ctx, openVideo(ctx, opts.manifestURL), opts.format)
+	case COMMAND_AUDIO:
+		listAudioTracks(ctx, opts.manifestURL, opts.format)
+	case COMMAND_COUNT:
+		countTotalSegments(ctx, openVideo(ctx, opts.manifestURL), opts.Resolution, opts.format)
+	case COMMAND_MANIFEST_URL:
+		outputManifestURL(ctx, openVideo(ctx, opts.manifestURL), opts.Resolution, opts.format)
+	case COMMAND_INSPECT:
+		inspectManifest(ctx, opts.manifestURL, opts.headRequests, opts.format)
+	case COMMAND_RECORD:
+		recordLiveStream(ctx, opts.manifestURL, opts.DownloadOptions, opts.duration)
+	case COMMAND_MIRROR:
+		mirrorVideo(ctx, opts.manifestURL, opts.DownloadOptions)
+	}
+	return nil
+}
+
+// registerOutputFlags adds the flags placing the downloaded files
+func registerOutputFlags(flags *flag.FlagSet, opts *stream.DownloadOptions) {
+	flags.StringVar(&opts.OutputPath, "output", "", "root directory of every segment, journal and output file (the working directory when omitted)")
+	flags.StringVar(&opts.OutputPath, "outputPath", "", "alias for --output")
+	flags.StringVar(&opts.Template, "output-template", "", "path of the output files below --output with the placeholders {uid}, {resolution}, {bandwidth}, {date}, {name} and {ext}, e.g. {uid}/{date}/{resolution}_{name}.{ext}. The segments are kept next to them (default "+stream.DEFAULT_OUTPUT_TEMPLATE+", "+stream.VIDEO_OUTPUT_TEMPLATE+" with batch and --all-renditions)")
+}
+
+// parseFlags parses args allowing positional arguments to appear before,
+// between or after the flags and returns the positional arguments
+func parseFlags(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// printUsage lists the subcommands followed by the flags for the interactive menu
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage:\n  %s <command> [flags] [video url or uid]\n  %s [flags]    (interactive menu)\n\nCommands:\n", os.Args[0], os.Args[0])
+	for _, description := range commandDescriptions {
+		fmt.Fprintf(out, "  %-14s %s\n", description[0], description[1])
+	}
+	fmt.Fprintf(out, "\nRun '%s <command> --help' for the flags of a command.\n\nInteractive flags:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clientOptions holds the flags configuring the HTTP client of the downloader
+type clientOptions struct {
+	connectTimeout  time.Duration
+	readTimeout     time.Duration
+	proxy           string
+	headers         headerFlags
+	referer         string
+	userAgent       string
+	cookieFile      string
+	caBundle        string
+	maxIdleConns    int
+	maxConnsPerHost int
+	idleConnTimeout time.Duration
+}
+
+// headerFlags collects repeated --header flags
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header %q must look like \"Name: value\"", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// register adds the HTTP client flags to a flag set
+func (o *clientOptions) register(flags *flag.FlagSet) {
+	flags.DurationVar(&o.connectTimeout, "connect-timeout", 30*time.Second, "timeout for establishing a connection, including the TLS handshake")
+	flags.DurationVar(&o.readTimeout, "read-timeout", time.Minute, "timeout for a stalled connection, waiting for a response or for more of its body (0 disables it)")
+	flags.StringVar(&o.proxy, "proxy", "", "proxy for every request, e.g. http://host:3128 or socks5://host:1080 (HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used when omitted)")
+	flags.Var(&o.headers, "header", "extra request header as \"Name: value\", can be repeated")
+	flags.StringVar(&o.referer, "referer", "", "Referer header, needed for videos restricted with allowedOrigins")
+	flags.StringVar(&o.userAgent, "user-agent", "", "User-Agent header")
+	flags.StringVar(&o.cookieFile, "cookies", "", "Netscape cookies.txt file loaded into the cookie jar")
+	flags.StringVar(&o.caBundle, "ca-bundle", "", "PEM file of extra certificate authorities trusted for TLS")
+	flags.IntVar(&o.maxIdleConns, "max-idle-conns", 100, "number of idle connections kept open across all hosts")
+	flags.IntVar(&o.maxConnsPerHost, "max-conns-per-host", 0, "number of connections per host, 0 for no limit")
+	flags.DurationVar(&o.idleConnTimeout, "idle-conn-timeout", 90*time.Second, "how long an idle connection is kept open")
+}
+
+// apply builds the client from the flags and installs it in the downloader
+func (o *clientOptions) apply() error {
+	client, err := o.client()
+	if err != nil {
+		return err
+	}
+	downloader.HTTPClient = client
+	return nil
+}
+
+// client builds an HTTP client from the flags
+func (o *clientOptions) client() (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if o.proxy != "" {
+		proxyURL, err := url.Parse(o.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %v", o.proxy, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %s, use http, https or socks5", proxyURL.Scheme)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{}
+	if o.caBundle != "" {
+		pool, err := loadCABundle(o.caBundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{Timeout: o.connectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   o.connectTimeout,
+		ResponseHeaderTimeout: o.readTimeout,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          o.maxIdleConns,
+		MaxIdleConnsPerHost:   o.maxIdleConns,
+		MaxConnsPerHost:       o.maxConnsPerHost,
+		IdleConnTimeout:       o.idleConnTimeout,
+	}
+
+	headers := http.Header{}
+	for _, header := range o.headers {
+		name, value, _ := strings.Cut(header, ":")
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if o.referer != "" {
+		headers.Set("Referer", o.referer)
+	}
+	if o.userAgent != "" {
+		headers.Set("User-Agent", o.userAgent)
+	}
+
+	var base http.RoundTripper = transport
+	if o.readTimeout > 0 {
+		base = &stallTransport{base: transport, timeout: o.readTimeout}
+	}
+	client := &http.Client{Transport: &headerTransport{base: base, headers: headers}}
+	if o.cookieFile != "" {
+		jar, err := loadCookieJar(o.cookieFile)
+		if err != nil {
+			return nil, err
+		}
+		client.Jar = jar
+	}
+	return client, nil
+}
+
+// headerTransport adds the configured headers to requests that don't set
+// them already
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.headers) == 0 {
+		return t.base.RoundTrip(req)
+	}
+	// a RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		if req.Header.Get(name) == "" {
+			req.Header[name] = values
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// stallTransport fails a response body read that doesn't receive any data
+// within timeout, which bounds stalled transfers without limiting the duration
+// of large downloads. Only the request is cancelled, idle connections of the
+// pool are left alone
+type stallTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *stallTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &stallBody{ReadCloser: resp.Body, timeout: t.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(t.timeout, func() {
+		body.stalled.Store(true)
+		cancel()
+	})
+	// the timer only runs while a read is waiting for data
+	body.timer.Stop()
+	resp.Body = body
+	return resp, nil
+}
+
+// stallBody cancels its request when a read waits longer than timeout
+type stallBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled atomic.Bool
+}
+
+func (b *stallBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && b.stalled.Load() {
+		return n, &stallError{timeout: b.timeout}
+	}
+	return n, err
+}
+
+func (b *stallBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// stallError is a net.Error so the downloader retries stalled transfers
+type stallError struct {
+	timeout time.Duration
+}
+
+func (e *stallError) Error() string {
+	return fmt.Sprintf("no data received for %s", e.timeout)
+}
+
+func (e *stallError) Timeout() bool   { return true }
+func (e *stallError) Temporary() bool { return true }
+
+// loadCABundle returns the system certificate pool extended with the
+// certificates of a PEM file
+func loadCABundle(bundlePath string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s doesn't contain any PEM certificate", bundlePath)
+	}
+	return pool, nil
+}
+
+// loadCookieJar reads a cookies.txt file in the Netscape format exported by
+// browsers, curl and yt-dlp into a cookie jar
+func loadCookieJar(cookiePath string) (http.CookieJar, error) {
+	file, err := os.Open(cookiePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		// trailing tabs belong to an empty value
+		text := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(text, "#HttpOnly_")
+		text = strings.TrimPrefix(text, "#HttpOnly_")
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// domain, include subdomains, path, secure, expiry, name, value
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("%s:%d: expected 7 tab separated fields, got %d", cookiePath, line, len(fields))
+		}
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid expiry %s", cookiePath, line, fields[4])
+		}
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if expiry > 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+		}
+		host := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = host
+		}
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: "/"}, []*http.Cookie{cookie})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/Schachte/cloudflare-stream-downloader/stream"
+)
+
+// registerTokenFlags adds the signed URL token flags to a flag set
+func registerTokenFlags(flags *flag.FlagSet, tokens *stream.TokenOptions) {
+	flags.StringVar(&tokens.Token, "token", "", "signed URL token used in place of the video UID")
+	flags.StringVar(&tokens.SigningKeyID, "signing-key-id", "", "ID of the Stream signing key used to mint a token locally")
+	flags.StringVar(&tokens.SigningKeyPEM, "signing-key-pem", "", "signing key as returned by the Stream API (base64 encoded PEM), a PEM string or a path to a PEM file")
+	flags.DurationVar(&tokens.ExpiresIn, "token-expires-in", stream.DEFAULT_TOKEN_EXPIRES_IN, "lifetime of a locally minted token (exp claim)")
+	flags.DurationVar(&tokens.NotBefore, "token-not-before", 0, "offset from now before a locally minted token becomes valid (nbf claim)")
+	flags.StringVar(&tokens.AccessRules, "token-access-rules", "", "JSON array of access rules for a locally minted token, or @path to a JSON file")
+	flags.BoolVar(&tokens.Downloadable, "token-downloadable", false, "set the downloadable claim on a locally minted token")
+}
+
+// registerClipFlags adds the --start and --end flags to flags
+func registerClipFlags(flags *flag.FlagSet, clip *stream.Clip) {
+	flags.Func("start", "only download from this time on, in seconds or [hh:]mm:ss[.ms]", func(value string) error {
+		var err error
+		clip.Start, err = stream.ParseClipTime(value)
+		return err
+	})
+	flags.Func("end", "only download up to this time, in seconds or [hh:]mm:ss[.ms]", func(value string) error {
+		var err error
+		clip.End, err = stream.ParseClipTime(value)
+		return err
+	})
+}
+
+// registerAudioFlags adds the audio selection flags to a flag set
+func registerAudioFlags(flags *flag.FlagSet, audio *stream.AudioSelection) {
+	flags.StringVar(&audio.Languages, "audio-lang", "", "comma separated audio languages to download, e.g. en,de, or all (the default track when omitted)")
+	flags.StringVar(&audio.Names, "audio-name", "", "comma separated audio track names to download, e.g. \"English,Director's commentary\"")
+}
+
+// registerRetryFlags adds the retry flags of the segment downloads
+func registerRetryFlags(flags *flag.FlagSet) {
+	flags.IntVar(&downloader.Retries, "retries", downloader.Retries, "number of retries for a failed segment download")
+	flags.DurationVar(&downloader.RetryDelay, "retry-delay", downloader.RetryDelay, "initial backoff delay between retries, doubled on every attempt")
+	flags.DurationVar(&downloader.RetryMaxDelay, "retry-max-delay", downloader.RetryMaxDelay, "maximum backoff delay between retries")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+	FORMAT_YAML = "yaml"
+)
+
+// validateFormat checks the value of --format
+func validateFormat(format string) error {
+	switch format {
+	case FORMAT_TEXT, FORMAT_JSON, FORMAT_YAML:
+		return nil
+	}
+	return fmt.Errorf("unknown format %s, choose one of: %s, %s, %s", format, FORMAT_TEXT, FORMAT_JSON, FORMAT_YAML)
+}
+
+// printFormatted writes v to stdout as JSON or YAML
+func printFormatted(format string, v interface{}) error {
+	if format != FORMAT_YAML {
+		return printJSON(v)
+	}
+
+	data, err := marshalYAML(v)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// marshalYAML encodes v as a YAML document. The document is converted from
+// the JSON encoding so both use the json struct tags and keep the field order
+func marshalYAML(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	node, err := decodeNode(decoder)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	writeYAML(&out, node, 0, false)
+	return out.Bytes(), nil
+}
+
+// yamlNode is a decoded JSON value with the key order of objects kept
+type yamlNode struct {
+	keys   []string
+	values []*yamlNode // object members or array items
+	array  bool
+	object bool
+	scalar interface{}
+}
+
+// decodeNode reads the next JSON value from decoder
+func decodeNode(decoder *json.Decoder) (*yamlNode, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return &yamlNode{scalar: token}, nil
+	}
+
+	node := &yamlNode{array: delim == '[', object: delim == '{'}
+	for decoder.More() {
+		if node.object {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			node.keys = append(node.keys, key.(string))
+		}
+		value, err := decodeNode(decoder)
+		if err != nil {
+			return nil, err
+		}
+		node.values = append(node.values, value)
+	}
+	// the closing delimiter
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// writeYAML writes node in block style. inline is set when the node follows
+// a "- " on the current line
+func writeYAML(out io.Writer, node *yamlNode, indent int, inline bool) {
+	pad := strings.Repeat("  ", indent)
+	switch {
+	case node.array && len(node.values) == 0:
+		fmt.Fprintln(out, "[]")
+	case node.object && len(node.values) == 0:
+		fmt.Fprintln(out, "{}")
+	case node.array:
+		for idx, value := range node.values {
+			if idx > 0 || !inline {
+				fmt.Fprint(out, pad)
+			}
+			fmt.Fprint(out, "- ")
+			writeYAML(out, value, indent+1, true)
+		}
+	case node.object:
+		for idx, key := range node.keys {
+			if idx > 0 || !inline {
+				fmt.Fprint(out, pad)
+			}
+			fmt.Fprintf(out, "%s:", yamlScalar(key))
+			value := node.values[idx]
+			if (value.array || value.object) && len(value.values) > 0 {
+				fmt.Fprintln(out)
+				writeYAML(out, value, indent+1, false)
+				continue
+			}
+			fmt.Fprint(out, " ")
+			writeYAML(out, value, indent+1, true)
+		}
+	default:
+		fmt.Fprintln(out, yamlScalar(node.scalar))
+	}
+}
+
+// yamlPlain matches the strings that may be written without quotes, anything
+// else is quoted. A leading dot or digit could be read as a number such as
+// .inf, .nan or 1e3
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_./+-]*$`)
+
+// yamlReserved are the words YAML 1.1 and 1.2 read as booleans or null in
+// any case
+var yamlReserved = map[string]bool{
+	"y": true, "n": true, "yes": true, "no": true, "true": true, "false": true,
+	"on": true, "off": true, "null": true,
+}
+
+// yamlScalar formats a JSON scalar, quoting strings YAML would read as
+// another type
+func yamlScalar(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return fmt.Sprint(value)
+	case json.Number:
+		return value.String()
+	case string:
+		if yamlPlain.MatchString(value) && !yamlReserved[strings.ToLower(value)] {
+			return value
+		}
+		// a JSON string is a valid double quoted YAML scalar
+		quoted, _ := json.Marshal(value)
+		return string(quoted)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// readYAMLScalar reads back a string written by yamlScalar, double quoted
+// scalars use the JSON escapes
+func readYAMLScalar(t *testing.T, scalar string) string {
+	t.Helper()
+	if !strings.HasPrefix(scalar, `"`) {
+		return scalar
+	}
+	var value string
+	if err := json.Unmarshal([]byte(scalar), &value); err != nil {
+		t.Fatalf("%s is not a double quoted scalar: %v", scalar, err)
+	}
+	return value
+}
+
+func TestYAMLScalar(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		quoted bool
+	}{
+		{"yes", "yes", true},
+		{"capitalised no", "No", true},
+		{"null", "null", true},
+		{"upper case null", "NULL", true},
+		{"tilde", "~", true},
+		{"on", "on", true},
+		{"single letter boolean", "y", true},
+		{"integer", "1080", true},
+		{"negative number", "-5", true},
+		{"float without a leading digit", ".5", true},
+		{"infinity", ".inf", true},
+		{"exponent", "1e3", true},
+		{"hex", "0x1F", true},
+		{"leading zero", "007", true},
+		{"leading dash", "-flag", true},
+		{"sequence entry", "- item", true},
+		{"leading colon", ":port", true},
+		{"mapping", "key: value", true},
+		{"leading hash", "#comment", true},
+		{"comment after a space", "a #b", true},
+		{"multi-line", "line1\nline2", true},
+		{"trailing newline", "line\n", true},
+		{"empty", "", true},
+		{"leading space", " padded", true},
+		{"tab", "a\tb", true},
+		{"double quote", `say "hi"`, true},
+		{"backslash", `C:\videos`, true},
+		{"non-ASCII", "vidéo", true},
+		{"word", "yesterday", false},
+		{"resolution", "x1280", false},
+		{"codec", "avc1.4d401f", false},
+		{"path", "videos/1280x720/video.mp4", false},
+		{"identifier", "stream_720-hd+", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scalar := yamlScalar(test.value)
+			if quoted := strings.HasPrefix(scalar, `"`); quoted != test.quoted {
+				t.Errorf("yamlScalar(%q) = %s, quoted %v, want %v", test.value, scalar, quoted, test.quoted)
+			}
+			if strings.ContainsAny(scalar, "\n\t") {
+				t.Errorf("yamlScalar(%q) = %s spans several lines", test.value, scalar)
+			}
+			if got := readYAMLScalar(t, scalar); got != test.value {
+				t.Errorf("yamlScalar(%q) reads back as %q", test.value, got)
+			}
+		})
+	}
+}
+
+func TestYAMLScalarTypes(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{false, "false"},
+		{json.Number("1.5e3"), "1.5e3"},
+		{json.Number("-7"), "-7"},
+	}
+	for _, test := range tests {
+		if got := yamlScalar(test.value); got != test.want {
+			t.Errorf("yamlScalar(%#v) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestMarshalYAML(t *testing.T) {
+	type item struct {
+		ID   string `json:"id"`
+		Note string `json:"note"`
+	}
+	document := struct {
+		Name    string            `json:"name"`
+		Empty   string            `json:"empty"`
+		Tags    []string          `json:"tags"`
+		None    []string          `json:"none"`
+		Blank   []string          `json:"blank"`
+		Object  map[string]string `json:"object"`
+		Items   []item            `json:"items"`
+		Nested  [][]int           `json:"nested"`
+		Count   int               `json:"count"`
+		Ratio   float64           `json:"ratio"`
+		OK      bool              `json:"ok"`
+		Nothing *string           `json:"nothing"`
+		Reserve string            `json:"null"`
+	}{
+		Name:    "yes",
+		Tags:    []string{"-1", "a: b"},
+		Blank:   []string{},
+		Object:  map[string]string{},
+		Items:   []item{{"007", "line1\nline2"}, {"x", "#tag"}},
+		Nested:  [][]int{{1, 2}, {}},
+		Count:   3,
+		Ratio:   0.5,
+		OK:      true,
+		Reserve: "~",
+	}
+	want := `name: "yes"
+empty: ""
+tags:
+  - "-1"
+  - "a: b"
+none: null
+blank: []
+object: {}
+items:
+  - id: "007"
+    note: "line1\nline2"
+  - id: x
+    note: "#tag"
+nested:
+  - - 1
+    - 2
+  - []
+count: 3
+ratio: 0.5
+ok: true
+nothing: null
+"null": "~"
+`
+	got, err := marshalYAML(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("marshalYAML() =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Schachte/cloudflare-stream-downloader/stream"
+)
+
+// inspectManifest prints a report of every rendition, the segment sizes are
+// requested with HEAD requests unless headRequests is false
+func inspectManifest(ctx context.Context, input string, headRequests bool, format string) {
+	video := openVideo(ctx, input)
+	if format == FORMAT_TEXT {
+		fmt.Printf("🔍 Inspecting the renditions of video UID: %s\n\n", video.VideoUID)
+	}
+
+	report, err := video.Inspect(ctx, headRequests)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if format != FORMAT_TEXT {
+		if err := printFormatted(format, report); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printInspectReport(report)
+}
+
+// printInspectReport prints a table of the renditions
+func printInspectReport(report *stream.InspectReport) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "TYPE\tNAME\tPLAYLIST\tSEGMENTS\tDURATION\tAVG\tTARGET\tENCRYPTION\tDISCONTINUITIES\tSIZE")
+	for _, rendition := range report.Renditions {
+		encryption := "none"
+		if len(rendition.Encryption) > 0 {
+			encryption = strings.Join(rendition.Encryption, ",")
+		}
+		size := "unknown"
+		switch rendition.SizeSource {
+		case stream.SIZE_FROM_HEAD:
+			size = formatBytes(rendition.EstimatedBytes)
+		case stream.SIZE_FROM_BANDWIDTH:
+			size = "~" + formatBytes(rendition.EstimatedBytes)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%ss\t%ss\t%ss\t%s\t%d\t%s\n",
+			rendition.Type,
+			rendition.Name,
+			rendition.PlaylistType,
+			rendition.Segments,
+			strconv.FormatFloat(rendition.Duration, 'f', -1, 64),
+			strconv.FormatFloat(rendition.AverageSegmentDuration, 'f', -1, 64),
+			strconv.FormatFloat(rendition.TargetDuration, 'f', -1, 64),
+			encryption,
+			rendition.Discontinuities,
+			size,
+		)
+	}
+	writer.Flush()
+	for _, rendition := range report.Renditions {
+		if rendition.SizeSource == stream.SIZE_FROM_BANDWIDTH {
+			fmt.Println("\nSizes starting with ~ are estimated from BANDWIDTH × duration")
+			break
+		}
+	}
+	fmt.Println()
+}
+
+// formatBytes formats a byte count with a binary unit
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, exponent := float64(size)/unit, 0
+	for value >= unit && exponent < 4 {
+		value /= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exponent])
+}
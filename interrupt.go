@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const (
+	// EXIT_INTERRUPTED is the exit status after an interrupt, as shells
+	// report a process stopped by SIGINT
+	EXIT_INTERRUPTED = 130
+	// RESUME_DOWNLOAD_HINT tells how to continue an interrupted download, the
+	// journals skip the segments already on disk
+	RESUME_DOWNLOAD_HINT = "the finished segments are kept, run the same command again to resume the download"
+)
+
+// handleInterrupts returns a context cancelled by the first SIGINT or SIGTERM,
+// which aborts the running requests so the command can keep its journals and
+// remove partial files. A second signal exits immediately
+func handleInterrupts() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 2)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		fmt.Fprintln(os.Stderr, "\n⏹ Stopping, press Ctrl-C again to exit immediately")
+		cancel()
+		<-interrupt
+		fmt.Fprintln(os.Stderr, "\n🚫 Exiting without cleaning up")
+		os.Exit(EXIT_INTERRUPTED)
+	}()
+	return ctx
+}
+
+// exitIfInterrupted exits once a command failed because of an interrupt,
+// printing how to resume it when resume is set
+func exitIfInterrupted(ctx context.Context, resume string) {
+	if ctx.Err() == nil {
+		return
+	}
+	if resume != "" {
+		fmt.Fprintf(os.Stderr, "⏸ Interrupted, %s\n", resume)
+	} else {
+		fmt.Fprintln(os.Stderr, "⏸ Interrupted")
+	}
+	os.Exit(EXIT_INTERRUPTED)
+}
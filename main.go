@@ -2,28 +2,17 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"flag"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
-	"path"
-	"path/filepath"
-	"regexp"
-	"strconv"
-	"strings"
-	"sync"
 
+	"github.com/Schachte/cloudflare-stream-downloader/stream"
 	"github.com/grafov/m3u8"
 	"github.com/manifoldco/promptui"
-	"github.com/schollz/progressbar/v3"
 )
 
 const (
@@ -36,20 +25,35 @@ const (
 	OPTION_EXIT                = "🚫 Exit"
 )
 
-type Video struct {
-	BaseURL            string
-	MasterManifestURL  string
-	VideoUID           string
-	RenditionManifests map[string]string
-
-	MasterPlaylist m3u8.MasterPlaylist
-}
+// downloader runs every command, the flags configure it before a command runs
+var downloader = stream.NewClient()
 
 func main() {
+	downloader.OnEvent = newProgressPrinter().handle
+	downloader.PromptVariant = printResolutionDownloadMenu
+	ctx := handleInterrupts()
+
+	if len(os.Args) > 1 && isCommand(os.Args[1]) {
+		if err := runCommand(ctx, os.Args[1], os.Args[2:]); err != nil {
+			exitIfInterrupted(ctx, "")
+			log.Fatal(err)
+		}
+		return
+	}
+
+	flag.Usage = printUsage
 	manifestURLPointer := flag.String("manifestUrl", "", "URL to download video. (-- needs to be prepended)")
+	flag.StringVar(&downloader.Customer, "customer", "", "customer subdomain used for bare video UIDs and iframe embeds. (-- needs to be prepended)")
 	absoluteOutputPathPointer := flag.String("outputPath", "", "path to output the audio and video segments along with the combined file. (-- needs to be prepended)")
+	registerTokenFlags(flag.CommandLine, &downloader.Tokens)
+	client := clientOptions{}
+	client.register(flag.CommandLine)
 	flag.Parse()
 
+	if err := client.apply(); err != nil {
+		log.Fatal(err)
+	}
+
 	manifestURL := *manifestURLPointer
 	absoluteOutputPath := *absoluteOutputPathPointer
 
@@ -59,7 +63,17 @@ func main() {
 		}
 	}
 
-	if manifestURL == "" {
+	var source *stream.Source
+	if manifestURL != "" {
+		var err error
+		source, err = normalizeManifestURL(ctx, manifestURL)
+		if err != nil {
+			exitIfInterrupted(ctx, "")
+			log.Fatal(err)
+		}
+	}
+
+	if source == nil {
 		fmt.Println("⚠️ WARNING: No HLS manifest was specified, so you will only be able to upload a video or add a manifest")
 	}
 
@@ -70,7 +84,7 @@ func main() {
 
 	var prompt promptui.Select
 	for {
-		if manifestURL != "" {
+		if source != nil {
 			options = append(options, []string{
 				OPTION_DOWNLOAD,
 				OPTION_OUTPUT_MANIFEST_URL,
@@ -92,9 +106,9 @@ func main() {
 
 		switch result {
 		case OPTION_DOWNLOAD:
-			initializeVideoDownloadProcess(manifestURL, absoluteOutputPath)
+			initializeVideoDownloadProcess(ctx, openSource(ctx, source), stream.DownloadOptions{OutputPath: absoluteOutputPath, Subtitles: stream.SUBTITLES_SIDECAR})
 		case OPTION_OUTPUT_MANIFEST_URL:
-			outputManifestURL(manifestURL)
+			outputManifestURL(ctx, openSource(ctx, source), "", FORMAT_TEXT)
 		case OPTION_UPLOAD_FILEPATH:
 			reader := bufio.NewReader(os.Stdin)
 			fmt.Print("Enter absolute video file path: ")
@@ -103,16 +117,27 @@ func main() {
 				log.Fatal(err)
 			}
 			filename = filename[:len(filename)-1]
-			initUpload(filename)
+			initUpload(ctx, filename, "")
 		case OPTION_LIST_RESOLUTIONS:
-			listAvailableResolutions(manifestURL)
+			listAvailableResolutions(ctx, openSource(ctx, source), FORMAT_TEXT)
 		case OPTION_COUNT_SEGMENTS:
-			countTotalSegments(manifestURL, absoluteOutputPath)
+			countTotalSegments(ctx, openSource(ctx, source), "", FORMAT_TEXT)
 		case OPTION_CHANGE_MANIFEST_URL:
-			fmt.Print("Enter new m3u8 manifest URL: ")
-			var userInput string
-			fmt.Scanln(&userInput)
-			manifestURL = userInput
+			// the video is asked for again until it resolves
+			for {
+				fmt.Print("Enter new m3u8 manifest, embed or thumbnail URL, or video UID: ")
+				var userInput string
+				if _, err := fmt.Scanln(&userInput); err == io.EOF {
+					log.Fatal("no video entered")
+				}
+				resolved, err := normalizeManifestURL(ctx, userInput)
+				if err == nil {
+					source = resolved
+					break
+				}
+				exitIfInterrupted(ctx, "")
+				fmt.Printf("❌ %v\n", err)
+			}
 		case OPTION_EXIT:
 			fmt.Println("👋 Exiting Stream downloader")
 			os.Exit(1)
@@ -122,462 +147,166 @@ func main() {
 	}
 }
 
-// outputManifestURL will output the m3u8 manifest URL for a specific video resolution
-func outputManifestURL(manifestURL string) {
-	baseURL, UID, err := extractUIDAndPrefixURL(manifestURL)
-	if err != nil {
-		log.Fatalf("there was a problem parsing the base url: %v", err)
-	}
-
-	video := Video{
-		MasterManifestURL: manifestURL,
-		BaseURL:           baseURL,
-		VideoUID:          UID,
-	}
-
-	masterPlaylist, err := video.retrieveMasterPlaylist(manifestURL)
-	if err != nil {
-		log.Fatalf("there was a problem retrieving master playlist: %v", err)
-	}
-	video.MasterPlaylist = *masterPlaylist
-
-	chosenManifest, _, err := video.printResolutionDownloadMenu()
+// openVideo opens the video behind input or exits with the error
+func openVideo(ctx context.Context, input string) *stream.Video {
+	video, err := downloader.Open(ctx, input)
 	if err != nil {
-		log.Fatalf("there was a problem selecting a download option: %v", err)
+		exitIfInterrupted(ctx, "")
+		log.Fatal(err)
 	}
-
-	fmt.Println(chosenManifest)
+	return video
 }
 
-// countTotalSegments will output the number of segments on a particular manifest
-func countTotalSegments(manifestURL string, absoluteOutputPath string) {
-	baseURL, UID, err := extractUIDAndPrefixURL(manifestURL)
+// openSource opens a video resolved before or exits with the error
+func openSource(ctx context.Context, source *stream.Source) *stream.Video {
+	video, err := downloader.OpenSource(ctx, source)
 	if err != nil {
-		log.Fatalf("there was a problem parsing the base url: %v", err)
-	}
-
-	video := Video{
-		MasterManifestURL: manifestURL,
-		BaseURL:           baseURL,
-		VideoUID:          UID,
-	}
-
-	masterPlaylist, err := video.retrieveMasterPlaylist(manifestURL)
-	if err != nil {
-		log.Fatalf("there was a problem retrieving master playlist: %v", err)
-	}
-	video.MasterPlaylist = *masterPlaylist
-
-	chosenManifest, chosenResolution, err := video.printResolutionDownloadMenu()
-	if err != nil {
-		log.Fatalf("there was a problem selecting a download option: %v", err)
-	}
-
-	segmentPaths, err := video.downloadSegmentsFromManifest(chosenManifest, chosenResolution, true, false, absoluteOutputPath)
-	if err != nil {
-		log.Fatalf("there was a problem downloading the segments: %v", err)
+		exitIfInterrupted(ctx, "")
+		log.Fatal(err)
 	}
-
-	fmt.Printf("There are a total of %d segments on the %s manifest\n",
-		len(segmentPaths),
-		chosenResolution,
-	)
+	return video
 }
 
-// listAvailableResolutions outputs all available resolutions from a manifest
-func listAvailableResolutions(manifestURL string) {
-	baseURL, UID, err := extractUIDAndPrefixURL(manifestURL)
-	if err != nil {
-		log.Fatalf("there was a problem parsing the base url: %v", err)
-	}
-
-	video := Video{
-		MasterManifestURL: manifestURL,
-		BaseURL:           baseURL,
-		VideoUID:          UID,
+// outputManifestURL will output the m3u8 manifest URL for a specific video
+// resolution. JSON and YAML list every variant when no resolution is given
+func outputManifestURL(ctx context.Context, video *stream.Video, resolution, format string) {
+	type renditionManifest struct {
+		Resolution  string `json:"resolution"`
+		ManifestURL string `json:"manifestUrl"`
 	}
 
-	masterPlaylist, err := video.retrieveMasterPlaylist(manifestURL)
-	if err != nil {
-		log.Fatalf("there was a problem retrieving master playlist: %v", err)
+	if format != FORMAT_TEXT && resolution == "" {
+		manifests := []renditionManifest{}
+		for _, variant := range video.Variants() {
+			manifests = append(manifests, renditionManifest{variant.Resolution, video.RenditionManifests[variant.Resolution]})
+		}
+		if err := printFormatted(format, manifests); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	video.MasterPlaylist = *masterPlaylist
-	_, _, err = video.printResolutionDownloadMenu()
+	variant, err := video.SelectVariant(resolution)
 	if err != nil {
 		log.Fatalf("there was a problem selecting a download option: %v", err)
 	}
-}
-
-// initializeVideoDownloadProcess will invoke the download job to pull
-// all segments and final mp4 video onto disk
-func initializeVideoDownloadProcess(manifestURL string, absoluteOutputPath string) {
-	baseURL, UID, err := extractUIDAndPrefixURL(manifestURL)
+	chosenManifest, err := video.VariantManifestURL(variant)
 	if err != nil {
-		log.Fatalf("there was a problem parsing the base url: %v", err)
-	}
-
-	video := Video{
-		MasterManifestURL: manifestURL,
-		BaseURL:           baseURL,
-		VideoUID:          UID,
-	}
-
-	masterPlaylist, err := video.retrieveMasterPlaylist(manifestURL)
-	if err != nil {
-		log.Fatalf("there was a problem retrieving master playlist: %v", err)
-	}
-	video.MasterPlaylist = *masterPlaylist
-
-	chosenManifest, chosenResolution, err := video.printResolutionDownloadMenu()
-	if err != nil {
-		log.Fatalf("there was a problem selecting a download option: %v", err)
+		log.Fatal(err)
 	}
 
-	var storedPaths []string
-	for _, media := range video.MasterPlaylist.Variants[0].Alternatives {
-		if media.Type == "AUDIO" {
-			manifestForResolution := fmt.Sprintf("%s/%s/manifest/%s", video.BaseURL, video.VideoUID, media.URI)
-			segmentPaths, err := video.downloadSegmentsFromManifest(manifestForResolution, chosenResolution, false, true, absoluteOutputPath)
-			if err != nil {
-				log.Fatalf("there was a problem downloading the segments: %v", err)
-			}
-
-			storedPath, err := video.concatenateTSFiles(segmentPaths, chosenResolution, true)
-			if err != nil {
-				log.Fatalf("there was a problem concatenating the segments: %v", err)
-			}
-			storedPaths = append(storedPaths, storedPath)
+	if format != FORMAT_TEXT {
+		if err := printFormatted(format, renditionManifest{variant.Resolution, chosenManifest}); err != nil {
+			log.Fatal(err)
 		}
+		return
 	}
-
-	segmentPaths, err := video.downloadSegmentsFromManifest(chosenManifest, chosenResolution, false, false, absoluteOutputPath)
-	if err != nil {
-		log.Fatalf("there was a problem downloading the segments: %v", err)
-	}
-
-	storedPath, err := video.concatenateTSFiles(segmentPaths, chosenResolution, false)
-	if err != nil {
-		log.Fatalf("there was a problem concatenating the segments: %v", err)
-	}
-	storedPaths = append(storedPaths, storedPath)
-
-	// merge potential audio and video files together with ffmpeg
-	if len(storedPaths) >= 2 {
-		fmt.Printf("🌱 audio and video are being merged...")
-		video.mergeMP4FilesInDir(storedPaths)
-	}
-	video.renderOutputPaths(chosenResolution)
+	fmt.Println(chosenManifest)
 }
 
-// downloadSegmentsFromManifest will download a complete video and individual segments
-// from a particular manifest and returns the list of relative segment paths
-func (v *Video) downloadSegmentsFromManifest(manifestURL, resolution string, skipDownload, isAudio bool, absoluteOutputPath string) ([]string, error) {
-	if isAudio {
-		fmt.Printf("🌱 Beginning audio download for [%s]\n", resolution)
-	} else {
-		fmt.Printf("🌱 Beginning video download for [%s]\n", resolution)
-	}
-	resp, err := http.Get(manifestURL)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	dataBuf := bytes.NewBuffer(body)
-	playlist, listType, err := m3u8.Decode(*dataBuf, false)
-	if err != nil {
-		return nil, err
-	}
-
-	concurrencyLimit := 5
-	sem := make(chan struct{}, concurrencyLimit)
-	var wg sync.WaitGroup
-	errChan := make(chan error, 1)
-
-	localSegmentPaths := []string{}
-	if listType == m3u8.MEDIA {
-		mediaPlaylist := playlist.(*m3u8.MediaPlaylist)
-		if mediaPlaylist.Map != nil {
-			segmentURL := mediaPlaylist.Map.URI
-			for strings.HasPrefix(segmentURL, "../") {
-				segmentURL = strings.TrimPrefix(segmentURL, "../")
-			}
-			completeSegmentURL := fmt.Sprintf("%s/%s", v.BaseURL, segmentURL)
-			segmentName, err := getSegmentName(completeSegmentURL)
+// countTotalSegments will output the number of segments on a particular
+// manifest. JSON and YAML describe every variant when no resolution is given
+func countTotalSegments(ctx context.Context, video *stream.Video, resolution, format string) {
+	if format != FORMAT_TEXT {
+		variants := video.Variants()
+		if resolution != "" {
+			variant, err := video.SelectVariant(resolution)
 			if err != nil {
-				return nil, err
-			}
-			var localSegmentPath string
-			if isAudio {
-				localSegmentPath = fmt.Sprintf("%s/%s/segments/audio_%s", absoluteOutputPath, resolution, segmentName)
-			} else {
-				localSegmentPath = fmt.Sprintf("%s/%s/segments/video_%s", absoluteOutputPath, resolution, segmentName)
-			}
-			localSegmentPaths = append(localSegmentPaths, localSegmentPath)
-			if !skipDownload {
-				err = downloadFile(completeSegmentURL, localSegmentPath)
-				if err != nil {
-					return nil, err
-				}
+				log.Fatalf("there was a problem selecting a download option: %v", err)
 			}
+			variants = []*m3u8.Variant{variant}
 		}
 
-		bar := progressbar.Default(int64(len(mediaPlaylist.Segments)))
-		for _, segment := range mediaPlaylist.Segments {
-			if segment != nil {
-				segmentURL := segment.URI
-				for strings.HasPrefix(segmentURL, "../") {
-					segmentURL = strings.TrimPrefix(segmentURL, "../")
-				}
-				completeSegmentURL := fmt.Sprintf("%s/%s", v.BaseURL, segmentURL)
-				segmentName, err := getSegmentName(completeSegmentURL)
-				if err != nil {
-					return nil, err
-				}
-				var localSegmentPath string
-				if isAudio {
-					localSegmentPath = fmt.Sprintf("%s/segments/audio_%s", resolution, segmentName)
-				} else {
-					localSegmentPath = fmt.Sprintf("%s/segments/video_%s", resolution, segmentName)
-				}
-				localSegmentPaths = append(localSegmentPaths, localSegmentPath)
-
-				// parallelization for segment downloads
-				if !skipDownload {
-					sem <- struct{}{}
-					wg.Add(1)
-					go func() {
-						defer func() {
-							<-sem
-							wg.Done()
-						}()
-						err := downloadFile(completeSegmentURL, localSegmentPath)
-						if err != nil {
-							select {
-							case errChan <- err:
-							default:
-							}
-						}
-					}()
-					bar.Add(1)
-				}
-			} else {
-				bar.Add(1)
+		counts := []stream.VariantInfo{}
+		for _, variant := range variants {
+			info, err := video.DescribeVariant(ctx, variant)
+			if err != nil {
+				log.Fatal(err)
 			}
+			counts = append(counts, info)
 		}
+		var err error
+		if resolution != "" {
+			err = printFormatted(format, counts[0])
+		} else {
+			err = printFormatted(format, counts)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	wg.Wait()
-	close(errChan)
-
-	if err := <-errChan; err != nil {
-		panic(err)
-	}
-	return localSegmentPaths, nil
-}
-
-// extractUIDAndPrefixURL will parse out the base URI for the customer as well
-// as the UID for the video
-func extractUIDAndPrefixURL(url string) (baseURL, uid string, err error) {
-	regex := regexp.MustCompile(`^(.+)/(.+)/manifest/video.m3u8$`)
-	matches := regex.FindStringSubmatch(url)
-
-	if len(matches) == 3 {
-		baseURI := matches[1]
-		uid := matches[2]
-		return baseURI, uid, nil
-	}
-	return "", "", errors.New("invalid input")
-}
-
-// retrieveMasterPlaylist gets the master m3u8
-func (v *Video) retrieveMasterPlaylist(url string) (*m3u8.MasterPlaylist, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	dataBuf := bytes.NewBuffer(body)
-	playlist, _, err := m3u8.Decode(*dataBuf, false)
-	if err != nil {
-		return nil, err
-	}
-
-	masterPlaylist := playlist.(*m3u8.MasterPlaylist)
-	return masterPlaylist, nil
-}
-
-// downloadFile will take a URL and download it to a predfined location
-func downloadFile(url, relativePath string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	targetDir := filepath.Dir(relativePath)
-	err = os.MkdirAll(targetDir, 0755)
-	if err != nil {
-		return err
-	}
-
-	out, err := os.Create(relativePath)
+	variant, err := video.SelectVariant(resolution)
 	if err != nil {
-		return err
+		log.Fatalf("there was a problem selecting a download option: %v", err)
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
-	return err
-}
-
-// getSegmentName will strip out the unique segment name from a segment
-// request URL
-func getSegmentName(urlStr string) (string, error) {
-	parsedURL, err := url.Parse(urlStr)
+	segments, err := video.SegmentCount(ctx, variant)
 	if err != nil {
-		return "", err
-	}
-	base := path.Base(parsedURL.Path)
-	segmentPattern := regexp.MustCompile(`(^seg_\d+|init)\.(ts|mp4)$`)
-	if segmentPattern.MatchString(base) {
-		return base, nil
+		log.Fatalf("there was a problem counting the segments: %v", err)
 	}
-	return "", fmt.Errorf("segment name not found")
+	fmt.Printf("There are a total of %d segments on the %s manifest\n",
+		segments,
+		variant.Resolution,
+	)
 }
 
-// concatenateTSFiles take all downloaded segments and concat into single, playable
-// mp4 using ffmpeg
-func (v *Video) concatenateTSFiles(filePaths []string, chosenResolution string, isAudio bool) (string, error) {
-	var outputFilename string
-	outputDir := chosenResolution
-	outputFilename = "video.mp4"
-
-	if isAudio {
-		outputFilename = "audio.mp4"
-	}
-
-	currentDirectory, err := os.Getwd()
-	if err != nil {
-		return "", err
-	}
-
-	for idx, file := range filePaths {
-		updatedPath := path.Join(currentDirectory, file)
-		filePaths[idx] = updatedPath
-	}
-
-	outputPath := path.Join(currentDirectory, outputDir, outputFilename)
-	outputFile, err := os.Create(outputPath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer outputFile.Close()
-
-	for _, filePath := range filePaths {
-		inputFile, err := os.Open(filePath)
+// listAvailableResolutions outputs all available resolutions from a manifest.
+// JSON and YAML describe the whole master playlist
+func listAvailableResolutions(ctx context.Context, video *stream.Video, format string) {
+	if format != FORMAT_TEXT {
+		description, err := video.Describe(ctx)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		_, err = io.Copy(outputFile, inputFile)
-		if err != nil {
+		if err := printFormatted(format, description); err != nil {
 			log.Fatal(err)
 		}
-
-		inputFile.Close()
+		return
 	}
-	return outputPath, nil
-}
 
-// printResolutionDownloadMenu lists available options to pull segments
-// from an available resolution
-func (v *Video) printResolutionDownloadMenu() (string, string, error) {
-	var userOption int
-	var manifestURLIdx []string
-	var resolutionIdx []string
-
-	reader := bufio.NewReader(os.Stdin)
-	resolutionURLs := make(map[string]string)
-
-	fmt.Printf("📋 Listing all available resolutions for video UID: %s\n\n", v.VideoUID)
-	for idx, variant := range v.MasterPlaylist.Variants {
-		manifestForResolution := fmt.Sprintf("%s/%s/manifest/%s", v.BaseURL, v.VideoUID, variant.URI)
-		resolutionURLs[variant.Resolution] = manifestForResolution
-		manifestURLIdx = append(manifestURLIdx, manifestForResolution)
-		resolutionIdx = append(resolutionIdx, variant.Resolution)
+	fmt.Printf("📋 Listing all available resolutions for video UID: %s\n\n", video.VideoUID)
+	for idx, variant := range video.MasterPlaylist.Variants {
 		fmt.Printf("%d) %s\n", idx, variant.Resolution)
 	}
+	fmt.Println()
+}
 
-	fmt.Printf("%d) 🚫 Exit\n", len(manifestURLIdx))
-	fmt.Print("\n📼 Select resolution: ")
-	input, err := reader.ReadString('\n')
-	if err != nil {
-		fmt.Println("Error reading input:", err)
-		return "", "", err
-	}
-
-	userOption, err = strconv.Atoi(strings.TrimSpace(input[:len(input)-1]))
+// initializeVideoDownloadProcess will invoke the download job to pull
+// all segments and final mp4 video onto disk
+func initializeVideoDownloadProcess(ctx context.Context, video *stream.Video, opts stream.DownloadOptions) {
+	directories, err := video.Download(ctx, opts)
 	if err != nil {
-		fmt.Println("Error converting input to integer:", err)
-		return "", "", err
-	}
-
-	if userOption == len(manifestURLIdx) {
-		fmt.Println("👋 Exiting Stream downloader")
-		os.Exit(1)
+		exitIfInterrupted(ctx, RESUME_DOWNLOAD_HINT)
+		log.Fatal(err)
 	}
-
-	chosenResolution := resolutionIdx[userOption]
-	return resolutionURLs[chosenResolution], chosenResolution, nil
+	renderOutputPaths(directories...)
 }
 
-func (v *Video) renderOutputPaths(resolution string) {
+// renderOutputPaths prints the directories holding the downloaded files
+func renderOutputPaths(directories ...string) {
 	fmt.Println("Complete!")
 	fmt.Println("---------------------------------------------")
-	fmt.Printf("Video output:\n./%s/\n\n", resolution)
+	fmt.Println("Video output:")
+	for _, directory := range directories {
+		fmt.Println(displayPath(directory))
+	}
+	fmt.Println()
 	fmt.Println("---------------------------------------------")
 }
 
-func (v *Video) mergeMP4FilesInDir(filePaths []string) error {
-	if len(filePaths) != 2 {
-		return fmt.Errorf("expected 2 MP4 files, found %d", len(filePaths))
-	}
-
-	file, err := os.Open(filePaths[0])
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	dirPath := filepath.Dir(file.Name())
-	cmd := exec.Command("ffmpeg", "-i", filePaths[0], "-i", filePaths[1], "-c:v", "copy", "-c:a", "copy", fmt.Sprintf("%s/merged.mp4", dirPath))
-	err = cmd.Run()
+// normalizeManifestURL resolves any supported video URL form given to the
+// interactive menu and shows the HLS manifest it points at
+func normalizeManifestURL(ctx context.Context, input string) (*stream.Source, error) {
+	source, err := downloader.Resolve(ctx, input)
 	if err != nil {
-		return err
-	}
-
-	err = os.RemoveAll(filePaths[0])
-	if err != nil {
-		return err
+		return nil, err
 	}
-	err = os.RemoveAll(filePaths[1])
-	if err != nil {
-		return err
+	if source.ManifestURL != input {
+		fmt.Printf("🔗 Using manifest %s\n", source.ManifestURL)
 	}
-	return nil
+	return source, nil
 }
 
 func fileExists(filePath string) bool {
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/Schachte/cloudflare-stream-downloader/stream"
+)
+
+// mirrorVideo saves the selected renditions as a self-contained HLS package
+// that plays offline
+func mirrorVideo(ctx context.Context, input string, opts stream.DownloadOptions) {
+	video := openVideo(ctx, input)
+
+	masterPath, err := video.Mirror(ctx, opts)
+	if err != nil {
+		exitIfInterrupted(ctx, RESUME_DOWNLOAD_HINT)
+		log.Fatal(err)
+	}
+	fmt.Printf("📼 Open %s with any HLS player to play the mirror offline\n", masterPath)
+	renderOutputPaths(filepath.Dir(masterPath))
+}
@@ -0,0 +1,15 @@
+package main
+
+import "path/filepath"
+
+// displayPath formats a directory for the messages, relative directories are
+// shown starting with ./
+func displayPath(directory string) string {
+	if filepath.IsAbs(directory) {
+		return directory + string(filepath.Separator)
+	}
+	if directory == "." {
+		return "./"
+	}
+	return "./" + filepath.ToSlash(directory) + "/"
+}
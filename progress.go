@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Schachte/cloudflare-stream-downloader/stream"
+)
+
+// PROGRESS_LOG_INTERVAL is how often a progress line is printed when the
+// output isn't a terminal, or shown on the line of a batch job. On a
+// terminal the line is redrawn on every stream.EVENT_PROGRESS
+const PROGRESS_LOG_INTERVAL = 5 * time.Second
+
+// progressPrinter shows the events of the downloader. Messages go to stdout,
+// the progress line, the chosen rendition and the totals of a transfer go to
+// stderr so formatted output on stdout stays parseable
+type progressPrinter struct {
+	mu          sync.Mutex
+	interactive bool
+	drawn       bool
+	logged      time.Time
+}
+
+// newProgressPrinter redraws the progress line in place when stderr is a
+// terminal
+func newProgressPrinter() *progressPrinter {
+	printer := &progressPrinter{logged: time.Now()}
+	if stat, err := os.Stderr.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		printer.interactive = true
+	}
+	return printer
+}
+
+// handle prints an event of the downloader
+func (p *progressPrinter) handle(event stream.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch event.Type {
+	case stream.EVENT_MESSAGE:
+		p.clear()
+		fmt.Println(event.Message)
+	case stream.EVENT_SELECTED:
+		p.clear()
+		fmt.Fprintln(os.Stderr, event.Message)
+	case stream.EVENT_PROGRESS:
+		if p.interactive {
+			fmt.Fprintf(os.Stderr, "\r\033[2K%s", progressLine(event.Progress))
+			p.drawn = true
+		} else if time.Since(p.logged) >= PROGRESS_LOG_INTERVAL {
+			p.logged = time.Now()
+			fmt.Fprintln(os.Stderr, progressLine(event.Progress))
+		}
+	case stream.EVENT_TRANSFER_DONE:
+		p.clear()
+		fmt.Fprintln(os.Stderr, transferSummary(event.Progress))
+		p.logged = time.Now()
+	}
+}
+
+// clear removes the progress line from the terminal, with p.mu held
+func (p *progressPrinter) clear() {
+	if p.interactive && p.drawn {
+		fmt.Fprint(os.Stderr, "\r\033[2K")
+		p.drawn = false
+	}
+}
+
+// progressLine formats the progress of a transfer, with the estimated total
+// when the size of some segments is still unknown
+func progressLine(progress *stream.Progress) string {
+	parts := []string{}
+	if progress.Total > 0 {
+		percent := float64(progress.Bytes) * 100 / float64(progress.Total)
+		if percent > 100 {
+			percent = 100
+		}
+		estimate := ""
+		if progress.Estimated {
+			estimate = "~"
+		}
+		parts = append(parts, fmt.Sprintf("%.0f%% %s of %s%s", percent, formatBytes(progress.Bytes), estimate, formatBytes(progress.Total)))
+	} else {
+		parts = append(parts, formatBytes(progress.Bytes))
+	}
+
+	if progress.Transferred > 0 {
+		parts = append(parts, formatBytes(int64(progress.Throughput()))+"/s")
+		if eta := progress.ETA(); eta > 0 {
+			parts = append(parts, "ETA "+eta.Round(time.Second).String())
+		}
+	}
+	parts = append(parts, fmt.Sprintf("%d/%d segments", progress.Done, progress.Planned))
+	if progress.Retries > 0 {
+		parts = append(parts, fmt.Sprintf("%d retries", progress.Retries))
+	}
+	return fmt.Sprintf("⬇️ %s %s", progress.Stage, strings.Join(parts, ", "))
+}
+
+// transferSummary formats the totals of a finished transfer
+func transferSummary(progress *stream.Progress) string {
+	summary := fmt.Sprintf("📶 Received %s in %s (%s/s) for %d segments", formatBytes(progress.Transferred), progress.Elapsed.Round(time.Second), formatBytes(int64(progress.Throughput())), progress.Done)
+	if progress.Retries > 0 {
+		summary += fmt.Sprintf(", %d retries", progress.Retries)
+	}
+	return summary
+}
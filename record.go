@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Schachte/cloudflare-stream-downloader/stream"
+)
+
+// recordLiveStream follows the live playlist of a Stream Live input until the
+// stream ends, the duration limit is reached or SIGINT is received and
+// finalises the recording into an mp4
+func recordLiveStream(ctx context.Context, input string, opts stream.DownloadOptions, maxDuration time.Duration) {
+	video := openVideo(ctx, input)
+
+	// the first Ctrl-C cancels ctx, which stops the recorders without
+	// discarding the segments recorded so far
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			fmt.Println("💾 Finalising the segments recorded so far...")
+		case <-done:
+		}
+	}()
+
+	fmt.Println("⏺ Press Ctrl-C to stop the recording")
+	directory, err := video.Record(ctx, opts, maxDuration)
+	if errors.Is(err, stream.ErrNothingRecorded) {
+		log.Fatal("no segments were recorded")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	renderOutputPaths(directory)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Schachte/cloudflare-stream-downloader/stream"
+	"github.com/grafov/m3u8"
+)
+
+// printResolutionDownloadMenu lists the available variants and asks for the
+// number of one or for selection rules until the answer picks a variant. It
+// is the downloader's PromptVariant, used when no --resolution is given
+func printResolutionDownloadMenu(video *stream.Video) (*m3u8.Variant, string, error) {
+	variants := video.Variants()
+
+	fmt.Printf("📋 Listing all available resolutions for video UID: %s\n\n", video.VideoUID)
+	for idx, variant := range variants {
+		fmt.Printf("%d) %s\n", idx, stream.VariantDescription(variant))
+	}
+	fmt.Printf("%d) 🚫 Exit\n", len(variants))
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("\n📼 Select resolution (number, or rules such as best, <=720p, avc1): ")
+		input, err := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+		if err != nil && (err != io.EOF || input == "") {
+			return nil, "", fmt.Errorf("error reading input: %w", err)
+		}
+
+		if option, convErr := strconv.Atoi(input); convErr == nil {
+			switch {
+			case option == len(variants):
+				fmt.Println("👋 Exiting Stream downloader")
+				os.Exit(1)
+			case option >= 0 && option < len(variants):
+				return variants[option], "chosen from the menu", nil
+			}
+			fmt.Printf("⚠️ %d is not one of the options, choose 0-%d\n", option, len(variants))
+			continue
+		}
+
+		if input == "" {
+			continue
+		}
+		variant, reason, err := video.ChooseVariant(input)
+		if err == nil {
+			return variant, reason, nil
+		}
+		fmt.Printf("⚠️ %v\n", err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// DEFAULT_SERVE_ADDRESS only accepts connections from this machine
+const DEFAULT_SERVE_ADDRESS = "127.0.0.1:8080"
+
+// serveContentTypes are the MIME types of the files written by the
+// downloader, set explicitly since the system MIME tables rarely know them
+var serveContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".mp4":  "video/mp4",
+	".m4s":  "video/iso.segment",
+	".vtt":  "text/vtt; charset=utf-8",
+	".json": "application/json",
+	".key":  "application/octet-stream",
+}
+
+// servedVideo is a video directory listed on the player page
+type servedVideo struct {
+	UID        string
+	Renditions []servedRendition
+}
+
+// servedRendition is a playable file of a video, a mirrored master playlist
+// or a merged mp4
+type servedRendition struct {
+	Label string
+	URL   string
+}
+
+// serveDirectory serves the files below directory over HTTP, along with a
+// player page listing the mirrored and downloaded videos until ctx is done
+func serveDirectory(ctx context.Context, directory, address string) error {
+	info, err := os.Stat(directory)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", directory)
+	}
+
+	files := http.FileServer(http.Dir(directory))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "Range")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.URL.Path == "/" {
+			renderPlayerPage(w, directory)
+			return
+		}
+		// http.FileServer answers Range requests and keeps a preset type
+		if contentType, ok := serveContentTypes[strings.ToLower(filepath.Ext(r.URL.Path))]; ok {
+			w.Header().Set("Content-Type", contentType)
+		}
+		files.ServeHTTP(w, r)
+	})
+
+	server := &http.Server{Addr: address, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	fmt.Printf("📺 Serving %s on http://%s/ (Ctrl-C to stop)\n", displayPath(directory), address)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// renderPlayerPage lists the videos found below directory. The directory is
+// scanned on every request so new downloads show up on reload
+func renderPlayerPage(w http.ResponseWriter, directory string) {
+	videos, err := findServedVideos(directory)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var page bytes.Buffer
+	if err := playerPage.Execute(&page, videos); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page.Bytes())
+}
+
+// findServedVideos walks directory for master playlists and mp4 files and
+// groups them by the top level directory, the UID with the video output
+// template. Segments and media playlists are left out since they can't be
+// played on their own
+func findServedVideos(directory string) ([]servedVideo, error) {
+	byUID := make(map[string]*servedVideo)
+	err := filepath.WalkDir(directory, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == "segments" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var label string
+		switch strings.ToLower(filepath.Ext(filePath)) {
+		case ".mp4":
+			label = "mp4"
+		case ".m3u8":
+			resolutions, ok := masterResolutions(filePath)
+			if !ok {
+				return nil
+			}
+			label = "HLS " + strings.Join(resolutions, ", ")
+		default:
+			return nil
+		}
+
+		relative, err := filepath.Rel(directory, filePath)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+		uid, name := ".", relative
+		if idx := strings.Index(relative, "/"); idx >= 0 {
+			uid, name = relative[:idx], relative[idx+1:]
+		}
+		if byUID[uid] == nil {
+			byUID[uid] = &servedVideo{UID: uid}
+		}
+		byUID[uid].Renditions = append(byUID[uid].Renditions, servedRendition{
+			Label: fmt.Sprintf("%s (%s)", name, label),
+			URL:   "/" + relative,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	videos := []servedVideo{}
+	for _, video := range byUID {
+		videos = append(videos, *video)
+	}
+	sort.Slice(videos, func(i, j int) bool {
+		return videos[i].UID < videos[j].UID
+	})
+	return videos, nil
+}
+
+// masterResolutions returns the resolutions of a master playlist, false for
+// media playlists and unreadable files
+func masterResolutions(playlistPath string) ([]string, bool) {
+	data, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return nil, false
+	}
+	playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(data), false)
+	if err != nil || listType != m3u8.MASTER {
+		return nil, false
+	}
+
+	resolutions := []string{}
+	for _, variant := range playlist.(*m3u8.MasterPlaylist).Variants {
+		if variant != nil && !variant.Iframe && variant.Resolution != "" {
+			resolutions = append(resolutions, variant.Resolution)
+		}
+	}
+	return resolutions, true
+}
+
+// playerPage plays mp4 files in every browser and HLS playlists in browsers
+// with native HLS support, the page loads nothing from the internet
+var playerPage = template.Must(template.New("player").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>cloudflare-stream-downloader</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+video { width: 100%; max-width: 960px; background: #000; }
+li { margin: 0.3em 0; }
+a.play { cursor: pointer; color: #0051c3; text-decoration: underline; }
+.hint { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<video id="player" controls></video>
+<p id="source" class="hint">Pick a rendition below. HLS playlists play in browsers with native HLS support, otherwise open their URL in VLC or ffplay.</p>
+{{range .}}
+<h2>{{.UID}}</h2>
+<ul>
+{{range .Renditions}}<li><a class="play" data-src="{{.URL}}">{{.Label}}</a> <a class="hint" href="{{.URL}}">{{.URL}}</a></li>
+{{end}}</ul>
+{{else}}
+<p>No mirrored or downloaded videos found.</p>
+{{end}}
+<script>
+document.querySelectorAll("a.play").forEach(function (link) {
+  link.addEventListener("click", function () {
+    var player = document.getElementById("player");
+    player.src = link.dataset.src;
+    player.play();
+    document.getElementById("source").textContent = location.origin + link.dataset.src;
+  });
+});
+</script>
+</body>
+</html>
+`))
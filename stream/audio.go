@@ -0,0 +1,270 @@
+package stream
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	RENDITION_VIDEO = "video"
+	RENDITION_AUDIO = "audio"
+
+	// AUDIO_ALL selects every audio track when passed to --audio-lang
+	AUDIO_ALL = "all"
+)
+
+// mediaTrack is a downloaded audio or subtitles rendition along with the
+// metadata written into the merged file
+type mediaTrack struct {
+	Language string
+	Name     string
+	Path     string
+
+	shared bool // used by several merges and removed by the caller
+	// restarts are the offsets in Path where the timestamps of MPEG-TS
+	// start over, after a discontinuity or a gap of a recording
+	restarts []int64
+}
+
+// AudioSelection chooses the audio tracks that are downloaded. Languages and
+// Names are comma separated, Languages can also be AUDIO_ALL. The DEFAULT
+// track is used when both are empty
+type AudioSelection struct {
+	Languages string
+	Names     string
+}
+
+// AudioTrack is an audio rendition listed in the master playlist. Tracks
+// carried by the variants have no manifest of their own
+type AudioTrack struct {
+	Group       string `json:"group"`
+	Language    string `json:"language"`
+	Name        string `json:"name"`
+	Default     bool   `json:"default"`
+	ManifestURL string `json:"manifestUrl"`
+}
+
+// namedRendition is an alternative rendition with the label and rendition
+// name used for its files
+type namedRendition struct {
+	media *m3u8.Alternative
+	label string
+	name  string
+}
+
+// selectTracks returns the audio renditions matching the selection. Without
+// a selection the DEFAULT track, or the first one, is used
+func (s AudioSelection) selectTracks(renditions []*m3u8.Alternative) ([]*m3u8.Alternative, error) {
+	if len(renditions) == 0 {
+		return nil, nil
+	}
+	if s.Languages == "" && s.Names == "" {
+		for _, media := range renditions {
+			if media.Default {
+				return []*m3u8.Alternative{media}, nil
+			}
+		}
+		return renditions[:1], nil
+	}
+	if strings.EqualFold(s.Languages, AUDIO_ALL) {
+		return renditions, nil
+	}
+
+	languages := splitList(s.Languages)
+	names := splitList(s.Names)
+	selected := []*m3u8.Alternative{}
+	for _, media := range renditions {
+		if matchesLanguage(media.Language, languages) || matchesName(media.Name, names) {
+			selected = append(selected, media)
+		}
+	}
+	if len(selected) == 0 {
+		available := []string{}
+		for _, media := range renditions {
+			available = append(available, fmt.Sprintf("%s (%s)", media.Language, media.Name))
+		}
+		return nil, fmt.Errorf("%w, choose from: %s", ErrNoAudioTrack, strings.Join(available, ", "))
+	}
+	return selected, nil
+}
+
+// matchesLanguage reports whether the language tag equals one of languages
+// or is a regional variant of it, e.g. en-US for en
+func matchesLanguage(tag string, languages []string) bool {
+	for _, language := range languages {
+		if strings.EqualFold(tag, language) || strings.HasPrefix(strings.ToLower(tag), strings.ToLower(language)+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesName reports whether name equals one of names, ignoring case
+func matchesName(name string, names []string) bool {
+	for _, candidate := range names {
+		if strings.EqualFold(name, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated flag value
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// alternativeRenditions returns the EXT-X-MEDIA renditions of mediaType that
+// belong to the group referenced by the chosen variant, each one only once
+func (v *Video) alternativeRenditions(mediaType string, variant *m3u8.Variant) []*m3u8.Alternative {
+	group := ""
+	if variant != nil {
+		if mediaType == "AUDIO" {
+			group = variant.Audio
+		} else {
+			group = variant.Subtitles
+		}
+	}
+	return v.groupRenditions(mediaType, group)
+}
+
+// groupRenditions returns the renditions of a media type in a group, or in
+// every group when group is empty
+func (v *Video) groupRenditions(mediaType, group string) []*m3u8.Alternative {
+	seen := make(map[string]bool)
+	renditions := []*m3u8.Alternative{}
+	for _, variant := range v.MasterPlaylist.Variants {
+		for _, media := range variant.Alternatives {
+			if media.Type != mediaType || media.URI == "" || seen[media.URI] {
+				continue
+			}
+			if group != "" && media.GroupId != group {
+				continue
+			}
+			seen[media.URI] = true
+			renditions = append(renditions, media)
+		}
+	}
+	return renditions
+}
+
+// renditionNames labels renditions by language, falling back to their name,
+// and derives unique file names from prefix. A single rendition keeps the
+// bare prefix so its files are named as before
+func renditionNames(prefix string, renditions []*m3u8.Alternative) []namedRendition {
+	named := []namedRendition{}
+	labels := make(map[string]int)
+	for _, media := range renditions {
+		label := renditionLabel(media)
+		labels[label]++
+		if labels[label] > 1 {
+			label = fmt.Sprintf("%s_%d", label, labels[label])
+		}
+		name := prefix
+		if len(renditions) > 1 {
+			name = prefix + "_" + label
+		}
+		named = append(named, namedRendition{media: media, label: label, name: name})
+	}
+	return named
+}
+
+// renditionLabel names a rendition in file names, preferring its language
+// over its display name
+func renditionLabel(media *m3u8.Alternative) string {
+	label := media.Language
+	if label == "" {
+		label = media.Name
+	}
+	label = safeName(label)
+	if label == "" {
+		return "und"
+	}
+	return label
+}
+
+// safeName replaces the characters of name that don't belong in file names
+func safeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// AudioTracks lists every audio track of the master playlist by group with
+// the LANGUAGE, NAME and DEFAULT attributes and the signed manifest URL
+func (v *Video) AudioTracks() ([]AudioTrack, error) {
+	tracks := []AudioTrack{}
+	seen := make(map[string]bool)
+	for _, variant := range v.MasterPlaylist.Variants {
+		for _, media := range variant.Alternatives {
+			if media.Type != "AUDIO" || seen[media.GroupId+media.URI+media.Name] {
+				continue
+			}
+			seen[media.GroupId+media.URI+media.Name] = true
+
+			track := AudioTrack{
+				Group:    media.GroupId,
+				Language: media.Language,
+				Name:     media.Name,
+				Default:  media.Default,
+			}
+			if media.URI != "" {
+				audioManifest, err := resolveURL(v.MasterManifestURL, media.URI)
+				if err != nil {
+					return nil, fmt.Errorf("there was a problem resolving the audio manifest: %w", err)
+				}
+				track.ManifestURL = v.signedURL(audioManifest)
+			}
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks, nil
+}
+
+// metadataArgs returns the ffmpeg flags tagging output stream idx of the
+// stream type with the language and name of the track
+func (t mediaTrack) metadataArgs(streamType string, idx int) []string {
+	specifier := fmt.Sprintf("-metadata:s:%s:%d", streamType, idx)
+	args := []string{specifier, "language=" + mp4Language(t.Language)}
+	if t.Name != "" {
+		args = append(args, specifier, "title="+t.Name)
+	}
+	return args
+}
+
+// mp4Language converts an RFC 5646 language tag into the ISO 639-2 code mp4
+// files store for every track
+func mp4Language(tag string) string {
+	primary := strings.ToLower(strings.SplitN(strings.ReplaceAll(tag, "_", "-"), "-", 2)[0])
+	if len(primary) == 3 {
+		return primary
+	}
+	if code, ok := iso6392Codes[primary]; ok {
+		return code
+	}
+	return "und"
+}
+
+// iso6392Codes maps common ISO 639-1 codes onto their ISO 639-2/T code
+var iso6392Codes = map[string]string{
+	"ar": "ara", "bg": "bul", "ca": "cat", "cs": "ces", "da": "dan",
+	"de": "deu", "el": "ell", "en": "eng", "es": "spa", "et": "est",
+	"fa": "fas", "fi": "fin", "fr": "fra", "he": "heb", "hi": "hin",
+	"hr": "hrv", "hu": "hun", "id": "ind", "it": "ita", "ja": "jpn",
+	"ko": "kor", "lt": "lit", "lv": "lav", "ms": "msa", "nb": "nob",
+	"nl": "nld", "no": "nor", "pl": "pol", "pt": "por", "ro": "ron",
+	"ru": "rus", "sk": "slk", "sl": "slv", "sr": "srp", "sv": "swe",
+	"th": "tha", "tr": "tur", "uk": "ukr", "vi": "vie", "zh": "zho",
+}
@@ -0,0 +1,182 @@
+// Package stream downloads, inspects, mirrors, records and uploads Cloudflare
+// Stream videos. A Client holds the settings shared by every operation, Open
+// resolves a video and the methods of Video work on it
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// DEFAULT_CONCURRENCY is the number of segments downloaded at the same time
+const DEFAULT_CONCURRENCY = 5
+
+// Client downloads, inspects and uploads videos. Its fields are read while
+// the operations run and shouldn't be changed once the first one started.
+// The methods can be called from several goroutines, the segment downloads
+// of every operation share the Concurrency limit
+type Client struct {
+	// HTTPClient sends every request, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// Concurrency bounds the segment downloads and HEAD requests running at
+	// the same time across every operation of the client
+	Concurrency int
+	// Retries is the number of retries after a failed request. RetryDelay is
+	// the backoff before the first one, doubled on every attempt up to
+	// RetryMaxDelay
+	Retries       int
+	RetryDelay    time.Duration
+	RetryMaxDelay time.Duration
+	// Muxer merges the renditions into merged.mp4: MUXER_NATIVE or
+	// MUXER_FFMPEG, NewClient sets it to DefaultMuxer
+	Muxer string
+	// Customer is the customer subdomain used for bare video UIDs and iframe
+	// embeds
+	Customer string
+	// Tokens places a signed URL token in the URLs of every video
+	Tokens TokenOptions
+	// PromptVariant picks a variant, along with the reason shown for it, when
+	// no selection rules are given. The best variant is used when it is nil
+	PromptVariant func(video *Video) (*m3u8.Variant, string, error)
+	// OnEvent receives the messages and the progress of every operation. It
+	// can be called from several goroutines at the same time
+	OnEvent func(event Event)
+
+	slotsOnce sync.Once
+	slots     chan struct{}
+}
+
+// NewClient returns a client with the default settings
+func NewClient() *Client {
+	return &Client{
+		HTTPClient:    http.DefaultClient,
+		Concurrency:   DEFAULT_CONCURRENCY,
+		Retries:       DEFAULT_RETRIES,
+		RetryDelay:    DEFAULT_RETRY_DELAY,
+		RetryMaxDelay: DEFAULT_RETRY_MAX_DELAY,
+		Muxer:         DefaultMuxer(),
+	}
+}
+
+// Resolve turns a bare UID, an embed, watch or thumbnail URL, a DASH or HLS
+// manifest URL or an HTML page embedding a Stream player into the HLS
+// manifest of the video, with the signed URL token of Tokens in place
+func (c *Client) Resolve(ctx context.Context, input string) (*Source, error) {
+	source, err := c.resolveStreamSource(ctx, input, c.Customer)
+	if err != nil {
+		return nil, fmt.Errorf("there was a problem resolving the video URL: %w", err)
+	}
+	return c.Tokens.apply(source)
+}
+
+// Open resolves input and retrieves the master playlist of the video along
+// with the manifest URL of every rendition
+func (c *Client) Open(ctx context.Context, input string) (*Video, error) {
+	source, err := c.Resolve(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return c.OpenSource(ctx, source)
+}
+
+// OpenSource retrieves the master playlist of a video resolved before with
+// Resolve along with the manifest URL of every rendition
+func (c *Client) OpenSource(ctx context.Context, source *Source) (*Video, error) {
+	return c.newVideo(ctx, source)
+}
+
+// Describe opens the video behind input and describes its master playlist
+func (c *Client) Describe(ctx context.Context, input string) (*PlaylistDescription, error) {
+	video, err := c.Open(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return video.Describe(ctx)
+}
+
+// Inspect opens the video behind input and reports on every rendition, see
+// Video.Inspect
+func (c *Client) Inspect(ctx context.Context, input string, headRequests bool) (*InspectReport, error) {
+	video, err := c.Open(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return video.Inspect(ctx, headRequests)
+}
+
+// Download opens the video behind input and downloads it, see Video.Download
+func (c *Client) Download(ctx context.Context, input string, opts DownloadOptions) ([]string, error) {
+	video, err := c.Open(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return video.Download(ctx, opts)
+}
+
+// Mirror opens the video behind input and saves it as an HLS package that
+// plays offline, see Video.Mirror
+func (c *Client) Mirror(ctx context.Context, input string, opts DownloadOptions) (string, error) {
+	video, err := c.Open(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return video.Mirror(ctx, opts)
+}
+
+// Record opens the live stream behind input and records it, see Video.Record
+func (c *Client) Record(ctx context.Context, input string, opts DownloadOptions, maxDuration time.Duration) (string, error) {
+	video, err := c.Open(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return video.Record(ctx, opts, maxDuration)
+}
+
+// httpClient returns the client sending the requests
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// request sends a request without a body, it is aborted when ctx is done
+func (c *Client) request(ctx context.Context, method, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.httpClient().Do(req)
+}
+
+// acquireDownloadSlot blocks until fewer than Concurrency segments are being
+// downloaded, or until ctx is done
+func (c *Client) acquireDownloadSlot(ctx context.Context) error {
+	c.slotsOnce.Do(func() {
+		limit := c.Concurrency
+		if limit < 1 {
+			limit = 1
+		}
+		c.slots = make(chan struct{}, limit)
+	})
+	// a free slot must not win over a cancelled ctx
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseDownloadSlot frees a slot taken by acquireDownloadSlot
+func (c *Client) releaseDownloadSlot() {
+	<-c.slots
+}
@@ -0,0 +1,73 @@
+package stream
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Clip is the part of a video to download in seconds from the start of the
+// playlist. A zero End keeps everything after Start
+type Clip struct {
+	Start float64
+	End   float64
+}
+
+// IsSet reports whether a start or an end was given
+func (c Clip) IsSet() bool {
+	return c.Start > 0 || c.End > 0
+}
+
+// Validate checks that the range isn't empty
+func (c Clip) Validate() error {
+	if c.End > 0 && c.End <= c.Start {
+		return fmt.Errorf("the end %s has to be after the start %s", formatWebVTTTime(c.End), formatWebVTTTime(c.Start))
+	}
+	return nil
+}
+
+// covers reports whether a segment starting at segmentStart overlaps the range
+func (c Clip) covers(segmentStart, segmentDuration float64) bool {
+	if c.End > 0 && segmentStart >= c.End {
+		return false
+	}
+	return segmentStart+segmentDuration > c.Start
+}
+
+// relativeTo moves the range onto the timeline of a file starting at offset
+func (c Clip) relativeTo(offset float64) Clip {
+	relative := Clip{Start: math.Max(c.Start-offset, 0)}
+	if c.End > 0 {
+		relative.End = c.End - offset
+	}
+	return relative
+}
+
+// String formats the range for progress messages
+func (c Clip) String() string {
+	if c.End == 0 {
+		return fmt.Sprintf("%s to the end", formatWebVTTTime(c.Start))
+	}
+	return fmt.Sprintf("%s to %s", formatWebVTTTime(c.Start), formatWebVTTTime(c.End))
+}
+
+// ParseClipTime parses seconds such as 90 or 12.5, or a [hh:]mm:ss[.ms]
+// timestamp into seconds
+func ParseClipTime(value string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time %q, use seconds or [hh:]mm:ss[.ms]", value)
+	}
+
+	var seconds float64
+	for idx, part := range parts {
+		number, err := strconv.ParseFloat(part, 64)
+		last := idx == len(parts)-1
+		if err != nil || number < 0 || math.IsInf(number, 0) || math.IsNaN(number) || (idx > 0 && number >= 60) || (!last && strings.Contains(part, ".")) {
+			return 0, fmt.Errorf("invalid time %q, use seconds or [hh:]mm:ss[.ms]", value)
+		}
+		seconds = seconds*60 + number
+	}
+	return seconds, nil
+}
@@ -0,0 +1,306 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	ENCRYPTION_NONE       = "NONE"
+	ENCRYPTION_AES_128    = "AES-128"
+	ENCRYPTION_SAMPLE_AES = "SAMPLE-AES"
+)
+
+// segmentEncryption describes how a downloaded segment has to be decrypted
+type segmentEncryption struct {
+	Method string
+	Key    []byte
+	IV     []byte
+}
+
+// keyCache keeps the keys fetched for a video so rotated keys are only
+// requested once
+type keyCache struct {
+	fetchURL func(ctx context.Context, url string) ([]byte, error)
+	mu       sync.Mutex
+	keys     map[string]*cachedKey
+}
+
+// cachedKey is a key of the cache, its mutex is held while the key is
+// fetched so only the segments waiting for it are blocked
+type cachedKey struct {
+	mu  sync.Mutex
+	key []byte
+}
+
+func newKeyCache(fetchURL func(ctx context.Context, url string) ([]byte, error)) *keyCache {
+	return &keyCache{fetchURL: fetchURL, keys: make(map[string]*cachedKey)}
+}
+
+// mapKeys returns the EXT-X-KEY in effect at every EXT-X-MAP of a media
+// playlist, in playlist order. The decoded playlist links a key and a map
+// declared before the same segment without telling which came first, while
+// RFC 8216 only encrypts an initialization section with a key declared
+// before it. Only AES-128 encrypts a whole initialization section, other
+// methods give a nil key
+func mapKeys(body []byte) []*m3u8.Key {
+	var keys []*m3u8.Key
+	var current *m3u8.Key
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			attributes := parseAttributeList(strings.TrimPrefix(line, "#EXT-X-KEY:"))
+			current = nil
+			if attributes["METHOD"] == ENCRYPTION_AES_128 {
+				current = &m3u8.Key{
+					Method:            attributes["METHOD"],
+					URI:               attributes["URI"],
+					IV:                attributes["IV"],
+					Keyformat:         attributes["KEYFORMAT"],
+					Keyformatversions: attributes["KEYFORMATVERSIONS"],
+				}
+			}
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			keys = append(keys, current)
+		}
+	}
+	return keys
+}
+
+// parseAttributeList splits the NAME=VALUE pairs of a tag, quoted values
+// can contain commas
+func parseAttributeList(list string) map[string]string {
+	attributes := map[string]string{}
+	for list != "" {
+		separator := strings.IndexByte(list, '=')
+		if separator < 0 {
+			break
+		}
+		name := strings.TrimSpace(list[:separator])
+		list = list[separator+1:]
+
+		var value string
+		if strings.HasPrefix(list, "\"") {
+			quoted := list[1:]
+			end := strings.IndexByte(quoted, '"')
+			if end < 0 {
+				value, list = quoted, ""
+			} else {
+				value, list = quoted[:end], quoted[end+1:]
+			}
+		} else {
+			end := strings.IndexByte(list, ',')
+			if end < 0 {
+				end = len(list)
+			}
+			value = strings.TrimSpace(list[:end])
+			list = list[end:]
+		}
+		attributes[name] = value
+		list = strings.TrimPrefix(list, ",")
+	}
+	return attributes
+}
+
+// segmentEncryption resolves the EXT-X-KEY in effect for a segment. The key
+// URI is resolved against the media playlist and requested with the same
+// token as the segments. A nil result means the segment is not encrypted
+func (v *Video) segmentEncryption(ctx context.Context, key *m3u8.Key, playlistURL string, sequence uint64) (*segmentEncryption, error) {
+	if key == nil || key.Method == "" || key.Method == ENCRYPTION_NONE {
+		return nil, nil
+	}
+	if key.Method != ENCRYPTION_AES_128 && key.Method != ENCRYPTION_SAMPLE_AES {
+		return nil, &UnsupportedEncryptionError{Method: key.Method}
+	}
+	if key.Keyformat != "" && key.Keyformat != "identity" {
+		return nil, &UnsupportedEncryptionError{Method: key.Method, KeyFormat: key.Keyformat}
+	}
+
+	keyURL, err := resolveURL(playlistURL, key.URI)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := v.keys.fetch(ctx, keyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	iv, err := segmentIV(key.IV, sequence)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentEncryption{Method: key.Method, Key: keyBytes, IV: iv}, nil
+}
+
+// fetch downloads a 16 byte key once per URL, a failed fetch is tried again
+// by the next segment using the key
+func (c *keyCache) fetch(ctx context.Context, keyURL string) ([]byte, error) {
+	c.mu.Lock()
+	cached, ok := c.keys[keyURL]
+	if !ok {
+		cached = &cachedKey{}
+		c.keys[keyURL] = cached
+	}
+	c.mu.Unlock()
+
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+	if cached.key != nil {
+		return cached.key, nil
+	}
+	key, err := c.fetchURL(ctx, keyURL)
+	if err != nil {
+		return nil, fmt.Errorf("there was a problem fetching key %s: %w", keyURL, err)
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("key %s has %d bytes, expected %d", keyURL, len(key), aes.BlockSize)
+	}
+	cached.key = key
+	return key, nil
+}
+
+// segmentIV parses the explicit IV attribute or, when absent, derives the IV
+// from the media sequence number as required by RFC 8216 section 5.2
+func segmentIV(explicit string, sequence uint64) ([]byte, error) {
+	iv := make([]byte, aes.BlockSize)
+	if explicit == "" {
+		binary.BigEndian.PutUint64(iv[8:], sequence)
+		return iv, nil
+	}
+
+	value := strings.TrimPrefix(strings.TrimPrefix(explicit, "0x"), "0X")
+	if len(value)%2 == 1 {
+		value = "0" + value
+	}
+	decoded, err := hex.DecodeString(value)
+	if err != nil || len(decoded) > aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV %s", explicit)
+	}
+	copy(iv[aes.BlockSize-len(decoded):], decoded)
+	return iv, nil
+}
+
+// cbcDecryptReader decrypts an AES-128-CBC stream while it is read and strips
+// the PKCS7 padding from the final block
+type cbcDecryptReader struct {
+	source  io.Reader
+	mode    cipher.BlockMode
+	pending []byte // ciphertext not yet decrypted
+	plain   []byte // plaintext ready to be returned
+	eof     bool
+}
+
+func newCBCDecryptReader(source io.Reader, key, iv []byte) (*cbcDecryptReader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cbcDecryptReader{
+		source: source,
+		mode:   cipher.NewCBCDecrypter(block, iv),
+	}, nil
+}
+
+func (r *cbcDecryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// fill decrypts every complete block except the last one, which is held back
+// until the end of the stream so its padding can be removed
+func (r *cbcDecryptReader) fill() error {
+	buf := make([]byte, 32*1024)
+	n, err := r.source.Read(buf)
+	r.pending = append(r.pending, buf[:n]...)
+	if err == io.EOF {
+		r.eof = true
+	} else if err != nil {
+		return err
+	}
+
+	if r.eof {
+		if len(r.pending)%aes.BlockSize != 0 {
+			return errors.New("encrypted segment is not a multiple of the AES block size")
+		}
+		if len(r.pending) == 0 {
+			return nil
+		}
+		r.mode.CryptBlocks(r.pending, r.pending)
+		plain, err := stripPKCS7(r.pending)
+		if err != nil {
+			return err
+		}
+		r.plain = plain
+		r.pending = nil
+		return nil
+	}
+
+	ready := len(r.pending) - len(r.pending)%aes.BlockSize - aes.BlockSize
+	if ready <= 0 {
+		return nil
+	}
+	plain := make([]byte, ready)
+	r.mode.CryptBlocks(plain, r.pending[:ready])
+	r.plain = plain
+	r.pending = append([]byte{}, r.pending[ready:]...)
+	return nil
+}
+
+// stripPKCS7 removes the PKCS7 padding of the final decrypted block
+func stripPKCS7(data []byte) ([]byte, error) {
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(data) {
+		return nil, errors.New("invalid PKCS7 padding, is the key correct?")
+	}
+	for _, b := range data[len(data)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("invalid PKCS7 padding, is the key correct?")
+		}
+	}
+	return data[:len(data)-padding], nil
+}
+
+// decryptingReader wraps a segment body so it yields plaintext. AES-128
+// segments are decrypted while streaming, SAMPLE-AES segments have to be
+// buffered since their samples are encrypted inside the container
+func decryptingReader(body io.Reader, encryption *segmentEncryption) (io.Reader, error) {
+	if encryption == nil {
+		return body, nil
+	}
+	switch encryption.Method {
+	case ENCRYPTION_AES_128:
+		return newCBCDecryptReader(body, encryption.Key, encryption.IV)
+	case ENCRYPTION_SAMPLE_AES:
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		decrypted, err := decryptSampleAESTransportStream(data, encryption.Key, encryption.IV)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(decrypted), nil
+	}
+	return nil, &UnsupportedEncryptionError{Method: encryption.Method}
+}
@@ -0,0 +1,262 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+var (
+	testKey      = []byte("0123456789abcdef")
+	testWrongKey = []byte("fedcba9876543210")
+	testIV       = []byte("abcdefghijklmnop")
+)
+
+// testPKCS7 pads data to a multiple of the AES block size
+func testPKCS7(data []byte) []byte {
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	return append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+}
+
+// testEncrypt encrypts data, which must be a multiple of the AES block size,
+// with AES-128-CBC
+func testEncrypt(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, testIV).CryptBlocks(encrypted, data)
+	return encrypted
+}
+
+// testPlaintext returns n bytes of a repeating pattern
+func testPlaintext(n int) []byte {
+	data := make([]byte, n)
+	for idx := range data {
+		data[idx] = byte(idx % 251)
+	}
+	return data
+}
+
+func TestCBCDecryptReader(t *testing.T) {
+	tests := []struct {
+		name       string
+		ciphertext []byte
+		key        []byte
+		oneByte    bool
+		want       []byte
+		wantErr    bool
+	}{
+		{"empty plaintext", testEncrypt(t, testKey, testPKCS7(nil)), testKey, false, []byte{}, false},
+		{"partial block", testEncrypt(t, testKey, testPKCS7(testPlaintext(15))), testKey, false, testPlaintext(15), false},
+		{"exact block boundary", testEncrypt(t, testKey, testPKCS7(testPlaintext(32))), testKey, false, testPlaintext(32), false},
+		{"larger than the read buffer", testEncrypt(t, testKey, testPKCS7(testPlaintext(100000))), testKey, false, testPlaintext(100000), false},
+		{"one byte at a time", testEncrypt(t, testKey, testPKCS7(testPlaintext(50))), testKey, true, testPlaintext(50), false},
+		{"bad padding", testEncrypt(t, testKey, append(testPlaintext(31), 0x05)), testKey, false, nil, true},
+		{"wrong key", testEncrypt(t, testKey, testPKCS7(testPlaintext(40))), testWrongKey, false, nil, true},
+		{"truncated", testEncrypt(t, testKey, testPKCS7(testPlaintext(40)))[:40], testKey, false, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var source io.Reader = bytes.NewReader(test.ciphertext)
+			if test.oneByte {
+				source = iotest.OneByteReader(source)
+			}
+			reader, err := newCBCDecryptReader(source, test.key, testIV)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(reader)
+			if test.wantErr {
+				if err == nil {
+					t.Error("ReadAll() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("decrypted %d bytes, want %d bytes of plaintext", len(got), len(test.want))
+			}
+		})
+	}
+}
+
+func TestStripPKCS7(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"one byte of padding", append(testPlaintext(15), 0x01), testPlaintext(15), false},
+		{"full padding block", append(testPlaintext(16), bytes.Repeat([]byte{16}, 16)...), testPlaintext(16), false},
+		{"only padding", bytes.Repeat([]byte{16}, 16), []byte{}, false},
+		{"zero padding", append(testPlaintext(15), 0x00), nil, true},
+		{"padding above the block size", append(testPlaintext(15), 17), nil, true},
+		{"padding longer than the data", []byte{1, 3}, nil, true},
+		{"inconsistent padding", append(testPlaintext(13), 0x02, 0x03, 0x03), nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := stripPKCS7(test.data)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("stripPKCS7() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("stripPKCS7() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSegmentIV(t *testing.T) {
+	tests := []struct {
+		name     string
+		explicit string
+		sequence uint64
+		want     []byte
+		wantErr  bool
+	}{
+		{"media sequence", "", 0x0102, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2}, false},
+		{"large media sequence", "", 1 << 40, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0}, false},
+		{"explicit IV", "0x000102030405060708090A0B0C0D0E0F", 7, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, false},
+		{"short explicit IV", "0X1ff", 7, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xff}, false},
+		{"not hex", "0xzz", 0, nil, true},
+		{"longer than a block", "0x" + fmt.Sprintf("%034x", 1), 0, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := segmentIV(test.explicit, test.sequence)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("segmentIV() = %x, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("segmentIV() = %x, want %x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMapKeys(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-MAP:URI="init0.mp4"
+#EXT-X-KEY:METHOD=AES-128,URI="key1.bin",IV=0x01
+#EXTINF:4,
+seg0.m4s
+#EXT-X-MAP:URI="init1.mp4"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="key2.bin"
+#EXT-X-MAP:URI="init2.mp4"
+#EXT-X-KEY:METHOD=AES-128,URI="key,3.bin",KEYFORMAT="identity"
+#EXTINF:4,
+seg1.m4s
+#EXT-X-KEY:METHOD=NONE
+#EXT-X-MAP:URI="init3.mp4"
+`
+	want := []*m3u8.Key{
+		nil,
+		{Method: ENCRYPTION_AES_128, URI: "key1.bin", IV: "0x01"},
+		nil,
+		nil,
+	}
+	got := mapKeys([]byte(playlist))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mapKeys() = %v, want %v", got, want)
+	}
+
+	// the key declared after the last map only applies to the segments
+	got = mapKeys([]byte(playlist + "#EXT-X-KEY:METHOD=AES-128,URI=\"key,3.bin\",KEYFORMAT=\"identity\"\n#EXT-X-MAP:URI=\"init4.mp4\"\n"))
+	if last := got[len(got)-1]; last == nil || last.URI != "key,3.bin" || last.Keyformat != "identity" {
+		t.Errorf("key of the last map = %v, want key,3.bin with the identity key format", last)
+	}
+}
+
+func TestKeyCacheFetch(t *testing.T) {
+	ctx := context.Background()
+	var fetches int32
+	slowStarted, slow := make(chan struct{}), make(chan struct{})
+	cache := newKeyCache(func(ctx context.Context, url string) ([]byte, error) {
+		atomic.AddInt32(&fetches, 1)
+		switch url {
+		case "slow.key":
+			close(slowStarted)
+			<-slow
+		case "short.key":
+			return []byte("short"), nil
+		}
+		return testKey, nil
+	})
+
+	// a key being fetched doesn't block the segments using another key
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := cache.fetch(ctx, "slow.key")
+		slowDone <- err
+	}()
+	<-slowStarted
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := cache.fetch(ctx, "fast.key")
+		fetched <- err
+	}()
+	select {
+	case err := <-fetched:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetching a key waited for the fetch of another key")
+	}
+	close(slow)
+	if err := <-slowDone; err != nil {
+		t.Fatal(err)
+	}
+
+	// segments sharing a key fetch it once
+	atomic.StoreInt32(&fetches, 0)
+	var wg sync.WaitGroup
+	for idx := 0; idx < 8; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if key, err := cache.fetch(ctx, "shared.key"); err != nil || !bytes.Equal(key, testKey) {
+				t.Errorf("fetch() = %x, %v, want the key", key, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if fetches != 1 {
+		t.Errorf("shared key fetched %d times, want 1", fetches)
+	}
+
+	if _, err := cache.fetch(ctx, "short.key"); err == nil {
+		t.Error("fetch() of a 5 byte key succeeded, want an error")
+	}
+}
@@ -0,0 +1,171 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafov/m3u8"
+)
+
+// PlaylistDescription is the machine readable description of a master
+// playlist
+type PlaylistDescription struct {
+	UID         string            `json:"uid"`
+	ManifestURL string            `json:"manifestUrl"`
+	Duration    float64           `json:"duration"`
+	Variants    []VariantInfo     `json:"variants"`
+	Audio       []AlternativeInfo `json:"audio"`
+	Subtitles   []AlternativeInfo `json:"subtitles"`
+}
+
+// VariantInfo describes a variant of the master playlist along with its
+// media playlist
+type VariantInfo struct {
+	Resolution       string  `json:"resolution"`
+	Bandwidth        uint32  `json:"bandwidth"`
+	AverageBandwidth uint32  `json:"averageBandwidth,omitempty"`
+	Codecs           string  `json:"codecs,omitempty"`
+	FrameRate        float64 `json:"frameRate,omitempty"`
+	AudioGroup       string  `json:"audioGroup,omitempty"`
+	SubtitlesGroup   string  `json:"subtitlesGroup,omitempty"`
+	ManifestURL      string  `json:"manifestUrl"`
+	Segments         int     `json:"segments"`
+	Duration         float64 `json:"duration"`
+}
+
+// AlternativeInfo describes an audio or subtitles rendition. Renditions
+// carried by the variants have no manifest of their own
+type AlternativeInfo struct {
+	Group       string  `json:"group"`
+	Language    string  `json:"language,omitempty"`
+	Name        string  `json:"name"`
+	Default     bool    `json:"default"`
+	ManifestURL string  `json:"manifestUrl,omitempty"`
+	Segments    int     `json:"segments,omitempty"`
+	Duration    float64 `json:"duration,omitempty"`
+}
+
+// Describe fetches the media playlists of every variant and alternative
+// rendition to describe the master playlist
+func (v *Video) Describe(ctx context.Context) (*PlaylistDescription, error) {
+	description := &PlaylistDescription{
+		UID:         v.VideoUID,
+		ManifestURL: v.signedURL(v.MasterManifestURL),
+		Variants:    []VariantInfo{},
+		Audio:       []AlternativeInfo{},
+		Subtitles:   []AlternativeInfo{},
+	}
+
+	for _, variant := range v.MasterPlaylist.Variants {
+		if variant == nil || variant.Iframe {
+			continue
+		}
+		info, err := v.DescribeVariant(ctx, variant)
+		if err != nil {
+			return nil, err
+		}
+		if description.Duration == 0 {
+			description.Duration = info.Duration
+		}
+		description.Variants = append(description.Variants, info)
+	}
+
+	seen := make(map[string]bool)
+	for _, variant := range v.MasterPlaylist.Variants {
+		for _, media := range variant.Alternatives {
+			key := media.Type + media.GroupId + media.URI + media.Name
+			if (media.Type != "AUDIO" && media.Type != "SUBTITLES") || seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			info := AlternativeInfo{
+				Group:    media.GroupId,
+				Language: media.Language,
+				Name:     media.Name,
+				Default:  media.Default,
+			}
+			if media.URI != "" {
+				manifestURL, err := resolveURL(v.MasterManifestURL, media.URI)
+				if err != nil {
+					return nil, err
+				}
+				info.ManifestURL = v.signedURL(manifestURL)
+				info.Segments, info.Duration, err = v.mediaPlaylistStats(ctx, info.ManifestURL)
+				if err != nil {
+					return nil, fmt.Errorf("there was a problem reading the %s playlist of %s: %w", media.Type, media.Name, err)
+				}
+			}
+			if media.Type == "AUDIO" {
+				description.Audio = append(description.Audio, info)
+			} else {
+				description.Subtitles = append(description.Subtitles, info)
+			}
+		}
+	}
+	return description, nil
+}
+
+// DescribeVariant describes a variant along with the segments of its media
+// playlist
+func (v *Video) DescribeVariant(ctx context.Context, variant *m3u8.Variant) (VariantInfo, error) {
+	manifestURL, err := resolveURL(v.MasterManifestURL, variant.URI)
+	if err != nil {
+		return VariantInfo{}, err
+	}
+	info := VariantInfo{
+		Resolution:       variant.Resolution,
+		Bandwidth:        variant.Bandwidth,
+		AverageBandwidth: variant.AverageBandwidth,
+		Codecs:           variant.Codecs,
+		FrameRate:        variant.FrameRate,
+		AudioGroup:       variant.Audio,
+		SubtitlesGroup:   variant.Subtitles,
+		ManifestURL:      v.signedURL(manifestURL),
+	}
+	info.Segments, info.Duration, err = v.mediaPlaylistStats(ctx, info.ManifestURL)
+	if err != nil {
+		return VariantInfo{}, fmt.Errorf("there was a problem reading the %s playlist: %w", variant.Resolution, err)
+	}
+	return info, nil
+}
+
+// mediaPlaylistStats returns the number of segments of a media playlist and
+// the sum of their durations in seconds
+func (v *Video) mediaPlaylistStats(ctx context.Context, manifestURL string) (int, float64, error) {
+	playlist, err := v.fetchMediaPlaylist(ctx, manifestURL)
+	if err != nil {
+		return 0, 0, err
+	}
+	segments, duration := 0, 0.0
+	for _, segment := range playlist.Segments {
+		if segment != nil {
+			segments++
+			duration += segment.Duration
+		}
+	}
+	return segments, roundDuration(duration), nil
+}
+
+// SegmentCount returns the number of files making up the media playlist of
+// variant, its initialization section included
+func (v *Video) SegmentCount(ctx context.Context, variant *m3u8.Variant) (int, error) {
+	manifestURL, err := v.VariantManifestURL(variant)
+	if err != nil {
+		return 0, err
+	}
+	playlist, err := v.fetchMediaPlaylist(ctx, manifestURL)
+	if err != nil {
+		return 0, fmt.Errorf("there was a problem reading the %s playlist: %w", variant.Resolution, err)
+	}
+	segments := 0
+	if playlist.Map != nil {
+		segments++
+	}
+	for _, segment := range playlist.Segments {
+		if segment != nil {
+			segments++
+		}
+	}
+	return segments, nil
+}
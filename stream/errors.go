@@ -0,0 +1,49 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidInput is returned when a video URL or UID can't be resolved
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrNoRendition is returned when no variant matches the selection rules
+	ErrNoRendition = errors.New("no rendition matches")
+	// ErrNoAudioTrack is returned when no audio track matches the selection
+	ErrNoAudioTrack = errors.New("no audio track matches")
+	// ErrNothingRecorded is returned when a recording stopped before its
+	// first segment
+	ErrNothingRecorded = errors.New("no segments were recorded")
+	// ErrMissingCredentials is returned by Upload without an account ID or
+	// an API token
+	ErrMissingCredentials = errors.New("missing credentials")
+)
+
+// UnsupportedEncryptionError is returned for segments encrypted with a
+// method or key format that can't be decrypted, such as DRM
+type UnsupportedEncryptionError struct {
+	Method    string
+	KeyFormat string
+}
+
+func (e *UnsupportedEncryptionError) Error() string {
+	if e.KeyFormat != "" {
+		return fmt.Sprintf("key format %s requires a DRM license and is not supported", e.KeyFormat)
+	}
+	return fmt.Sprintf("encryption method %s is not supported", e.Method)
+}
+
+// VerificationError reports segments of a rendition that still fail
+// verification after VERIFY_ATTEMPTS downloads
+type VerificationError struct {
+	Rendition string
+	Failed    int
+	Path      string // the first failing segment
+	Problem   string
+	Report    string // path of the verification report
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("%d %s segments failed verification, e.g. %s: %s (see %s)", e.Failed, e.Rendition, e.Path, e.Problem, e.Report)
+}
@@ -0,0 +1,69 @@
+package stream
+
+import "time"
+
+// EventType tells the events sent to Client.OnEvent apart
+type EventType string
+
+const (
+	// EVENT_MESSAGE carries a progress message meant for people in Message
+	EVENT_MESSAGE EventType = "message"
+	// EVENT_SELECTED is sent when a variant was picked, Message names it
+	// along with the reason
+	EVENT_SELECTED EventType = "selected"
+	// EVENT_PROGRESS is sent every PROGRESS_INTERVAL while segments are
+	// downloaded
+	EVENT_PROGRESS EventType = "progress"
+	// EVENT_TRANSFER_DONE carries the totals once the segment downloads of an
+	// operation finished
+	EVENT_TRANSFER_DONE EventType = "transfer-done"
+	// EVENT_UPLOAD_PROGRESS is sent after every uploaded chunk
+	EVENT_UPLOAD_PROGRESS EventType = "upload-progress"
+)
+
+// PROGRESS_INTERVAL is how often EVENT_PROGRESS is sent during a download
+const PROGRESS_INTERVAL = 200 * time.Millisecond
+
+// Event is a message or a progress update of an operation
+type Event struct {
+	Type     EventType
+	Message  string
+	Progress *Progress
+}
+
+// Progress is a snapshot of the bytes transferred by an operation
+type Progress struct {
+	// Stage names the rendition being downloaded or the uploaded file
+	Stage string
+	// Bytes counts the finished and running segments or chunks, including
+	// the segments found on disk from an earlier run
+	Bytes int64
+	// Transferred counts the bytes sent or received over the network
+	Transferred int64
+	// Total is the size of the transfer, 0 while it is unknown. Estimated is
+	// set while it is extrapolated from the segments started so far
+	Total     int64
+	Estimated bool
+	// Done and Planned count the segments, or the chunks of an upload
+	Done    int
+	Planned int
+	Retries int
+	Elapsed time.Duration
+}
+
+// Throughput returns the bytes transferred per second
+func (p *Progress) Throughput() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Transferred) / p.Elapsed.Seconds()
+}
+
+// ETA returns the time left at the current throughput, 0 when it is unknown
+func (p *Progress) ETA() time.Duration {
+	throughput := p.Throughput()
+	if throughput <= 0 || p.Total <= p.Bytes {
+		return 0
+	}
+	return time.Duration(float64(p.Total-p.Bytes) / throughput * float64(time.Second))
+}
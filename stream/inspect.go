@@ -0,0 +1,251 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	// SIZE_FROM_HEAD sizes are the Content-Length of every segment
+	SIZE_FROM_HEAD = "head"
+	// SIZE_FROM_BANDWIDTH sizes are BANDWIDTH × duration estimates
+	SIZE_FROM_BANDWIDTH = "bandwidth"
+	// SIZE_UNKNOWN is used for renditions without HEAD sizes or bandwidth
+	SIZE_UNKNOWN = "unknown"
+)
+
+// InspectReport describes every rendition of a video
+type InspectReport struct {
+	UID         string            `json:"uid"`
+	ManifestURL string            `json:"manifestUrl"`
+	Renditions  []RenditionReport `json:"renditions"`
+}
+
+// RenditionReport describes the media playlist of a variant or an audio or
+// subtitles rendition along with its estimated size
+type RenditionReport struct {
+	Type                   string   `json:"type"`
+	Name                   string   `json:"name"`
+	Bandwidth              uint32   `json:"bandwidth,omitempty"`
+	ManifestURL            string   `json:"manifestUrl"`
+	PlaylistType           string   `json:"playlistType"`
+	Segments               int      `json:"segments"`
+	Duration               float64  `json:"duration"`
+	AverageSegmentDuration float64  `json:"averageSegmentDuration"`
+	TargetDuration         float64  `json:"targetDuration"`
+	Encryption             []string `json:"encryption"`
+	Discontinuities        int      `json:"discontinuities"`
+	EstimatedBytes         int64    `json:"estimatedBytes"`
+	SizeSource             string   `json:"sizeSource"`
+}
+
+// Inspect reports on the media playlist of every variant and alternative
+// rendition. The segment sizes are requested with HEAD requests when
+// headRequests is set, otherwise they are estimated from BANDWIDTH × duration
+func (v *Video) Inspect(ctx context.Context, headRequests bool) (*InspectReport, error) {
+	report := &InspectReport{
+		UID:         v.VideoUID,
+		ManifestURL: v.signedURL(v.MasterManifestURL),
+		Renditions:  []RenditionReport{},
+	}
+
+	seen := make(map[string]bool)
+	for _, variant := range v.MasterPlaylist.Variants {
+		if variant == nil || variant.Iframe || seen[variant.URI] {
+			continue
+		}
+		seen[variant.URI] = true
+		rendition, err := v.inspectRendition(ctx, RENDITION_VIDEO, variant.Resolution, variant.URI, variant.Bandwidth, headRequests)
+		if err != nil {
+			return nil, err
+		}
+		report.Renditions = append(report.Renditions, rendition)
+	}
+
+	for _, variant := range v.MasterPlaylist.Variants {
+		for _, media := range variant.Alternatives {
+			if (media.Type != "AUDIO" && media.Type != "SUBTITLES") || media.URI == "" || seen[media.URI] {
+				continue
+			}
+			seen[media.URI] = true
+			renditionType := RENDITION_AUDIO
+			if media.Type == "SUBTITLES" {
+				renditionType = "subtitles"
+			}
+			name := fmt.Sprintf("%s/%s", media.GroupId, renditionLabel(media))
+			rendition, err := v.inspectRendition(ctx, renditionType, name, media.URI, 0, headRequests)
+			if err != nil {
+				return nil, err
+			}
+			report.Renditions = append(report.Renditions, rendition)
+		}
+	}
+	return report, nil
+}
+
+// inspectRendition decodes a media playlist and estimates its size. bandwidth
+// is the BANDWIDTH of a variant, 0 for alternative renditions
+func (v *Video) inspectRendition(ctx context.Context, renditionType, name, uri string, bandwidth uint32, headRequests bool) (RenditionReport, error) {
+	manifestURL, err := resolveURL(v.MasterManifestURL, uri)
+	if err != nil {
+		return RenditionReport{}, err
+	}
+	manifestURL = v.signedURL(manifestURL)
+	playlist, err := v.fetchMediaPlaylist(ctx, manifestURL)
+	if err != nil {
+		return RenditionReport{}, fmt.Errorf("there was a problem reading the %s playlist: %w", name, err)
+	}
+
+	report := RenditionReport{
+		Type:           renditionType,
+		Name:           name,
+		Bandwidth:      bandwidth,
+		ManifestURL:    manifestURL,
+		PlaylistType:   playlistType(playlist),
+		TargetDuration: playlist.TargetDuration,
+		Encryption:     []string{},
+		SizeSource:     SIZE_UNKNOWN,
+	}
+
+	// the sizes of byte range segments are known from the playlist
+	urls := []string{}
+	var rangeBytes int64
+	addResource := func(uri string, limit int64) error {
+		if limit > 0 {
+			rangeBytes += limit
+			return nil
+		}
+		resourceURL, err := resolveURL(manifestURL, uri)
+		if err != nil {
+			return err
+		}
+		urls = append(urls, v.signedURL(resourceURL))
+		return nil
+	}
+	if playlist.Map != nil {
+		if err := addResource(playlist.Map.URI, playlist.Map.Limit); err != nil {
+			return RenditionReport{}, err
+		}
+	}
+	methods := make(map[string]bool)
+	addKey := func(key *m3u8.Key) {
+		if key != nil && key.Method != "" && key.Method != "NONE" && !methods[key.Method] {
+			methods[key.Method] = true
+			report.Encryption = append(report.Encryption, key.Method)
+		}
+	}
+	addKey(playlist.Key)
+	for _, segment := range playlist.Segments {
+		if segment == nil {
+			continue
+		}
+		report.Segments++
+		report.Duration += segment.Duration
+		if segment.Discontinuity {
+			report.Discontinuities++
+		}
+		addKey(segment.Key)
+		if err := addResource(segment.URI, segment.Limit); err != nil {
+			return RenditionReport{}, err
+		}
+	}
+	if report.Segments > 0 {
+		report.AverageSegmentDuration = roundDuration(report.Duration / float64(report.Segments))
+	}
+	report.Duration = roundDuration(report.Duration)
+
+	if headRequests {
+		size, ok, err := v.client.contentLengths(ctx, urls)
+		if err != nil {
+			return RenditionReport{}, err
+		}
+		if ok {
+			report.EstimatedBytes, report.SizeSource = size+rangeBytes, SIZE_FROM_HEAD
+			return report, nil
+		}
+	}
+	if bandwidth > 0 {
+		report.EstimatedBytes = int64(float64(bandwidth) / 8 * report.Duration)
+		report.SizeSource = SIZE_FROM_BANDWIDTH
+	}
+	return report, nil
+}
+
+// playlistType returns VOD, EVENT or LIVE. Playlists without a type that are
+// complete are reported as VOD
+func playlistType(playlist *m3u8.MediaPlaylist) string {
+	switch {
+	case playlist.MediaType == m3u8.VOD:
+		return "VOD"
+	case playlist.MediaType == m3u8.EVENT:
+		return "EVENT"
+	case playlist.Closed:
+		return "VOD"
+	}
+	return "LIVE"
+}
+
+// contentLengths sums the Content-Length of HEAD requests on urls, sent with
+// up to Concurrency at the same time. It reports false as soon as a request
+// fails or a length is missing, so the estimate falls back to the bandwidth,
+// and returns the error of ctx once it is done
+func (c *Client) contentLengths(ctx context.Context, urls []string) (int64, bool, error) {
+	heads, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var total int64
+	ok := true
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, resourceURL := range urls {
+		// the slot is taken before starting a goroutine, so a long
+		// playlist doesn't start one per segment
+		if err := c.acquireDownloadSlot(heads); err != nil {
+			break
+		}
+		resourceURL := resourceURL
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.releaseDownloadSlot()
+
+			length, err := c.contentLength(heads, resourceURL)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil || length < 0 {
+				ok = false
+				cancel()
+				return
+			}
+			total += length
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+	if !ok {
+		return 0, false, nil
+	}
+	return total, true, nil
+}
+
+// contentLength returns the Content-Length announced for url, -1 when the
+// server doesn't send one. The request isn't retried, a failure only costs
+// the accuracy of the estimate
+func (c *Client) contentLength(ctx context.Context, url string) (int64, error) {
+	resp, err := c.request(ctx, http.MethodHead, url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return 0, err
+	}
+	return resp.ContentLength, nil
+}
@@ -0,0 +1,211 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// JOURNAL_FLUSH_SEGMENTS and JOURNAL_FLUSH_INTERVAL bound how many
+	// finished segments a crash can forget, those are downloaded again
+	JOURNAL_FLUSH_SEGMENTS = 32
+	JOURNAL_FLUSH_INTERVAL = 2 * time.Second
+)
+
+// journalSegment tracks a single segment of a rendition download
+type journalSegment struct {
+	URL       string `json:"url"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Completed bool   `json:"completed"`
+	Verified  bool   `json:"verified"`
+}
+
+// downloadJournal is persisted next to the segments directory so an interrupted
+// download can skip the segments that already made it to disk
+type downloadJournal struct {
+	// Video is the UID of the video, or the manifest URL without its query
+	// when the UID is unknown, so another video never resumes these files
+	Video       string           `json:"video"`
+	ManifestURL string           `json:"manifestUrl"`
+	Resolution  string           `json:"resolution"`
+	Rendition   string           `json:"rendition"`
+	Segments    []journalSegment `json:"segments"`
+
+	path    string
+	mu      sync.Mutex
+	pending int
+	flushed time.Time
+}
+
+// journalPath returns where the journal for a rendition download is stored
+func journalPath(directory, rendition string) string {
+	return fmt.Sprintf("%s/%s_journal.json", directory, rendition)
+}
+
+// openDownloadJournal loads the journal at journalPath when it describes the
+// same segment list, otherwise a fresh journal is created for the download
+func (v *Video) openDownloadJournal(journalPath, manifestURL, resolution, rendition string, segmentURLs, segmentPaths []string) (*downloadJournal, error) {
+	journal := &downloadJournal{
+		Video:       v.journalIdentity(manifestURL),
+		ManifestURL: manifestURL,
+		Resolution:  resolution,
+		Rendition:   rendition,
+		path:        journalPath,
+	}
+	for idx, segmentURL := range segmentURLs {
+		journal.Segments = append(journal.Segments, journalSegment{
+			URL:  segmentURL,
+			Path: segmentPaths[idx],
+		})
+	}
+
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return journal, journal.save()
+		}
+		return nil, err
+	}
+
+	previous := downloadJournal{}
+	if err := json.Unmarshal(data, &previous); err != nil {
+		v.printf("⚠️ WARNING: ignoring unreadable download journal %s: %v\n", journalPath, err)
+		return journal, journal.save()
+	}
+	if !journal.matches(&previous) {
+		if previous.Video != journal.Video {
+			v.printf("⚠️ WARNING: %s belongs to another video, its segments are downloaded again\n", journalPath)
+		}
+		return journal, journal.save()
+	}
+
+	// signed URL tokens change between runs, so keep the fresh URLs
+	for idx := range previous.Segments {
+		previous.Segments[idx].URL = journal.Segments[idx].URL
+	}
+	journal.Segments = previous.Segments
+	return journal, journal.save()
+}
+
+// journalIdentity names the video a journal belongs to. Signed manifest URLs
+// carry a fresh token on every run, so the UID is preferred
+func (v *Video) journalIdentity(manifestURL string) string {
+	if v.VideoUID != "" {
+		return v.VideoUID
+	}
+	parsed, err := url.Parse(manifestURL)
+	if err != nil {
+		return manifestURL
+	}
+	parsed.RawQuery, parsed.Fragment = "", ""
+	return parsed.String()
+}
+
+// matches reports whether the previous journal was recorded for the same
+// video, rendition and segment files
+func (j *downloadJournal) matches(previous *downloadJournal) bool {
+	if previous.Video != j.Video {
+		return false
+	}
+	if previous.Rendition != j.Rendition || previous.Resolution != j.Resolution {
+		return false
+	}
+	if len(previous.Segments) != len(j.Segments) {
+		return false
+	}
+	for idx, segment := range previous.Segments {
+		if segment.Path != j.Segments[idx].Path {
+			return false
+		}
+	}
+	return true
+}
+
+// isComplete reports whether a segment was fully downloaded and is still on
+// disk with the recorded size
+func (j *downloadJournal) isComplete(idx int) bool {
+	j.mu.Lock()
+	segment := j.Segments[idx]
+	j.mu.Unlock()
+
+	if !segment.Completed {
+		return false
+	}
+	info, err := os.Stat(segment.Path)
+	if err != nil {
+		return false
+	}
+	return info.Size() == segment.Size
+}
+
+// completedCount returns the number of segments that do not need downloading
+func (j *downloadJournal) completedCount() int {
+	count := 0
+	for idx := range j.Segments {
+		if j.isComplete(idx) {
+			count++
+		}
+	}
+	return count
+}
+
+// markComplete records a finished segment. The journal is flushed to disk
+// every JOURNAL_FLUSH_SEGMENTS segments or JOURNAL_FLUSH_INTERVAL, save
+// writes the rest once the segments are done. A nil journal records nothing,
+// for the segments that can't be resumed such as live ones
+func (j *downloadJournal) markComplete(idx int, size int64, verified bool) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Segments[idx].Size = size
+	j.Segments[idx].Completed = true
+	j.Segments[idx].Verified = verified
+	j.pending++
+	if j.pending < JOURNAL_FLUSH_SEGMENTS && time.Since(j.flushed) < JOURNAL_FLUSH_INTERVAL {
+		return nil
+	}
+	return j.saveLocked()
+}
+
+// save flushes the journal to disk
+func (j *downloadJournal) save() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.saveLocked()
+}
+
+// saveLocked writes the journal through a temporary file so a crash never
+// leaves a half-written journal behind
+func (j *downloadJournal) saveLocked() error {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := j.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+	j.pending = 0
+	j.flushed = time.Now()
+	return nil
+}
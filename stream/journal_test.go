@@ -0,0 +1,65 @@
+package stream
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenDownloadJournal(t *testing.T) {
+	dir := t.TempDir()
+	segmentPath := filepath.Join(dir, "segments", "video_seg_1.ts")
+	if err := os.MkdirAll(filepath.Dir(segmentPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(segmentPath, []byte("segment"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	journalFile := journalPath(dir, RENDITION_VIDEO)
+
+	open := func(video *Video, manifestURL string) *downloadJournal {
+		t.Helper()
+		journal, err := video.openDownloadJournal(journalFile, manifestURL, "1280x720", RENDITION_VIDEO, []string{manifestURL + "/seg_1.ts"}, []string{segmentPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return journal
+	}
+
+	first := &Video{VideoUID: "aaaa"}
+	journal := open(first, "https://example.com/aaaa/manifest/stream_720.m3u8?token=1")
+	if err := journal.markComplete(0, 7, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		video       *Video
+		manifestURL string
+		completed   int
+	}{
+		{"same video with a new token", &Video{VideoUID: "aaaa"}, "https://example.com/aaaa/manifest/stream_720.m3u8?token=2", 1},
+		{"another video", &Video{VideoUID: "bbbb"}, "https://example.com/bbbb/manifest/stream_720.m3u8", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if completed := open(test.video, test.manifestURL).completedCount(); completed != test.completed {
+				t.Errorf("completedCount() = %d, want %d", completed, test.completed)
+			}
+		})
+	}
+}
+
+func TestJournalIdentity(t *testing.T) {
+	withoutUID := &Video{}
+	if got, want := withoutUID.journalIdentity("https://cdn.example.com/live/index.m3u8?token=abc#t=1"), "https://cdn.example.com/live/index.m3u8"; got != want {
+		t.Errorf("journalIdentity() = %q, want %q", got, want)
+	}
+	withUID := &Video{VideoUID: "aaaa"}
+	if got := withUID.journalIdentity("https://example.com/token/manifest/video.m3u8"); got != "aaaa" {
+		t.Errorf("journalIdentity() = %q, want the UID", got)
+	}
+}
@@ -0,0 +1,312 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/grafov/m3u8"
+)
+
+// MIRROR_MASTER_PLAYLIST is the file name of the rewritten master playlist
+const MIRROR_MASTER_PLAYLIST = "master.m3u8"
+
+// mirroredPlaylist is a media playlist saved by the mirror along with the
+// directory its segments were downloaded into
+type mirroredPlaylist struct {
+	path      string
+	directory string
+}
+
+// Mirror downloads the variants picked by opts.Resolution, every variant when
+// it is empty, along with their audio and subtitle renditions and init
+// segments. Every playlist is saved with its URIs rewritten to the local
+// files, and the path of the master playlist is returned
+func (v *Video) Mirror(ctx context.Context, opts DownloadOptions) (string, error) {
+	defer v.useEvents(opts.OnEvent)()
+	if opts.Template == "" {
+		opts.Template = VIDEO_OUTPUT_TEMPLATE
+	}
+
+	variants, err := v.mirrorVariants(opts.Resolution)
+	if err != nil {
+		return "", err
+	}
+	v.printf("🪞 Mirroring %d renditions\n", len(variants))
+	defer v.beginTransfer()()
+
+	mirrored := make(map[string]mirroredPlaylist)
+	claimed := make(map[string]bool)
+	master := m3u8.NewMasterPlaylist()
+	master.SetVersion(v.MasterPlaylist.Version())
+	master.SetIndependentSegments(v.MasterPlaylist.IndependentSegments())
+	type mirroredVariant struct {
+		params   m3u8.VariantParams
+		playlist mirroredPlaylist
+	}
+	mirroredVariants := []mirroredVariant{}
+	directories := []string{}
+
+	for _, variant := range variants {
+		params := variant.VariantParams
+		params.Alternatives = nil
+		for _, mediaType := range []string{"AUDIO", "SUBTITLES"} {
+			group := variant.Audio
+			if mediaType == "SUBTITLES" {
+				group = variant.Subtitles
+			}
+			if group == "" {
+				continue
+			}
+			alternatives, err := v.mirrorAlternatives(ctx, opts, mediaType, group, mirrored, claimed)
+			if err != nil {
+				return "", err
+			}
+			params.Alternatives = append(params.Alternatives, alternatives...)
+		}
+
+		renditionURL, err := resolveURL(v.MasterManifestURL, variant.URI)
+		if err != nil {
+			return "", fmt.Errorf("there was a problem resolving the rendition manifest: %w", err)
+		}
+		v.printf("🎞 %s\n", VariantDescription(variant))
+		output := v.renditionOutput(opts, variant.Resolution, variant, claimed)
+		playlist, err := v.mirrorMediaPlaylist(ctx, v.signedURL(renditionURL), output, RENDITION_VIDEO)
+		if err != nil {
+			return "", err
+		}
+		mirroredVariants = append(mirroredVariants, mirroredVariant{params, playlist})
+		directories = append(directories, playlist.directory)
+	}
+	for _, playlist := range mirrored {
+		directories = append(directories, playlist.directory)
+	}
+
+	// the master playlist sits in the directory shared by every rendition
+	masterDirectory := commonDirectory(directories)
+	for _, variant := range mirroredVariants {
+		for _, alternative := range variant.params.Alternatives {
+			if alternative.URI != "" {
+				alternative.URI = relativeURI(masterDirectory, alternative.URI)
+			}
+		}
+		master.Append(relativeURI(masterDirectory, variant.playlist.path), nil, variant.params)
+	}
+
+	masterPath := filepath.Join(masterDirectory, MIRROR_MASTER_PLAYLIST)
+	if err := os.WriteFile(masterPath, master.Encode().Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return masterPath, nil
+}
+
+// mirrorVariants returns the variants picked by the selection rules, or every
+// variant without rules
+func (v *Video) mirrorVariants(rules string) ([]*m3u8.Variant, error) {
+	if rules != "" {
+		variant, err := v.SelectVariant(rules)
+		if err != nil {
+			return nil, err
+		}
+		return []*m3u8.Variant{variant}, nil
+	}
+
+	variants := []*m3u8.Variant{}
+	seen := make(map[string]bool)
+	for _, variant := range v.MasterPlaylist.Variants {
+		if variant == nil || variant.Iframe || seen[variant.URI] {
+			continue
+		}
+		seen[variant.URI] = true
+		variants = append(variants, variant)
+	}
+	if len(variants) == 0 {
+		return nil, errors.New("the master playlist has no renditions")
+	}
+	return variants, nil
+}
+
+// mirrorAlternatives downloads the audio or subtitle renditions of a group,
+// once per group, and returns copies of their EXT-X-MEDIA entries pointing at
+// the saved playlists. Without an audio selection every audio track is kept
+func (v *Video) mirrorAlternatives(ctx context.Context, opts DownloadOptions, mediaType, group string, mirrored map[string]mirroredPlaylist, claimed map[string]bool) ([]*m3u8.Alternative, error) {
+	renditions := v.groupRenditions(mediaType, group)
+	if mediaType == "AUDIO" && opts.Audio != (AudioSelection{}) {
+		selected, err := opts.Audio.selectTracks(renditions)
+		if err != nil {
+			return nil, fmt.Errorf("there was a problem selecting the audio tracks of group %s: %w", group, err)
+		}
+		renditions = selected
+	}
+
+	prefix, rendition := "audio_", RENDITION_AUDIO
+	if mediaType == "SUBTITLES" {
+		prefix, rendition = "subtitles_", "subtitles"
+	}
+	var output renditionOutput
+	alternatives := []*m3u8.Alternative{}
+	for _, named := range renditionNames(rendition, renditions) {
+		alternative := *named.media
+		key := mediaType + "/" + named.media.URI
+		if named.media.URI != "" {
+			playlist, done := mirrored[key]
+			if !done {
+				if output.directory == "" {
+					output = v.renditionOutput(opts, prefix+group, nil, claimed)
+				}
+				manifestURL, err := resolveURL(v.MasterManifestURL, named.media.URI)
+				if err != nil {
+					return nil, err
+				}
+				if mediaType == "SUBTITLES" {
+					v.printf("💬 Mirroring %s subtitles (%s)\n", named.media.Name, named.label)
+					playlist, err = v.mirrorSubtitlePlaylist(ctx, v.signedURL(manifestURL), output, named.label)
+				} else {
+					playlist, err = v.mirrorMediaPlaylist(ctx, v.signedURL(manifestURL), output, named.name)
+				}
+				if err != nil {
+					return nil, err
+				}
+				mirrored[key] = playlist
+			}
+			alternative.URI = playlist.path
+		}
+		alternatives = append(alternatives, &alternative)
+	}
+
+	// players need a default track when the selection left out the original one
+	hasDefault := false
+	for _, alternative := range alternatives {
+		hasDefault = hasDefault || alternative.Default
+	}
+	if mediaType == "AUDIO" && !hasDefault && len(alternatives) > 0 {
+		alternatives[0].Default = true
+	}
+	return alternatives, nil
+}
+
+// mirrorMediaPlaylist downloads the segments of a media playlist and saves the
+// playlist pointing at them. The segments are stored decrypted, so the keys
+// are left out of the saved playlist
+func (v *Video) mirrorMediaPlaylist(ctx context.Context, manifestURL string, output renditionOutput, rendition string) (mirroredPlaylist, error) {
+	segmentPaths, _, _, err := v.downloadSegmentsFromManifest(ctx, manifestURL, output, rendition, Clip{})
+	if err != nil {
+		return mirroredPlaylist{}, fmt.Errorf("there was a problem downloading the %s segments: %w", rendition, err)
+	}
+	playlist, err := v.fetchMediaPlaylist(ctx, manifestURL)
+	if err != nil {
+		return mirroredPlaylist{}, err
+	}
+
+	playlistPath := output.path(rendition, "m3u8")
+	if playlist.Map != nil {
+		playlist.Map = &m3u8.Map{URI: relativeURI(filepath.Dir(playlistPath), segmentPaths[0])}
+		segmentPaths = segmentPaths[1:]
+	}
+	if err := rewriteSegmentURIs(playlist, filepath.Dir(playlistPath), segmentPaths); err != nil {
+		return mirroredPlaylist{}, err
+	}
+	return mirroredPlaylist{path: playlistPath, directory: output.directory}, writePlaylist(playlistPath, playlist)
+}
+
+// mirrorSubtitlePlaylist downloads the WebVTT segments of a subtitles playlist
+// and saves the playlist pointing at them
+func (v *Video) mirrorSubtitlePlaylist(ctx context.Context, manifestURL string, output renditionOutput, label string) (mirroredPlaylist, error) {
+	segmentPaths, err := v.downloadSubtitleSegments(ctx, manifestURL, output.directory, label, Clip{})
+	if err != nil {
+		return mirroredPlaylist{}, fmt.Errorf("there was a problem downloading the %s subtitles: %w", label, err)
+	}
+	playlist, err := v.fetchMediaPlaylist(ctx, manifestURL)
+	if err != nil {
+		return mirroredPlaylist{}, err
+	}
+
+	playlistPath := output.path("subtitles."+label, "m3u8")
+	if err := rewriteSegmentURIs(playlist, filepath.Dir(playlistPath), segmentPaths); err != nil {
+		return mirroredPlaylist{}, err
+	}
+	return mirroredPlaylist{path: playlistPath, directory: output.directory}, writePlaylist(playlistPath, playlist)
+}
+
+// fetchMediaPlaylist downloads and decodes a media playlist
+func (v *Video) fetchMediaPlaylist(ctx context.Context, manifestURL string) (*m3u8.MediaPlaylist, error) {
+	body, err := v.fetchURL(ctx, manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMediaPlaylist(body)
+}
+
+// decodeMediaPlaylist decodes a media playlist
+func decodeMediaPlaylist(body []byte) (*m3u8.MediaPlaylist, error) {
+	playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(body), false)
+	if err != nil {
+		return nil, err
+	}
+	if listType != m3u8.MEDIA {
+		return nil, errors.New("expected a media playlist")
+	}
+	return playlist.(*m3u8.MediaPlaylist), nil
+}
+
+// rewriteSegmentURIs points the segments of a playlist, in playlist order, at
+// the downloaded files relative to directory and drops their keys
+func rewriteSegmentURIs(playlist *m3u8.MediaPlaylist, directory string, segmentPaths []string) error {
+	playlist.Key = nil
+	idx := 0
+	for _, segment := range playlist.Segments {
+		if segment == nil {
+			continue
+		}
+		if idx == len(segmentPaths) {
+			return errors.New("the playlist changed while it was mirrored")
+		}
+		segment.URI = relativeURI(directory, segmentPaths[idx])
+		segment.Key = nil
+		segment.Map = nil
+		idx++
+	}
+	if idx != len(segmentPaths) {
+		return errors.New("the playlist changed while it was mirrored")
+	}
+	return nil
+}
+
+// writePlaylist encodes a media playlist into playlistPath
+func writePlaylist(playlistPath string, playlist *m3u8.MediaPlaylist) error {
+	playlist.ResetCache()
+	return os.WriteFile(playlistPath, playlist.Encode().Bytes(), 0644)
+}
+
+// relativeURI returns the URI of target relative to directory
+func relativeURI(directory, target string) string {
+	relative, err := filepath.Rel(directory, target)
+	if err != nil {
+		return filepath.ToSlash(target)
+	}
+	return filepath.ToSlash(relative)
+}
+
+// commonDirectory returns the deepest directory containing every directory
+func commonDirectory(directories []string) string {
+	common := filepath.Clean(directories[0])
+	for _, directory := range directories[1:] {
+		directory = filepath.Clean(directory)
+		for common != "." && common != string(filepath.Separator) {
+			relative, err := filepath.Rel(common, directory)
+			if err == nil && relative != ".." && !filepath.IsAbs(relative) && !startsWithParent(relative) {
+				break
+			}
+			common = filepath.Dir(common)
+		}
+	}
+	return common
+}
+
+// startsWithParent reports whether a relative path leaves its directory
+func startsWithParent(relative string) bool {
+	return len(relative) >= 3 && relative[:3] == ".."+string(filepath.Separator)
+}
@@ -0,0 +1,528 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// mp4Atom is a box parsed from memory
+type mp4Atom struct {
+	Type string
+	Body []byte
+}
+
+// trackDefaults are the trex defaults used by fragments that omit a value
+type trackDefaults struct {
+	duration uint32
+	size     uint32
+	flags    uint32
+}
+
+// fragmentedTrack is a track of a fragmented MP4 while its fragments are read
+type fragmentedTrack struct {
+	*muxTrack
+	id       uint32
+	defaults trackDefaults
+	started  bool
+}
+
+// mp4Box serialises a box from its type and payload
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, part := range payload {
+		size += len(part)
+	}
+	box := make([]byte, 0, size)
+	box = binary.BigEndian.AppendUint32(box, uint32(size))
+	box = append(box, boxType...)
+	for _, part := range payload {
+		box = append(box, part...)
+	}
+	return box
+}
+
+// mp4FullBox serialises a box carrying a version and flags
+func mp4FullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(boxType, append([][]byte{header}, payload...)...)
+}
+
+// parseBoxes splits data into its boxes
+func parseBoxes(data []byte) ([]mp4Atom, error) {
+	atoms := []mp4Atom{}
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("truncated box header")
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		boxType := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errors.New("truncated box header")
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, fmt.Errorf("invalid size of %s box", boxType)
+		}
+		atoms = append(atoms, mp4Atom{Type: boxType, Body: data[header:size]})
+		data = data[size:]
+	}
+	return atoms, nil
+}
+
+// findBox returns the body of the first box found along path, or nil
+func findBox(data []byte, path ...string) []byte {
+	for _, boxType := range path {
+		atoms, err := parseBoxes(data)
+		if err != nil {
+			return nil
+		}
+		found := false
+		for _, atom := range atoms {
+			if atom.Type == boxType {
+				data, found = atom.Body, true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return data
+}
+
+// findBoxes returns the bodies of every direct child box of the given type
+func findBoxes(data []byte, boxType string) [][]byte {
+	atoms, err := parseBoxes(data)
+	if err != nil {
+		return nil
+	}
+	bodies := [][]byte{}
+	for _, atom := range atoms {
+		if atom.Type == boxType {
+			bodies = append(bodies, atom.Body)
+		}
+	}
+	return bodies
+}
+
+// readTopLevelBox reads the header of the box at offset and returns its type,
+// header size and total size
+func readTopLevelBox(file io.ReaderAt, offset, fileSize int64) (string, int64, int64, error) {
+	header := make([]byte, 16)
+	n, err := file.ReadAt(header, offset)
+	if n < 8 {
+		if err == nil || err == io.EOF {
+			err = errors.New("truncated box header")
+		}
+		return "", 0, 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(header))
+	headerSize := int64(8)
+	switch size {
+	case 0:
+		size = fileSize - offset
+	case 1:
+		if n < 16 {
+			return "", 0, 0, errors.New("truncated box header")
+		}
+		size = int64(binary.BigEndian.Uint64(header[8:]))
+		headerSize = 16
+	}
+	if size < headerSize || offset+size > fileSize {
+		return "", 0, 0, fmt.Errorf("invalid size of %s box at offset %d", header[4:8], offset)
+	}
+	return string(header[4:8]), headerSize, size, nil
+}
+
+// isFragmentedMP4 reports whether a file starts with an ISO BMFF box rather
+// than an MPEG-TS sync byte
+func isFragmentedMP4(header []byte) bool {
+	if len(header) < 8 {
+		return false
+	}
+	switch string(header[4:8]) {
+	case "ftyp", "styp", "moov", "moof", "sidx", "free":
+		return true
+	}
+	return false
+}
+
+// demuxFragmentedMP4 reads the tracks of a concatenated fMP4 rendition. The
+// initialization section describes the tracks and every moof adds samples
+// that stay in the file and are referenced by offset
+func demuxFragmentedMP4(file *os.File) ([]*muxTrack, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileSize := info.Size()
+
+	var tracks []*fragmentedTrack
+	var initStsd [][]byte
+	for offset := int64(0); offset < fileSize; {
+		boxType, headerSize, size, err := readTopLevelBox(file, offset, fileSize)
+		if err != nil {
+			return nil, err
+		}
+
+		switch boxType {
+		case "moov":
+			body := make([]byte, size-headerSize)
+			if _, err := file.ReadAt(body, offset+headerSize); err != nil {
+				return nil, err
+			}
+			if tracks == nil {
+				tracks, err = parseInitSection(body, file)
+				if err != nil {
+					return nil, err
+				}
+				for _, track := range tracks {
+					initStsd = append(initStsd, track.stsd)
+				}
+				break
+			}
+			// a repeated initialization section, e.g. after a discontinuity,
+			// has to describe the same samples
+			repeated, err := parseInitSection(body, file)
+			if err != nil {
+				return nil, err
+			}
+			if len(repeated) != len(tracks) {
+				return nil, errors.New("initialization sections with different tracks are not supported")
+			}
+			for idx, track := range repeated {
+				if !bytes.Equal(track.stsd, initStsd[idx]) {
+					return nil, errors.New("initialization sections with different codec settings are not supported")
+				}
+			}
+		case "moof":
+			if tracks == nil {
+				return nil, errors.New("media segment found before the initialization section")
+			}
+			body := make([]byte, size-headerSize)
+			if _, err := file.ReadAt(body, offset+headerSize); err != nil {
+				return nil, err
+			}
+			if err := parseFragment(body, offset, tracks); err != nil {
+				return nil, err
+			}
+		}
+		offset += size
+	}
+
+	if tracks == nil {
+		return nil, errors.New("no initialization section found")
+	}
+	muxTracks := []*muxTrack{}
+	for _, track := range tracks {
+		if len(track.samples) > 0 {
+			muxTracks = append(muxTracks, track.muxTrack)
+		}
+	}
+	if len(muxTracks) == 0 {
+		return nil, errors.New("no media samples found")
+	}
+	return muxTracks, nil
+}
+
+// parseInitSection reads the tracks and their fragment defaults from a moov box
+func parseInitSection(moov []byte, source io.ReaderAt) ([]*fragmentedTrack, error) {
+	defaults := map[uint32]trackDefaults{}
+	for _, trex := range findBoxes(findBox(moov, "mvex"), "trex") {
+		if len(trex) < 24 {
+			continue
+		}
+		defaults[binary.BigEndian.Uint32(trex[4:])] = trackDefaults{
+			duration: binary.BigEndian.Uint32(trex[12:]),
+			size:     binary.BigEndian.Uint32(trex[16:]),
+			flags:    binary.BigEndian.Uint32(trex[20:]),
+		}
+	}
+
+	tracks := []*fragmentedTrack{}
+	for _, trak := range findBoxes(moov, "trak") {
+		tkhd := findBox(trak, "tkhd")
+		mdhd := findBox(trak, "mdia", "mdhd")
+		hdlr := findBox(trak, "mdia", "hdlr")
+		stsd := findBox(trak, "mdia", "minf", "stbl", "stsd")
+		if len(tkhd) < 84 || len(mdhd) < 24 || len(hdlr) < 12 || len(stsd) < 8 {
+			return nil, errors.New("incomplete track header in initialization section")
+		}
+
+		track := &fragmentedTrack{muxTrack: &muxTrack{
+			handler: string(hdlr[8:12]),
+			stsd:    stsd[4:],
+			source:  source,
+		}}
+		if tkhd[0] == 1 {
+			track.id = binary.BigEndian.Uint32(tkhd[20:])
+		} else {
+			track.id = binary.BigEndian.Uint32(tkhd[12:])
+		}
+		track.width = binary.BigEndian.Uint32(tkhd[len(tkhd)-8:])
+		track.height = binary.BigEndian.Uint32(tkhd[len(tkhd)-4:])
+
+		var language uint16
+		if mdhd[0] == 1 {
+			if len(mdhd) < 36 {
+				return nil, errors.New("incomplete media header in initialization section")
+			}
+			track.timescale = binary.BigEndian.Uint32(mdhd[20:])
+			language = binary.BigEndian.Uint16(mdhd[32:])
+		} else {
+			track.timescale = binary.BigEndian.Uint32(mdhd[12:])
+			language = binary.BigEndian.Uint16(mdhd[20:])
+		}
+		track.language = unpackLanguage(language)
+		track.mediaTime = -1
+		if elst := findBox(trak, "edts", "elst"); elst != nil {
+			track.mediaTime = firstMediaTime(elst)
+		}
+		track.defaults = defaults[track.id]
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+// firstMediaTime returns the media time of the first non-empty edit, or -1
+func firstMediaTime(elst []byte) int64 {
+	if len(elst) < 8 {
+		return -1
+	}
+	version := elst[0]
+	count := binary.BigEndian.Uint32(elst[4:])
+	entry := elst[8:]
+	for i := uint32(0); i < count; i++ {
+		var mediaTime int64
+		if version == 1 {
+			if len(entry) < 20 {
+				return -1
+			}
+			mediaTime = int64(binary.BigEndian.Uint64(entry[8:]))
+			entry = entry[20:]
+		} else {
+			if len(entry) < 12 {
+				return -1
+			}
+			mediaTime = int64(int32(binary.BigEndian.Uint32(entry[4:])))
+			entry = entry[12:]
+		}
+		if mediaTime >= 0 {
+			return mediaTime
+		}
+	}
+	return -1
+}
+
+// parseFragment adds the samples described by a moof box. Sample data
+// offsets are relative to the start of the moof box
+func parseFragment(moof []byte, moofOffset int64, tracks []*fragmentedTrack) error {
+	for _, traf := range findBoxes(moof, "traf") {
+		tfhd := findBox(traf, "tfhd")
+		if len(tfhd) < 8 {
+			return errors.New("track fragment without header")
+		}
+		tfhdFlags := binary.BigEndian.Uint32(tfhd) & 0xffffff
+		trackID := binary.BigEndian.Uint32(tfhd[4:])
+
+		var track *fragmentedTrack
+		for _, candidate := range tracks {
+			if candidate.id == trackID {
+				track = candidate
+			}
+		}
+		if track == nil {
+			return fmt.Errorf("fragment references unknown track %d", trackID)
+		}
+
+		defaults := track.defaults
+		baseOffset := moofOffset
+		fields := tfhd[8:]
+		readField := func(size int) (uint64, error) {
+			if len(fields) < size {
+				return 0, errors.New("truncated track fragment header")
+			}
+			var value uint64
+			if size == 8 {
+				value = binary.BigEndian.Uint64(fields)
+			} else {
+				value = uint64(binary.BigEndian.Uint32(fields))
+			}
+			fields = fields[size:]
+			return value, nil
+		}
+		if tfhdFlags&0x1 != 0 {
+			value, err := readField(8)
+			if err != nil {
+				return err
+			}
+			baseOffset = int64(value)
+		}
+		if tfhdFlags&0x2 != 0 {
+			if _, err := readField(4); err != nil {
+				return err
+			}
+		}
+		if tfhdFlags&0x8 != 0 {
+			value, err := readField(4)
+			if err != nil {
+				return err
+			}
+			defaults.duration = uint32(value)
+		}
+		if tfhdFlags&0x10 != 0 {
+			value, err := readField(4)
+			if err != nil {
+				return err
+			}
+			defaults.size = uint32(value)
+		}
+		if tfhdFlags&0x20 != 0 {
+			value, err := readField(4)
+			if err != nil {
+				return err
+			}
+			defaults.flags = uint32(value)
+		}
+
+		if tfdt := findBox(traf, "tfdt"); len(tfdt) >= 8 {
+			decodeTime := uint64(binary.BigEndian.Uint32(tfdt[4:]))
+			if tfdt[0] == 1 && len(tfdt) >= 12 {
+				decodeTime = binary.BigEndian.Uint64(tfdt[4:])
+			}
+			if !track.started {
+				track.startDTS = decodeTime
+			}
+		}
+		track.started = true
+
+		dataOffset := baseOffset
+		for _, trun := range findBoxes(traf, "trun") {
+			next, err := track.addRun(trun, baseOffset, dataOffset, defaults)
+			if err != nil {
+				return err
+			}
+			dataOffset = next
+		}
+	}
+	return nil
+}
+
+// addRun adds the samples of a trun box and returns the offset following its
+// data, which is where a following run without data offset starts
+func (t *fragmentedTrack) addRun(trun []byte, baseOffset, dataOffset int64, defaults trackDefaults) (int64, error) {
+	if len(trun) < 8 {
+		return 0, errors.New("truncated track run")
+	}
+	version := trun[0]
+	flags := binary.BigEndian.Uint32(trun) & 0xffffff
+	count := binary.BigEndian.Uint32(trun[4:])
+	fields := trun[8:]
+	next := func() (uint32, error) {
+		if len(fields) < 4 {
+			return 0, errors.New("truncated track run")
+		}
+		value := binary.BigEndian.Uint32(fields)
+		fields = fields[4:]
+		return value, nil
+	}
+
+	if flags&0x1 != 0 {
+		value, err := next()
+		if err != nil {
+			return 0, err
+		}
+		dataOffset = baseOffset + int64(int32(value))
+	}
+	firstFlags, hasFirstFlags := uint32(0), flags&0x4 != 0
+	if hasFirstFlags {
+		value, err := next()
+		if err != nil {
+			return 0, err
+		}
+		firstFlags = value
+	}
+
+	for i := uint32(0); i < count; i++ {
+		sample := muxSample{
+			offset:   dataOffset,
+			duration: defaults.duration,
+			size:     defaults.size,
+		}
+		sampleFlags := defaults.flags
+		if i == 0 && hasFirstFlags {
+			sampleFlags = firstFlags
+		}
+		var err error
+		if flags&0x100 != 0 {
+			if sample.duration, err = next(); err != nil {
+				return 0, err
+			}
+		}
+		if flags&0x200 != 0 {
+			if sample.size, err = next(); err != nil {
+				return 0, err
+			}
+		}
+		if flags&0x400 != 0 {
+			if sampleFlags, err = next(); err != nil {
+				return 0, err
+			}
+		}
+		if flags&0x800 != 0 {
+			value, err := next()
+			if err != nil {
+				return 0, err
+			}
+			if version == 0 {
+				sample.cto = int64(value)
+			} else {
+				sample.cto = int64(int32(value))
+			}
+		}
+		// sample_is_non_sync_sample
+		sample.sync = sampleFlags&0x10000 == 0
+		t.samples = append(t.samples, sample)
+		dataOffset += int64(sample.size)
+	}
+	return dataOffset, nil
+}
+
+// unpackLanguage decodes the packed ISO 639-2 code of an mdhd box
+func unpackLanguage(packed uint16) string {
+	if packed == 0 || packed == 0x7fff {
+		return "und"
+	}
+	return string([]byte{
+		byte(packed>>10&0x1f) + 0x60,
+		byte(packed>>5&0x1f) + 0x60,
+		byte(packed&0x1f) + 0x60,
+	})
+}
+
+// packLanguage encodes an ISO 639-2 code for an mdhd box
+func packLanguage(language string) uint16 {
+	if len(language) != 3 {
+		language = "und"
+	}
+	var packed uint16
+	for i := 0; i < 3; i++ {
+		c := language[i]
+		if c < 'a' || c > 'z' {
+			return packLanguage("und")
+		}
+		packed = packed<<5 | uint16(c-0x60)
+	}
+	return packed
+}
@@ -0,0 +1,682 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	STREAM_TYPE_MPEG1_AUDIO = 0x03
+	STREAM_TYPE_MPEG2_AUDIO = 0x04
+	STREAM_TYPE_HEVC        = 0x24
+	STREAM_TYPE_AC3         = 0x81
+	STREAM_TYPE_EAC3        = 0x87
+
+	tsClockRate  = 90000
+	aacFrameSize = 1024
+)
+
+// aacSampleRates are the sampling frequencies indexed by an ADTS header
+var aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// tsElementaryStream is an H.264 or AAC stream of a transport stream while
+// its PES packets are converted into MP4 samples
+type tsElementaryStream struct {
+	streamType byte
+	pes        []byte
+	track      *muxTrack
+
+	wrap    int64
+	lastDTS int64
+	started bool
+
+	// shift moves the timestamps following a restart right behind the
+	// samples before it
+	shift  int64
+	resync bool
+
+	// H.264, the byte stream of an access unit is kept in unit until it is
+	// complete as PES packets without timestamp continue it
+	decodeTimes []int64
+	sps         []byte
+	pps         []byte
+	unit        []byte
+	unitDTS     int64
+	unitPTS     int64
+
+	// AAC
+	pending    []byte
+	sampleRate uint32
+	nextTime   int64
+}
+
+// tsDemuxer converts the elementary streams of a transport stream into
+// tracks whose sample data is written to a separate file
+type tsDemuxer struct {
+	pmtPIDs map[uint16]bool
+	streams map[uint16]*tsElementaryStream
+	samples *bufio.Writer
+	offset  int64
+}
+
+// demuxTransportStream reads the H.264 and AAC streams of a concatenated
+// MPEG-TS rendition. Access units are converted to length prefixed NAL units
+// and ADTS headers are removed while the samples are written to samples. The
+// timestamps starting at one of the restarts offsets are rebased so they
+// continue the samples before it
+func demuxTransportStream(input io.Reader, samples *os.File, restarts []int64) ([]*muxTrack, error) {
+	demuxer := &tsDemuxer{
+		pmtPIDs: map[uint16]bool{},
+		streams: map[uint16]*tsElementaryStream{},
+		samples: bufio.NewWriterSize(samples, 1<<20),
+	}
+
+	reader := bufio.NewReaderSize(input, 1<<20)
+	packet := make([]byte, TS_PACKET_SIZE)
+	for offset := int64(0); ; offset += TS_PACKET_SIZE {
+		for len(restarts) > 0 && restarts[0] <= offset {
+			if err := demuxer.restart(); err != nil {
+				return nil, err
+			}
+			restarts = restarts[1:]
+		}
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		if err := demuxer.handlePacket(packet); err != nil {
+			return nil, err
+		}
+	}
+
+	tracks := []*muxTrack{}
+	for _, stream := range demuxer.streams {
+		if err := demuxer.complete(stream); err != nil {
+			return nil, err
+		}
+		if stream.track == nil || len(stream.track.samples) == 0 {
+			continue
+		}
+		if stream.streamType == STREAM_TYPE_H264 {
+			if err := stream.finishVideo(); err != nil {
+				return nil, err
+			}
+		}
+		stream.track.source = samples
+		tracks = append(tracks, stream.track)
+	}
+	if err := demuxer.samples.Flush(); err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, errors.New("no H.264 or AAC samples found")
+	}
+
+	// video first, then audio
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return tracks[i].handler == HANDLER_VIDEO && tracks[j].handler != HANDLER_VIDEO
+	})
+	return tracks, nil
+}
+
+// restart completes the PES packets and access units of every stream before
+// the timestamps start over, the next timestamps are rebased on the samples
+// so far
+func (d *tsDemuxer) restart() error {
+	for _, stream := range d.streams {
+		if err := d.complete(stream); err != nil {
+			return err
+		}
+		stream.pending = nil
+		stream.resync = stream.track != nil
+	}
+	return nil
+}
+
+// handlePacket routes a packet to the PAT, a PMT or the PES packet of its stream
+func (d *tsDemuxer) handlePacket(packet []byte) error {
+	info, err := parseTSPacket(packet)
+	if err != nil {
+		return err
+	}
+	if !info.hasPayload {
+		return nil
+	}
+	payload := packet[info.payloadOffset:]
+
+	switch {
+	case info.pid == 0:
+		if info.payloadStart {
+			for _, pid := range parsePAT(payload) {
+				d.pmtPIDs[pid] = true
+			}
+		}
+		return nil
+	case d.pmtPIDs[info.pid]:
+		if info.payloadStart {
+			return d.parsePMT(payload)
+		}
+		return nil
+	}
+
+	stream := d.streams[info.pid]
+	if stream == nil {
+		return nil
+	}
+	if info.payloadStart {
+		if err := d.flush(stream); err != nil {
+			return err
+		}
+		stream.pes = append(stream.pes[:0], payload...)
+	} else if len(stream.pes) > 0 {
+		stream.pes = append(stream.pes, payload...)
+	}
+	return nil
+}
+
+// complete converts the PES packet assembled for a stream and writes the
+// access unit that is still open
+func (d *tsDemuxer) complete(stream *tsElementaryStream) error {
+	if err := d.flush(stream); err != nil {
+		return err
+	}
+	return d.writeAccessUnit(stream)
+}
+
+// parsePMT registers the elementary streams the muxer can convert
+func (d *tsDemuxer) parsePMT(payload []byte) error {
+	section := psiSection(payload)
+	if len(section) < 16 {
+		return nil
+	}
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	end := 3 + length - 4
+	if end > len(section) {
+		return errors.New("PMT spanning several packets is not supported")
+	}
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+
+	for i := 12 + programInfoLength; i+5 <= end; {
+		streamType := section[i]
+		pid := uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2])
+		infoLength := int(section[i+3]&0x0f)<<8 | int(section[i+4])
+		i += 5 + infoLength
+
+		switch streamType {
+		case STREAM_TYPE_H264, STREAM_TYPE_AAC:
+			if d.streams[pid] == nil {
+				d.streams[pid] = &tsElementaryStream{streamType: streamType}
+			}
+		case STREAM_TYPE_HEVC, STREAM_TYPE_MPEG1_AUDIO, STREAM_TYPE_MPEG2_AUDIO, STREAM_TYPE_AC3, STREAM_TYPE_EAC3:
+			return fmt.Errorf("MPEG-TS stream type 0x%02x is not supported by the native muxer, use --muxer %s", streamType, MUXER_FFMPEG)
+		}
+	}
+	return nil
+}
+
+// flush converts the PES packet assembled for a stream into samples
+func (d *tsDemuxer) flush(stream *tsElementaryStream) error {
+	pes := stream.pes
+	stream.pes = stream.pes[:0]
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return nil
+	}
+
+	if length := int(binary.BigEndian.Uint16(pes[4:])); length > 0 && 6+length < len(pes) {
+		pes = pes[:6+length]
+	}
+	headerEnd := 9 + int(pes[8])
+	if headerEnd > len(pes) {
+		return errors.New("truncated PES header")
+	}
+
+	var pts, dts int64
+	hasPTS := false
+	if timestamps := pes[7] >> 6; timestamps&0x2 != 0 && headerEnd >= 14 {
+		hasPTS = true
+		pts = parseTimestamp(pes[9:])
+		dts = pts
+		if timestamps&0x1 != 0 && headerEnd >= 19 {
+			dts = parseTimestamp(pes[14:])
+		}
+		dts, pts = stream.unwrap(dts, pts)
+		if stream.resync {
+			stream.shift = stream.nextDecodeTime() - dts
+			stream.resync = false
+		}
+		dts += stream.shift
+		pts += stream.shift
+	}
+
+	payload := pes[headerEnd:]
+	if stream.streamType == STREAM_TYPE_H264 {
+		return d.addAccessUnit(stream, payload, hasPTS, dts, pts)
+	}
+	return d.addAudioFrames(stream, payload, hasPTS, pts)
+}
+
+// nextDecodeTime returns the 90kHz decode time following the last sample of
+// the stream, the duration of the last video sample is assumed to be the one
+// before it
+func (s *tsElementaryStream) nextDecodeTime() int64 {
+	if s.streamType != STREAM_TYPE_H264 {
+		samples := int64(len(s.track.samples))
+		return int64(s.track.startDTS)*tsClockRate/int64(s.sampleRate) + samples*aacFrameSize*tsClockRate/int64(s.sampleRate)
+	}
+	last := len(s.decodeTimes) - 1
+	duration := int64(tsClockRate / 30)
+	if last > 0 && s.decodeTimes[last] > s.decodeTimes[last-1] {
+		duration = s.decodeTimes[last] - s.decodeTimes[last-1]
+	}
+	return s.decodeTimes[last] + duration
+}
+
+// parseTimestamp decodes a 33 bit PTS or DTS field
+func parseTimestamp(field []byte) int64 {
+	return int64(field[0]>>1&0x07)<<30 |
+		int64(field[1])<<22 |
+		int64(field[2]>>1)<<15 |
+		int64(field[3])<<7 |
+		int64(field[4]>>1)
+}
+
+// unwrap extends the 33 bit timestamps so they keep increasing when the
+// 90kHz clock wraps around
+func (s *tsElementaryStream) unwrap(dts, pts int64) (int64, int64) {
+	dts += s.wrap
+	if s.started && dts < s.lastDTS-(1<<32) {
+		s.wrap += 1 << 33
+		dts += 1 << 33
+	}
+	s.lastDTS = dts
+	s.started = true
+
+	pts += dts - dts%(1<<33)
+	if pts < dts-(1<<32) {
+		pts += 1 << 33
+	}
+	return dts, pts
+}
+
+// write appends sample data to the samples file and returns its offset
+func (d *tsDemuxer) write(parts ...[]byte) (int64, uint32, error) {
+	offset := d.offset
+	var size uint32
+	for _, part := range parts {
+		n, err := d.samples.Write(part)
+		if err != nil {
+			return 0, 0, err
+		}
+		size += uint32(n)
+	}
+	d.offset += int64(size)
+	return offset, size, nil
+}
+
+// addAccessUnit collects the Annex B byte stream of an H.264 access unit. A
+// PES packet with a timestamp starts a new access unit, one without
+// continues the open one, possibly in the middle of a NAL unit
+func (d *tsDemuxer) addAccessUnit(stream *tsElementaryStream, payload []byte, hasPTS bool, dts, pts int64) error {
+	if hasPTS || stream.unit == nil {
+		if err := d.writeAccessUnit(stream); err != nil {
+			return err
+		}
+		stream.unit = []byte{}
+		stream.unitDTS, stream.unitPTS = dts, pts
+	}
+	stream.unit = append(stream.unit, payload...)
+	return nil
+}
+
+// writeAccessUnit converts the open access unit of a stream into length
+// prefixed NAL units and writes it to the samples file in one piece, so the
+// data of other streams never ends up inside a sample
+func (d *tsDemuxer) writeAccessUnit(stream *tsElementaryStream) error {
+	data := stream.unit
+	stream.unit = nil
+
+	sample := []byte{}
+	sync := false
+	for _, unit := range splitAnnexB(data) {
+		nal := unit.nal
+		for len(nal) > 0 && nal[len(nal)-1] == 0 {
+			nal = nal[:len(nal)-1]
+		}
+		if len(nal) == 0 || unit.prefix == nil {
+			continue
+		}
+		switch nal[0] & 0x1f {
+		case 9: // access unit delimiter
+			continue
+		case 7:
+			if stream.sps == nil {
+				stream.sps = append([]byte{}, nal...)
+			}
+		case 8:
+			if stream.pps == nil {
+				stream.pps = append([]byte{}, nal...)
+			}
+		case 5:
+			sync = true
+		}
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(nal)))
+		sample = append(sample, nal...)
+	}
+	if len(sample) == 0 {
+		return nil
+	}
+
+	offset, size, err := d.write(sample)
+	if err != nil {
+		return err
+	}
+	if stream.track == nil {
+		stream.track = &muxTrack{handler: HANDLER_VIDEO, timescale: tsClockRate, language: "und", mediaTime: -1}
+	}
+	track := stream.track
+	if len(track.samples) == 0 {
+		track.startDTS = uint64(stream.unitDTS)
+	}
+	track.samples = append(track.samples, muxSample{
+		offset: offset,
+		size:   size,
+		cto:    stream.unitPTS - stream.unitDTS,
+		sync:   sync,
+	})
+	stream.decodeTimes = append(stream.decodeTimes, stream.unitDTS)
+	return nil
+}
+
+// finishVideo derives the sample durations from the decode times and builds
+// the avc1 sample description from the first SPS and PPS
+func (s *tsElementaryStream) finishVideo() error {
+	if s.sps == nil || s.pps == nil {
+		return errors.New("H.264 stream without SPS or PPS")
+	}
+	width, height, err := parseSPSDimensions(s.sps)
+	if err != nil {
+		return err
+	}
+
+	samples := s.track.samples
+	previous := uint32(tsClockRate / 30)
+	for idx := range samples {
+		if idx+1 < len(samples) && s.decodeTimes[idx+1] > s.decodeTimes[idx] {
+			previous = uint32(s.decodeTimes[idx+1] - s.decodeTimes[idx])
+		}
+		samples[idx].duration = previous
+	}
+
+	s.track.width = width << 16
+	s.track.height = height << 16
+	s.track.stsd = append(binary.BigEndian.AppendUint32(nil, 1), avcSampleEntry(s.sps, s.pps, width, height)...)
+	return nil
+}
+
+// addAudioFrames splits the ADTS frames of a PES packet into AAC samples.
+// Frames continue from the previous packet when it ended mid-frame
+func (d *tsDemuxer) addAudioFrames(stream *tsElementaryStream, payload []byte, hasPTS bool, pts int64) error {
+	data := append(stream.pending, payload...)
+	stream.pending = nil
+
+	for len(data) >= 7 {
+		if data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+			return errors.New("lost ADTS sync")
+		}
+		frameLength := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+		headerLength := 7
+		if data[1]&0x01 == 0 {
+			headerLength = 9
+		}
+		if frameLength < headerLength {
+			return errors.New("invalid ADTS frame length")
+		}
+		if frameLength > len(data) {
+			break
+		}
+
+		if stream.track == nil {
+			objectType := data[2]>>6 + 1
+			frequencyIndex := data[2] >> 2 & 0x0f
+			channels := (data[2]&0x01)<<2 | data[3]>>6
+			if int(frequencyIndex) >= len(aacSampleRates) {
+				return errors.New("invalid ADTS sampling frequency")
+			}
+			stream.sampleRate = aacSampleRates[frequencyIndex]
+			stream.track = &muxTrack{
+				handler:   HANDLER_AUDIO,
+				timescale: stream.sampleRate,
+				language:  "und",
+				mediaTime: -1,
+				stsd:      append(binary.BigEndian.AppendUint32(nil, 1), aacSampleEntry(objectType, frequencyIndex, channels, stream.sampleRate)...),
+			}
+			if hasPTS {
+				stream.track.startDTS = uint64(pts * int64(stream.sampleRate) / tsClockRate)
+			}
+		}
+
+		offset, size, err := d.write(data[headerLength:frameLength])
+		if err != nil {
+			return err
+		}
+		stream.track.samples = append(stream.track.samples, muxSample{
+			offset:   offset,
+			size:     size,
+			duration: aacFrameSize,
+			sync:     true,
+		})
+		data = data[frameLength:]
+	}
+	stream.pending = append([]byte{}, data...)
+	return nil
+}
+
+// avcSampleEntry builds an avc1 sample entry with its avcC configuration
+func avcSampleEntry(sps, pps []byte, width, height uint32) []byte {
+	avcC := []byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(sps)))
+	avcC = append(avcC, sps...)
+	avcC = append(avcC, 1)
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(pps)))
+	avcC = append(avcC, pps...)
+
+	entry := make([]byte, 6)                        // reserved
+	entry = binary.BigEndian.AppendUint16(entry, 1) // data reference index
+	entry = append(entry, make([]byte, 16)...)      // pre-defined and reserved
+	entry = binary.BigEndian.AppendUint16(entry, uint16(width))
+	entry = binary.BigEndian.AppendUint16(entry, uint16(height))
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000) // 72 dpi
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000)
+	entry = binary.BigEndian.AppendUint32(entry, 0)
+	entry = binary.BigEndian.AppendUint16(entry, 1) // frame count
+	entry = append(entry, make([]byte, 32)...)      // compressor name
+	entry = binary.BigEndian.AppendUint16(entry, 0x0018)
+	entry = binary.BigEndian.AppendUint16(entry, 0xffff)
+	return mp4Box("avc1", entry, mp4Box("avcC", avcC))
+}
+
+// aacSampleEntry builds an mp4a sample entry with the AudioSpecificConfig
+// derived from an ADTS header
+func aacSampleEntry(objectType, frequencyIndex, channels byte, sampleRate uint32) []byte {
+	config := []byte{objectType<<3 | frequencyIndex>>1, frequencyIndex<<7 | channels<<3}
+
+	decoderSpecificInfo := append([]byte{0x05, byte(len(config))}, config...)
+	decoderConfig := []byte{0x40, 0x15, 0, 0, 0}                    // AAC, audio stream, buffer size
+	decoderConfig = binary.BigEndian.AppendUint32(decoderConfig, 0) // max bitrate
+	decoderConfig = binary.BigEndian.AppendUint32(decoderConfig, 0) // average bitrate
+	decoderConfig = append(decoderConfig, decoderSpecificInfo...)
+	esDescriptor := []byte{0, 0, 0} // ES ID and flags
+	esDescriptor = append(esDescriptor, 0x04, byte(len(decoderConfig)))
+	esDescriptor = append(esDescriptor, decoderConfig...)
+	esDescriptor = append(esDescriptor, 0x06, 0x01, 0x02) // SL config
+	esds := mp4FullBox("esds", 0, 0, append([]byte{0x03, byte(len(esDescriptor))}, esDescriptor...))
+
+	rate := sampleRate
+	if rate > 0xffff {
+		rate = 0
+	}
+	entry := make([]byte, 6)                        // reserved
+	entry = binary.BigEndian.AppendUint16(entry, 1) // data reference index
+	entry = append(entry, make([]byte, 8)...)       // reserved
+	entry = binary.BigEndian.AppendUint16(entry, uint16(channels))
+	entry = binary.BigEndian.AppendUint16(entry, 16) // sample size
+	entry = append(entry, make([]byte, 4)...)
+	entry = binary.BigEndian.AppendUint32(entry, rate<<16)
+	return mp4Box("mp4a", entry, esds)
+}
+
+// bitReader reads the exp-Golomb coded fields of an H.264 SPS
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errors.New("truncated SPS")
+	}
+	value := uint32(r.data[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return value, nil
+}
+
+func (r *bitReader) bits(n int) (uint32, error) {
+	var value uint32
+	for i := 0; i < n; i++ {
+		bit, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<1 | bit
+	}
+	return value, nil
+}
+
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		bit, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("invalid exp-Golomb code in SPS")
+		}
+	}
+	value, err := r.bits(zeros)
+	return (1 << zeros) - 1 + value, err
+}
+
+func (r *bitReader) se() (int32, error) {
+	value, err := r.ue()
+	if value%2 == 1 {
+		return int32((value + 1) / 2), err
+	}
+	return -int32(value / 2), err
+}
+
+// parseSPSDimensions returns the cropped picture size coded in an H.264 SPS
+func parseSPSDimensions(sps []byte) (uint32, uint32, error) {
+	r := &bitReader{data: removeEmulationPrevention(sps[1:])}
+	profile, err := r.bits(8)
+	if err != nil {
+		return 0, 0, err
+	}
+	r.bits(16) // constraint flags and level
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat, _ = r.ue()
+		if chromaFormat == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		if present, _ := r.bit(); present == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if listPresent, _ := r.bit(); listPresent == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size && next != 0; j++ {
+					delta, _ := r.se()
+					next = (last + delta + 256) % 256
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	pocType, _ := r.ue()
+	switch pocType {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		cycle, _ := r.ue()
+		for i := uint32(0); i < cycle; i++ {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	widthInMbs, _ := r.ue()
+	heightInMapUnits, _ := r.ue()
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	width := (widthInMbs + 1) * 16
+	height := (2 - frameMbsOnly) * (heightInMapUnits + 1) * 16
+	if cropping, _ := r.bit(); cropping == 1 {
+		left, _ := r.ue()
+		right, _ := r.ue()
+		top, _ := r.ue()
+		bottom, err := r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+		cropX, cropY := uint32(1), 2-frameMbsOnly
+		switch chromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+		width -= cropX * (left + right)
+		height -= cropY * (top + bottom)
+	}
+	return width, height, nil
+}
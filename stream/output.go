@@ -0,0 +1,126 @@
+package stream
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	// DEFAULT_OUTPUT_TEMPLATE keeps a single download in <resolution>/
+	DEFAULT_OUTPUT_TEMPLATE = "{resolution}/{name}.{ext}"
+	// VIDEO_OUTPUT_TEMPLATE keeps the renditions of each video apart when
+	// several renditions or videos are downloaded in one run
+	VIDEO_OUTPUT_TEMPLATE = "{uid}/{resolution}/{name}.{ext}"
+)
+
+var templatePlaceholder = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// directoryPlaceholders can be used anywhere in an output template, the
+// others only in the file name
+var directoryPlaceholders = map[string]bool{
+	"uid":        true,
+	"resolution": true,
+	"bandwidth":  true,
+	"date":       true,
+}
+
+// renditionOutput is where the files of a rendition are written. The
+// segments and journals are kept in directory next to the final files
+type renditionOutput struct {
+	resolution string
+	directory  string
+	file       string
+}
+
+// path returns the path of a final file such as merged.mp4 or
+// subtitles.en.vtt
+func (o renditionOutput) path(name, ext string) string {
+	return filepath.Join(o.directory, strings.NewReplacer("{name}", name, "{ext}", ext).Replace(o.file))
+}
+
+// ValidateOutputTemplate checks that template only uses known placeholders
+// and that {name} and {ext} are limited to the file name. Templates of a batch
+// need {uid} in the directory so the videos don't share files
+func ValidateOutputTemplate(template string, batch bool) error {
+	if template == "" {
+		return nil
+	}
+	if filepath.IsAbs(template) {
+		return fmt.Errorf("output template %s must be relative, use --output for the output root", template)
+	}
+	directory, file := filepath.Split(filepath.FromSlash(template))
+	for _, match := range templatePlaceholder.FindAllStringSubmatch(template, -1) {
+		if !directoryPlaceholders[match[1]] && match[1] != "name" && match[1] != "ext" {
+			return fmt.Errorf("unknown placeholder %s in output template, use {uid}, {resolution}, {bandwidth}, {date}, {name} and {ext}", match[0])
+		}
+	}
+	for _, match := range templatePlaceholder.FindAllStringSubmatch(directory, -1) {
+		if !directoryPlaceholders[match[1]] {
+			return fmt.Errorf("%s can only be used in the file name of the output template", match[0])
+		}
+	}
+	if !strings.Contains(file, "{name}") {
+		return fmt.Errorf("the file name of output template %s needs {name} to tell the files of a rendition apart", template)
+	}
+	if batch && !strings.Contains(directory, "{uid}") {
+		return fmt.Errorf("the directory of output template %s needs {uid} to give every video of the batch its own files", template)
+	}
+	return nil
+}
+
+// renditionOutput expands the output template for a rendition of the video
+// and claims the directory below the output root in claimed. resolution names
+// the rendition and variant, when set, provides its bandwidth
+func (v *Video) renditionOutput(opts DownloadOptions, resolution string, variant *m3u8.Variant, claimed map[string]bool) renditionOutput {
+	template := opts.Template
+	if template == "" {
+		template = DEFAULT_OUTPUT_TEMPLATE
+	}
+
+	name := safeName(resolution)
+	if name == "" {
+		name = "audio_only"
+	}
+	bandwidth := ""
+	if variant != nil && variant.Bandwidth > 0 {
+		bandwidth = fmt.Sprintf("%dk", variant.Bandwidth/1000)
+	}
+	replacer := strings.NewReplacer(
+		"{uid}", v.outputRoot(),
+		"{resolution}", name,
+		"{bandwidth}", bandwidth,
+		"{date}", time.Now().Format("2006-01-02"),
+	)
+
+	directory, file := filepath.Split(filepath.FromSlash(template))
+	directory = filepath.Join(opts.OutputPath, replacer.Replace(directory))
+	if directory == "" {
+		directory = "."
+	}
+	return renditionOutput{
+		resolution: resolution,
+		directory:  claimDirectory(claimed, directory),
+		file:       replacer.Replace(file),
+	}
+}
+
+// claimDirectory reserves directory for a rendition of a Download or Mirror
+// call. Renditions expanding to the same directory, such as variants of one
+// resolution with another codec, get a numbered one. A nil claimed is used by
+// calls writing a single rendition
+func claimDirectory(claimed map[string]bool, directory string) string {
+	if claimed == nil {
+		return directory
+	}
+	claim := directory
+	for idx := 2; claimed[claim]; idx++ {
+		claim = fmt.Sprintf("%s_%d", directory, idx)
+	}
+	claimed[claim] = true
+	return claim
+}
@@ -0,0 +1,245 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// transferProgress counts the bytes received by the concurrent segment
+// downloads of every rendition of a video. The total is estimated from the
+// Content-Length of the segments started so far and the number of segments
+// still to go, and sent as an EVENT_PROGRESS every PROGRESS_INTERVAL
+type transferProgress struct {
+	mu         sync.Mutex
+	planned    map[string]int // segments per rendition, keyed by journal path
+	stage      string
+	started    int   // segments whose size is known or estimated
+	done       int   // segments finished, including those already on disk
+	knownBytes int64 // sizes of the started segments
+	received   int64 // bytes of finished and running segments
+	downloaded int64 // bytes received over the network by this run
+	retries    int
+	start      time.Time
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// segmentProgress follows the attempts of one segment download
+type segmentProgress struct {
+	transfer *transferProgress
+	attempts int
+	expected int64 // Content-Length of the running attempt, -1 when unknown
+	received int64
+}
+
+// beginTransfer starts sending the progress of the segment downloads of the
+// video and returns the function stopping it. Nested calls share the
+// progress of the outermost one, so it covers every rendition downloaded by
+// it
+func (v *Video) beginTransfer() func() {
+	if v.transfer != nil {
+		return func() {}
+	}
+	transfer := &transferProgress{
+		planned: make(map[string]int),
+		start:   time.Now(),
+		stop:    make(chan struct{}),
+	}
+	v.transfer = transfer
+
+	transfer.stopped.Add(1)
+	go func() {
+		defer transfer.stopped.Done()
+		ticker := time.NewTicker(PROGRESS_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-transfer.stop:
+				return
+			case <-ticker.C:
+				v.emit(Event{Type: EVENT_PROGRESS, Progress: transfer.snapshot()})
+			}
+		}
+	}()
+
+	return func() {
+		close(transfer.stop)
+		transfer.stopped.Wait()
+		v.transfer = nil
+		if progress := transfer.snapshot(); progress.Done > 0 {
+			v.emit(Event{Type: EVENT_TRANSFER_DONE, Progress: progress})
+		}
+	}
+}
+
+// planTransfer counts the segments of a rendition covered by clip before any
+// rendition is downloaded, so the progress estimates the total of every
+// rendition from the start
+func (v *Video) planTransfer(ctx context.Context, output renditionOutput, rendition, manifestURL string, clip Clip) error {
+	playlist, err := v.fetchMediaPlaylist(ctx, manifestURL)
+	if err != nil {
+		return err
+	}
+	segments := 0
+	if playlist.Map != nil {
+		segments++
+	}
+	var segmentStart float64
+	for _, segment := range playlist.Segments {
+		if segment == nil {
+			continue
+		}
+		if !clip.IsSet() || clip.covers(segmentStart, segment.Duration) {
+			segments++
+		}
+		segmentStart += segment.Duration
+	}
+	v.transfer.plan(journalPath(output.directory, rendition), segments)
+	return nil
+}
+
+// plan sets the number of segments of a rendition, key tells renditions apart
+func (t *transferProgress) plan(key string, segments int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.planned[key] = segments
+}
+
+// replan adds segments downloaded again to a rendition
+func (t *transferProgress) replan(key string, segments int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.planned[key] += segments
+	t.retries += segments
+}
+
+// describe names the rendition being downloaded
+func (t *transferProgress) describe(stage string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stage = stage
+}
+
+// resume counts a segment found on disk from an earlier run
+func (t *transferProgress) resume(size int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started++
+	t.done++
+	t.knownBytes += size
+	t.received += size
+}
+
+// segment follows a new segment download
+func (t *transferProgress) segment() *segmentProgress {
+	if t == nil {
+		return nil
+	}
+	return &segmentProgress{transfer: t, expected: -1}
+}
+
+// attempt is called before every attempt, the bytes of a failed attempt are
+// taken back
+func (s *segmentProgress) attempt() {
+	if s == nil {
+		return
+	}
+	t := s.transfer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.attempts++
+	if s.attempts > 1 {
+		t.retries++
+	}
+	t.received -= s.received
+	if s.expected >= 0 {
+		t.knownBytes -= s.expected
+		t.started--
+	}
+	s.received, s.expected = 0, -1
+}
+
+// begin records the Content-Length of the response, -1 when the server
+// doesn't announce it
+func (s *segmentProgress) begin(contentLength int64) {
+	if s == nil || contentLength < 0 {
+		return
+	}
+	t := s.transfer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.expected = contentLength
+	t.knownBytes += contentLength
+	t.started++
+}
+
+// read counts bytes of the response body
+func (s *segmentProgress) read(n int) {
+	if s == nil || n == 0 {
+		return
+	}
+	t := s.transfer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.received += int64(n)
+	t.received += int64(n)
+	t.downloaded += int64(n)
+}
+
+// finish marks the segment as done, its size is now known when the server
+// didn't announce it
+func (s *segmentProgress) finish() {
+	if s == nil {
+		return
+	}
+	t := s.transfer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s.expected < 0 {
+		s.expected = s.received
+		t.knownBytes += s.received
+		t.started++
+	}
+	t.done++
+}
+
+// snapshot returns the current progress, with the estimated total when the
+// size of some segments is still unknown
+func (t *transferProgress) snapshot() *Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	planned := 0
+	for _, segments := range t.planned {
+		planned += segments
+	}
+	total := t.knownBytes
+	if t.started > 0 && planned > t.started {
+		total += int64(float64(t.knownBytes) / float64(t.started) * float64(planned-t.started))
+	}
+	return &Progress{
+		Stage:       t.stage,
+		Bytes:       t.received,
+		Transferred: t.downloaded,
+		Total:       total,
+		Estimated:   planned > t.started,
+		Done:        t.done,
+		Planned:     planned,
+		Retries:     t.retries,
+		Elapsed:     time.Since(t.start),
+	}
+}
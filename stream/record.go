@@ -0,0 +1,341 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// liveRecorder follows a single live media playlist and downloads every new
+// segment by its media sequence number
+type liveRecorder struct {
+	video       *Video
+	manifestURL string
+	output      renditionOutput
+	rendition   string
+	media       *m3u8.Alternative
+	maxDuration time.Duration
+
+	nextSeq      uint64
+	started      bool
+	currentKey   *m3u8.Key
+	currentMap   string
+	initCount    int
+	planned      int // segments counted by the progress
+	recorded     float64
+	segmentPaths []string
+	// restarts are the indexes in segmentPaths where the timestamps start
+	// over, after a discontinuity or segments that expired unrecorded
+	restarts []int
+}
+
+// Record follows the live playlist of a Stream Live input until the stream
+// ends, the duration limit is reached or ctx is done and finalises the
+// segments recorded so far into an mp4. A maxDuration of 0 records until
+// the stream ends. The directory holding the recording is returned
+func (v *Video) Record(ctx context.Context, opts DownloadOptions, maxDuration time.Duration) (string, error) {
+	defer v.useEvents(opts.OnEvent)()
+	chosenManifest, chosenVariant, err := v.selectManifest(opts.Resolution)
+	if err != nil {
+		return "", fmt.Errorf("there was a problem selecting a download option: %w", err)
+	}
+
+	audioRenditions, err := opts.Audio.selectTracks(v.alternativeRenditions("AUDIO", chosenVariant))
+	if err != nil {
+		return "", fmt.Errorf("there was a problem selecting the audio tracks: %w", err)
+	}
+
+	output := v.renditionOutput(opts, chosenVariant.Resolution, chosenVariant, nil)
+	// recorded segments are named by their media sequence number, which
+	// starts over with every stream, so a new recording would overwrite them
+	if entries, err := os.ReadDir(filepath.Join(output.directory, "segments")); err == nil && len(entries) > 0 {
+		return "", fmt.Errorf("%s already holds a recording, record into another directory with --output or --output-template", output.directory)
+	}
+	recorders := []*liveRecorder{{
+		video:       v,
+		manifestURL: chosenManifest,
+		output:      output,
+		rendition:   RENDITION_VIDEO,
+		maxDuration: maxDuration,
+	}}
+	for _, rendition := range renditionNames(RENDITION_AUDIO, audioRenditions) {
+		audioManifest, err := resolveURL(v.MasterManifestURL, rendition.media.URI)
+		if err != nil {
+			return "", fmt.Errorf("there was a problem resolving the audio manifest: %w", err)
+		}
+		recorders = append(recorders, &liveRecorder{
+			video:       v,
+			manifestURL: v.signedURL(audioManifest),
+			output:      output,
+			rendition:   rendition.name,
+			media:       rendition.media,
+			maxDuration: maxDuration,
+		})
+	}
+
+	v.printf("🔴 Recording [%s]\n", chosenVariant.Resolution)
+	stopTransfer := v.beginTransfer()
+	v.transfer.describe(fmt.Sprintf("recording [%s]", chosenVariant.Resolution))
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(recorders))
+	for _, recorder := range recorders {
+		wg.Add(1)
+		go func(recorder *liveRecorder) {
+			defer wg.Done()
+			if err := recorder.record(ctx); err != nil {
+				errChan <- err
+			}
+		}(recorder)
+	}
+	wg.Wait()
+	stopTransfer()
+	close(errChan)
+	for err := range errChan {
+		v.printf("⚠️ WARNING: recording stopped early: %v\n", err)
+	}
+
+	if len(recorders[0].segmentPaths) == 0 {
+		return "", ErrNothingRecorded
+	}
+	var video mediaTrack
+	var audioTracks []mediaTrack
+	for _, recorder := range recorders {
+		if len(recorder.segmentPaths) == 0 {
+			continue
+		}
+		restarts, err := segmentOffsets(recorder.segmentPaths, recorder.restarts)
+		if err != nil {
+			return "", err
+		}
+		storedPath, err := v.concatenateTSFiles(recorder.segmentPaths, output, recorder.rendition)
+		if err != nil {
+			return "", fmt.Errorf("there was a problem concatenating the segments: %w", err)
+		}
+		if recorder.media == nil {
+			video = mediaTrack{Path: storedPath, restarts: restarts}
+			continue
+		}
+		audioTracks = append(audioTracks, mediaTrack{
+			Language: recorder.media.Language,
+			Name:     recorder.media.Name,
+			Path:     storedPath,
+			restarts: restarts,
+		})
+	}
+
+	// merge potential audio and video files together, MPEG-TS video is
+	// remuxed into MP4 even on its own. ctx is done when the recording was
+	// stopped, so the merge runs without it
+	if len(audioTracks) > 0 || isTransportStream(video.Path) {
+		if len(audioTracks) > 0 {
+			v.printf("🌱 audio and video are being merged...")
+		} else {
+			v.printf("🌱 video is being remuxed into MP4...")
+		}
+		if err := v.mergeMP4FilesInDir(context.Background(), output.path("merged", "mp4"), video, audioTracks, nil, Clip{}); err != nil {
+			return "", fmt.Errorf("there was a problem merging the audio and video files: %w", err)
+		}
+	}
+	return output.directory, nil
+}
+
+// record polls the media playlist on the target duration cadence until the
+// playlist is closed, the duration limit is reached or ctx is done
+func (r *liveRecorder) record(ctx context.Context) error {
+	for {
+		playlist, initKeys, err := r.fetchPlaylist(ctx)
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		newSegments, err := r.downloadNewSegments(ctx, playlist, initKeys)
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if playlist.Closed {
+			r.video.printf("🏁 %s playlist ended after %d segments\n", r.rendition, len(r.segmentPaths))
+			return nil
+		}
+		if r.limitReached() {
+			r.video.printf("⏱ %s reached the duration limit of %s\n", r.rendition, r.maxDuration)
+			return nil
+		}
+
+		// RFC 8216 6.3.4: reload after the target duration, or half of it
+		// when the playlist didn't change
+		wait := time.Duration(playlist.TargetDuration * float64(time.Second))
+		if newSegments == 0 {
+			wait /= 2
+		}
+		if wait <= 0 {
+			wait = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// fetchPlaylist downloads and decodes the media playlist along with the key
+// of every initialization section
+func (r *liveRecorder) fetchPlaylist(ctx context.Context) (*m3u8.MediaPlaylist, []*m3u8.Key, error) {
+	body, err := r.video.fetchURL(ctx, r.manifestURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	playlist, err := decodeMediaPlaylist(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return playlist, mapKeys(body), nil
+}
+
+// downloadNewSegments downloads the segments with a media sequence number
+// that wasn't recorded yet and returns how many were added. initKeys are the
+// keys of the initialization sections in playlist order
+func (r *liveRecorder) downloadNewSegments(ctx context.Context, playlist *m3u8.MediaPlaylist, initKeys []*m3u8.Key) (int, error) {
+	// the timestamps jump over segments that expired before they were
+	// recorded, the next segment restarts the timeline
+	restart := false
+	if r.started && playlist.SeqNo > r.nextSeq {
+		r.video.printf("⚠️ WARNING: %s segments %d-%d expired before they could be recorded\n", r.rendition, r.nextSeq, playlist.SeqNo-1)
+		restart = true
+	}
+
+	segmentURLs := []string{}
+	batchPaths := []string{}
+	batchKeys := []*segmentEncryption{}
+	currentMap := playlist.Map
+	mapIndex := -1
+	for _, segment := range playlist.Segments {
+		if segment == nil {
+			continue
+		}
+		if segment.Map != nil {
+			currentMap = segment.Map
+			mapIndex++
+		}
+		if segment.Key != nil {
+			r.currentKey = segment.Key
+		}
+		if r.started && segment.SeqId < r.nextSeq {
+			continue
+		}
+		if r.limitReached() {
+			break
+		}
+
+		if segment.Discontinuity && r.started {
+			r.video.printf("✂️ %s discontinuity before segment %d\n", r.rendition, segment.SeqId)
+			restart = true
+		}
+		if restart {
+			r.restarts = append(r.restarts, len(r.segmentPaths)+len(batchPaths))
+			restart = false
+		}
+
+		// a new initialization section is recorded in front of the segments using it
+		if currentMap != nil && currentMap.URI != r.currentMap {
+			initURL, err := resolveURL(r.manifestURL, currentMap.URI)
+			if err != nil {
+				return 0, err
+			}
+			initName, err := getSegmentName(initURL, "init")
+			if err != nil {
+				return 0, err
+			}
+			if r.initCount > 0 {
+				initName = fmt.Sprintf("%d_%s", r.initCount, initName)
+			}
+			var initKey *m3u8.Key
+			if mapIndex >= 0 && mapIndex < len(initKeys) {
+				initKey = initKeys[mapIndex]
+			}
+			encryption, err := r.video.segmentEncryption(ctx, initKey, r.manifestURL, segment.SeqId)
+			if err != nil {
+				return 0, err
+			}
+			r.initCount++
+			r.currentMap = currentMap.URI
+			segmentURLs = append(segmentURLs, r.video.signedURL(initURL))
+			batchPaths = append(batchPaths, r.localPath(initName))
+			batchKeys = append(batchKeys, encryption)
+		}
+
+		segmentURL, err := resolveURL(r.manifestURL, segment.URI)
+		if err != nil {
+			return 0, err
+		}
+		segmentName, err := getSegmentName(segmentURL, fmt.Sprintf("seg_%d", segment.SeqId))
+		if err != nil {
+			return 0, err
+		}
+		encryption, err := r.video.segmentEncryption(ctx, r.currentKey, r.manifestURL, segment.SeqId)
+		if err != nil {
+			return 0, err
+		}
+		segmentURLs = append(segmentURLs, r.video.signedURL(segmentURL))
+		batchPaths = append(batchPaths, r.localPath(segmentName))
+		batchKeys = append(batchKeys, encryption)
+
+		r.recorded += segment.Duration
+		r.nextSeq = segment.SeqId + 1
+		r.started = true
+	}
+
+	// live segments expire, so they are recorded without a journal to
+	// resume from
+	r.planned += len(batchPaths)
+	r.video.transfer.plan(journalPath(r.output.directory, r.rendition), r.planned)
+	if err := r.video.fetchSegments(ctx, segmentIndexes(len(segmentURLs)), segmentURLs, batchPaths, batchKeys, nil, r.video.transfer); err != nil {
+		return 0, err
+	}
+	r.segmentPaths = append(r.segmentPaths, batchPaths...)
+	return len(batchPaths), nil
+}
+
+// segmentOffsets returns the offsets the segments at indexes start at once
+// the segments are concatenated
+func segmentOffsets(segmentPaths []string, indexes []int) ([]int64, error) {
+	offsets := []int64{}
+	var offset int64
+	for idx, segmentPath := range segmentPaths {
+		if len(offsets) == len(indexes) {
+			break
+		}
+		for len(offsets) < len(indexes) && indexes[len(offsets)] == idx {
+			offsets = append(offsets, offset)
+		}
+		info, err := os.Stat(segmentPath)
+		if err != nil {
+			return nil, err
+		}
+		offset += info.Size()
+	}
+	return offsets, nil
+}
+
+// limitReached reports whether the recorded media duration hit the limit
+func (r *liveRecorder) limitReached() bool {
+	return r.maxDuration > 0 && time.Duration(r.recorded*float64(time.Second)) >= r.maxDuration
+}
+
+// localPath returns where a recorded segment is stored
+func (r *liveRecorder) localPath(segmentName string) string {
+	return fmt.Sprintf("%s/segments/%s_%s", r.output.directory, r.rendition, segmentName)
+}
@@ -0,0 +1,856 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MUXER_NATIVE = "native"
+	MUXER_FFMPEG = "ffmpeg"
+
+	HANDLER_VIDEO     = "vide"
+	HANDLER_AUDIO     = "soun"
+	HANDLER_SUBTITLES = "sbtl"
+
+	movieTimescale = 1000
+)
+
+// muxSample is a sample of a track and where its data is stored in the source
+type muxSample struct {
+	offset   int64
+	size     uint32
+	duration uint32
+	cto      int64 // composition time offset
+	sync     bool
+}
+
+// muxTrack is a track read from a rendition, ready to be written into a
+// progressive MP4
+type muxTrack struct {
+	handler   string
+	timescale uint32
+	language  string // ISO 639-2
+	name      string
+	width     uint32 // 16.16 fixed point
+	height    uint32 // 16.16 fixed point
+	stsd      []byte // sample description count followed by the entries
+	startDTS  uint64 // decode time of the first sample
+	mediaTime int64  // composition time the presentation starts at, -1 when unknown
+	mediaEnd  int64  // composition time the presentation stops at, 0 for the end of the media
+	samples   []muxSample
+	source    io.ReaderAt
+}
+
+// muxChunk is a run of samples of one track stored next to each other
+type muxChunk struct {
+	track  int
+	first  int
+	count  int
+	time   float64
+	offset int64
+}
+
+// DefaultMuxer returns MUXER_FFMPEG when ffmpeg is found in PATH, the native
+// muxer is used otherwise
+func DefaultMuxer() string {
+	if _, err := exec.LookPath("ffmpeg"); err == nil {
+		return MUXER_FFMPEG
+	}
+	return MUXER_NATIVE
+}
+
+// mergeMP4FilesInDir muxes the video with every audio track and the
+// subtitles into outputPath, tagging each track with its language, and
+// removes the inputs once the merged file is written. When clip is set, which
+// is relative to the start of the video file, the output is trimmed to it
+func (v *Video) mergeMP4FilesInDir(ctx context.Context, outputPath string, video mediaTrack, audioTracks, subtitles []mediaTrack, clip Clip) error {
+	var err error
+	switch v.client.Muxer {
+	case MUXER_FFMPEG:
+		err = mergeWithFFmpeg(ctx, outputPath, video.Path, audioTracks, subtitles, clip)
+	default:
+		err = remuxMP4(outputPath, video, audioTracks, subtitles, clip)
+	}
+	if err != nil {
+		return err
+	}
+
+	inputs := []string{video.Path}
+	for _, track := range audioTracks {
+		if !track.shared {
+			inputs = append(inputs, track.Path)
+		}
+	}
+	for _, track := range subtitles {
+		if !track.shared {
+			inputs = append(inputs, track.Path)
+		}
+	}
+	for _, filePath := range inputs {
+		err = os.RemoveAll(filePath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeWithFFmpeg muxes the files with ffmpeg, converting the subtitles to
+// mov_text. The audio and video inputs are cut to the clip range, the
+// subtitles were already cut while stitching
+func mergeWithFFmpeg(ctx context.Context, outputPath, videoPath string, audioTracks, subtitles []mediaTrack, clip Clip) error {
+	clipArgs := []string{}
+	if clip.Start > 0 {
+		clipArgs = append(clipArgs, "-ss", strconv.FormatFloat(clip.Start, 'f', 3, 64))
+	}
+	if clip.End > 0 {
+		clipArgs = append(clipArgs, "-to", strconv.FormatFloat(clip.End, 'f', 3, 64))
+	}
+
+	args := append([]string{}, clipArgs...)
+	args = append(args, "-i", videoPath)
+	for _, track := range audioTracks {
+		args = append(args, clipArgs...)
+		args = append(args, "-i", track.Path)
+	}
+	for _, track := range subtitles {
+		args = append(args, "-i", track.Path)
+	}
+
+	// the audio of the video file is replaced when separate tracks exist
+	if len(audioTracks) > 0 {
+		args = append(args, "-map", "0:v")
+	} else {
+		args = append(args, "-map", "0")
+	}
+	for idx := 1; idx <= len(audioTracks)+len(subtitles); idx++ {
+		args = append(args, "-map", strconv.Itoa(idx))
+	}
+	args = append(args, "-c:v", "copy", "-c:a", "copy")
+	if len(subtitles) > 0 {
+		args = append(args, "-c:s", "mov_text")
+	}
+	for idx, track := range audioTracks {
+		args = append(args, track.metadataArgs("a", idx)...)
+	}
+	if len(audioTracks) > 1 {
+		args = append(args, "-disposition:a:0", "default")
+	}
+	for idx, track := range subtitles {
+		args = append(args, track.metadataArgs("s", idx)...)
+	}
+	args = append(args, "-y", outputPath)
+
+	output, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput()
+	if err != nil && ctx.Err() != nil {
+		// ffmpeg was killed halfway through the merged file
+		os.Remove(outputPath)
+		return ctx.Err()
+	}
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, lines[len(lines)-1])
+	}
+	return nil
+}
+
+// remuxMP4 combines the fMP4 or MPEG-TS renditions and WebVTT subtitles into
+// a progressive MP4 without external tools
+func remuxMP4(outputPath string, video mediaTrack, audioTracks, subtitles []mediaTrack, clip Clip) error {
+	var files []*os.File
+	var tempPaths []string
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+		for _, tempPath := range tempPaths {
+			os.Remove(tempPath)
+		}
+	}()
+
+	// open reads the tracks of a rendition file, MPEG-TS samples are
+	// extracted into a temporary file next to it
+	open := func(input mediaTrack) ([]*muxTrack, error) {
+		inputPath := input.Path
+		file, err := os.Open(inputPath)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(file, header); err != nil {
+			return nil, fmt.Errorf("%s: %v", inputPath, err)
+		}
+		if isFragmentedMP4(header) {
+			tracks, err := demuxFragmentedMP4(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", inputPath, err)
+			}
+			return tracks, nil
+		}
+		if header[0] != TS_SYNC_BYTE {
+			return nil, fmt.Errorf("%s is neither fragmented MP4 nor MPEG-TS", inputPath)
+		}
+
+		samples, err := os.CreateTemp(filepath.Dir(inputPath), ".samples-*")
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, samples)
+		tempPaths = append(tempPaths, samples.Name())
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		tracks, err := demuxTransportStream(file, samples, input.restarts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", inputPath, err)
+		}
+		return tracks, nil
+	}
+
+	videoTracks, err := open(video)
+	if err != nil {
+		return err
+	}
+	tracks := []*muxTrack{}
+	for _, track := range videoTracks {
+		// the audio of the video file is replaced when separate tracks exist
+		if track.handler == HANDLER_AUDIO && len(audioTracks) > 0 {
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+
+	for _, audio := range audioTracks {
+		audioRenditionTracks, err := open(audio)
+		if err != nil {
+			return err
+		}
+		for _, track := range audioRenditionTracks {
+			if track.handler != HANDLER_AUDIO {
+				continue
+			}
+			track.language = mp4Language(audio.Language)
+			track.name = audio.Name
+			tracks = append(tracks, track)
+		}
+	}
+
+	var width, height uint32
+	for _, track := range tracks {
+		if track.handler == HANDLER_VIDEO {
+			width, height = track.width, track.height
+			break
+		}
+	}
+	for _, subtitle := range subtitles {
+		track, err := subtitleMuxTrack(subtitle, width, height)
+		if err != nil {
+			return fmt.Errorf("%s: %v", subtitle.Path, err)
+		}
+		tracks = append(tracks, track)
+	}
+
+	tempOutput := outputPath + ".tmp"
+	tempPaths = append(tempPaths, tempOutput)
+	if err := writeProgressiveMP4(tempOutput, tracks, clip); err != nil {
+		return err
+	}
+	return os.Rename(tempOutput, outputPath)
+}
+
+// writeProgressiveMP4 writes the tracks into an MP4 with the moov box in
+// front of the interleaved sample data so it plays while downloading
+func writeProgressiveMP4(outputPath string, tracks []*muxTrack, clip Clip) error {
+	if len(tracks) == 0 {
+		return errors.New("no tracks to write")
+	}
+
+	// align the tracks on the earliest presentation time of the media
+	starts := make([]float64, len(tracks))
+	globalStart := math.Inf(1)
+	for idx, track := range tracks {
+		if track.mediaTime < 0 {
+			track.mediaTime = presentationOffset(track.samples)
+		}
+		starts[idx] = float64(track.startDTS+uint64(track.mediaTime)) / float64(track.timescale)
+		if track.handler != HANDLER_SUBTITLES && starts[idx] < globalStart {
+			globalStart = starts[idx]
+		}
+	}
+	delays := make([]float64, len(tracks))
+	for idx, track := range tracks {
+		if track.handler != HANDLER_SUBTITLES {
+			delays[idx] = starts[idx] - globalStart
+		}
+	}
+	if clip.IsSet() {
+		if err := trimTracks(tracks, delays, clip); err != nil {
+			return err
+		}
+	}
+
+	chunks := interleaveChunks(tracks, delays)
+	var dataSize int64
+	for idx := range chunks {
+		chunks[idx].offset = dataSize
+		for _, sample := range tracks[chunks[idx].track].samples[chunks[idx].first : chunks[idx].first+chunks[idx].count] {
+			dataSize += int64(sample.size)
+		}
+	}
+
+	ftyp := mp4Box("ftyp", []byte("isom"), binary.BigEndian.AppendUint32(nil, 0x200), []byte("isomiso2avc1mp41"))
+	mdatHeader := mp4Box("mdat")
+	if dataSize+8 > math.MaxUint32 {
+		mdatHeader = binary.BigEndian.AppendUint32(nil, 1)
+		mdatHeader = append(mdatHeader, "mdat"...)
+		mdatHeader = binary.BigEndian.AppendUint64(mdatHeader, uint64(dataSize+16))
+	} else {
+		binary.BigEndian.PutUint32(mdatHeader, uint32(dataSize+8))
+	}
+
+	// the moov size doesn't depend on the chunk offsets, so it is built once
+	// to learn where the sample data starts and again with the final offsets
+	largeOffsets := dataSize > math.MaxUint32/2
+	moov := buildMoov(tracks, chunks, delays, 0, largeOffsets)
+	dataStart := int64(len(ftyp) + len(moov) + len(mdatHeader))
+	moov = buildMoov(tracks, chunks, delays, dataStart, largeOffsets)
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	writer := bufio.NewWriterSize(out, 1<<20)
+	for _, part := range [][]byte{ftyp, moov, mdatHeader} {
+		if _, err := writer.Write(part); err != nil {
+			return err
+		}
+	}
+	for _, chunk := range chunks {
+		track := tracks[chunk.track]
+		samples := track.samples[chunk.first : chunk.first+chunk.count]
+		// samples stored next to each other in the source are copied at once
+		for start := 0; start < len(samples); {
+			end := start + 1
+			size := int64(samples[start].size)
+			for end < len(samples) && samples[end].offset == samples[start].offset+size {
+				size += int64(samples[end].size)
+				end++
+			}
+			if _, err := io.Copy(writer, io.NewSectionReader(track.source, samples[start].offset, size)); err != nil {
+				return err
+			}
+			start = end
+		}
+	}
+	return writer.Flush()
+}
+
+// trimTracks cuts the audio and video tracks to the clip range, which is
+// relative to the start of the first video track, and moves the start of the
+// movie to the start of the range
+func trimTracks(tracks []*muxTrack, delays []float64, clip Clip) error {
+	reference := 0
+	for idx, track := range tracks {
+		if track.handler == HANDLER_VIDEO {
+			reference = idx
+			break
+		}
+	}
+	rangeStart := delays[reference] + clip.Start
+	rangeEnd := math.Inf(1)
+	if clip.End > 0 {
+		rangeEnd = delays[reference] + clip.End
+	}
+
+	for idx, track := range tracks {
+		if track.handler == HANDLER_SUBTITLES {
+			continue
+		}
+		if !track.trim(rangeStart-delays[idx], rangeEnd-delays[idx]) {
+			return fmt.Errorf("the %s track has no samples covering %s", track.handler, clip)
+		}
+		delays[idx] = math.Max(delays[idx]-rangeStart, 0)
+	}
+	return nil
+}
+
+// trim drops the samples outside of start and end, in seconds of the
+// presentation of the track, keeping the sync sample the range depends on.
+// The edit list then cuts the presentation to the exact range. It reports
+// whether any sample is left
+func (t *muxTrack) trim(start, end float64) bool {
+	decodeTimes := make([]int64, len(t.samples)+1)
+	for idx, sample := range t.samples {
+		decodeTimes[idx+1] = decodeTimes[idx] + int64(sample.duration)
+	}
+	timescale := float64(t.timescale)
+	startTime := t.mediaTime + int64(math.Round(math.Max(start, 0)*timescale))
+	endTime := int64(math.MaxInt64)
+	if !math.IsInf(end, 1) {
+		endTime = t.mediaTime + int64(math.Round(end*timescale))
+	}
+	if startTime >= decodeTimes[len(t.samples)] || endTime <= startTime {
+		return false
+	}
+
+	first := 0
+	for idx, sample := range t.samples {
+		if decodeTimes[idx] > startTime {
+			break
+		}
+		if sample.sync && decodeTimes[idx]+sample.cto <= startTime {
+			first = idx
+		}
+	}
+	last := len(t.samples)
+	for last > first+1 && decodeTimes[last-1]+t.samples[last-1].cto >= endTime {
+		last--
+	}
+
+	t.samples = t.samples[first:last]
+	t.startDTS += uint64(decodeTimes[first])
+	t.mediaTime = startTime - decodeTimes[first]
+	if endTime != math.MaxInt64 {
+		t.mediaEnd = endTime - decodeTimes[first]
+	}
+	return true
+}
+
+// presentationOffset returns the smallest composition time of the first
+// samples, which is where the presentation of a track with reordered frames
+// starts
+func presentationOffset(samples []muxSample) int64 {
+	var decodeTime int64
+	offset := int64(math.MaxInt64)
+	for idx, sample := range samples {
+		if idx == 64 {
+			break
+		}
+		if decodeTime+sample.cto < offset {
+			offset = decodeTime + sample.cto
+		}
+		decodeTime += int64(sample.duration)
+	}
+	if offset < 0 || offset == math.MaxInt64 {
+		return 0
+	}
+	return offset
+}
+
+// interleaveChunks groups the samples of every track into chunks of about a
+// second and orders them by presentation time
+func interleaveChunks(tracks []*muxTrack, delays []float64) []muxChunk {
+	chunks := []muxChunk{}
+	for trackIdx, track := range tracks {
+		var decodeTime uint64
+		chunk := muxChunk{track: trackIdx}
+		var chunkDuration uint64
+		for idx, sample := range track.samples {
+			if chunk.count > 0 && chunkDuration >= uint64(track.timescale) {
+				chunks = append(chunks, chunk)
+				chunk = muxChunk{track: trackIdx}
+				chunkDuration = 0
+			}
+			if chunk.count == 0 {
+				chunk.first = idx
+				chunk.time = delays[trackIdx] + float64(decodeTime)/float64(track.timescale)
+			}
+			chunk.count++
+			chunkDuration += uint64(sample.duration)
+			decodeTime += uint64(sample.duration)
+		}
+		if chunk.count > 0 {
+			chunks = append(chunks, chunk)
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].time < chunks[j].time
+	})
+	return chunks
+}
+
+// buildMoov serialises the movie header and the sample tables of every track
+// with chunk offsets relative to dataStart
+func buildMoov(tracks []*muxTrack, chunks []muxChunk, delays []float64, dataStart int64, largeOffsets bool) []byte {
+	var movieDuration uint64
+	traks := [][]byte{}
+	firstOfKind := map[string]bool{}
+	for idx, track := range tracks {
+		var mediaDuration uint64
+		for _, sample := range track.samples {
+			mediaDuration += uint64(sample.duration)
+		}
+		delay := uint64(math.Round(delays[idx] * movieTimescale))
+		presented := mediaDuration - uint64(track.mediaTime)
+		if uint64(track.mediaTime) > mediaDuration {
+			presented = 0
+		}
+		if track.mediaEnd > 0 && uint64(track.mediaEnd-track.mediaTime) < presented {
+			presented = uint64(track.mediaEnd - track.mediaTime)
+		}
+		trackDuration := delay + presented*movieTimescale/uint64(track.timescale)
+		if trackDuration > movieDuration {
+			movieDuration = trackDuration
+		}
+
+		// only the first audio track plays by default, the others are alternates
+		flags := uint32(0x7)
+		if firstOfKind[track.handler] || track.handler == HANDLER_SUBTITLES {
+			flags = 0x6
+		}
+		firstOfKind[track.handler] = true
+
+		trackChunks := []muxChunk{}
+		for _, chunk := range chunks {
+			if chunk.track == idx {
+				trackChunks = append(trackChunks, chunk)
+			}
+		}
+		traks = append(traks, buildTrak(track, uint32(idx+1), flags, trackChunks, delay, trackDuration, mediaDuration, dataStart, largeOffsets))
+	}
+
+	mvhd := []byte{}
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0) // creation time
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0) // modification time
+	mvhd = binary.BigEndian.AppendUint32(mvhd, movieTimescale)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, uint32(movieDuration))
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0x00010000) // rate 1.0
+	mvhd = binary.BigEndian.AppendUint16(mvhd, 0x0100)     // volume 1.0
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = append(mvhd, unityMatrix()...)
+	mvhd = append(mvhd, make([]byte, 24)...)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, uint32(len(tracks)+1))
+
+	return mp4Box("moov", append([][]byte{mp4FullBox("mvhd", 0, 0, mvhd)}, traks...)...)
+}
+
+// buildTrak serialises a track with its edit list and sample tables
+func buildTrak(track *muxTrack, trackID, flags uint32, chunks []muxChunk, delay, trackDuration, mediaDuration uint64, dataStart int64, largeOffsets bool) []byte {
+	tkhd := []byte{}
+	tkhd = binary.BigEndian.AppendUint32(tkhd, 0) // creation time
+	tkhd = binary.BigEndian.AppendUint32(tkhd, 0) // modification time
+	tkhd = binary.BigEndian.AppendUint32(tkhd, trackID)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, 0)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, uint32(trackDuration))
+	tkhd = append(tkhd, make([]byte, 8)...)
+	tkhd = binary.BigEndian.AppendUint16(tkhd, 0) // layer
+	switch track.handler {
+	case HANDLER_AUDIO:
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 1) // alternate group
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 0x0100)
+	case HANDLER_SUBTITLES:
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 2)
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 0)
+	default:
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 0)
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 0)
+	}
+	tkhd = append(tkhd, 0, 0)
+	tkhd = append(tkhd, unityMatrix()...)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, track.width)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, track.height)
+
+	// an empty edit delays tracks starting after the others, the media edit
+	// skips the composition offset of reordered frames
+	elst := []byte{}
+	entries := uint32(1)
+	if delay > 0 {
+		entries++
+		elst = binary.BigEndian.AppendUint32(elst, uint32(delay))
+		elst = binary.BigEndian.AppendUint32(elst, math.MaxUint32) // media time -1
+		elst = binary.BigEndian.AppendUint32(elst, 0x00010000)
+	}
+	elst = binary.BigEndian.AppendUint32(elst, uint32(trackDuration-delay))
+	elst = binary.BigEndian.AppendUint32(elst, uint32(track.mediaTime))
+	elst = binary.BigEndian.AppendUint32(elst, 0x00010000)
+	edts := mp4Box("edts", mp4FullBox("elst", 0, 0, binary.BigEndian.AppendUint32(nil, entries), elst))
+
+	mdhdVersion := byte(0)
+	mdhd := []byte{}
+	if mediaDuration > math.MaxUint32 {
+		mdhdVersion = 1
+		mdhd = append(mdhd, make([]byte, 16)...)
+		mdhd = binary.BigEndian.AppendUint32(mdhd, track.timescale)
+		mdhd = binary.BigEndian.AppendUint64(mdhd, mediaDuration)
+	} else {
+		mdhd = append(mdhd, make([]byte, 8)...)
+		mdhd = binary.BigEndian.AppendUint32(mdhd, track.timescale)
+		mdhd = binary.BigEndian.AppendUint32(mdhd, uint32(mediaDuration))
+	}
+	mdhd = binary.BigEndian.AppendUint16(mdhd, packLanguage(track.language))
+	mdhd = binary.BigEndian.AppendUint16(mdhd, 0)
+
+	hdlr := append(make([]byte, 4), track.handler...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(hdlr, track.name...)
+	hdlr = append(hdlr, 0)
+
+	var mediaHeader []byte
+	switch track.handler {
+	case HANDLER_VIDEO:
+		mediaHeader = mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	case HANDLER_AUDIO:
+		mediaHeader = mp4FullBox("smhd", 0, 0, make([]byte, 4))
+	default:
+		mediaHeader = mp4FullBox("nmhd", 0, 0)
+	}
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, binary.BigEndian.AppendUint32(nil, 1), mp4FullBox("url ", 0, 1)))
+
+	return mp4Box("trak",
+		mp4FullBox("tkhd", 0, flags, tkhd),
+		edts,
+		mp4Box("mdia",
+			mp4FullBox("mdhd", mdhdVersion, 0, mdhd),
+			mp4FullBox("hdlr", 0, 0, hdlr),
+			mp4Box("minf", mediaHeader, dinf, buildStbl(track, chunks, dataStart, largeOffsets)),
+		),
+	)
+}
+
+// buildStbl serialises the sample tables of a track
+func buildStbl(track *muxTrack, chunks []muxChunk, dataStart int64, largeOffsets bool) []byte {
+	samples := track.samples
+
+	// decoding times as runs of equal durations
+	stts := []byte{}
+	sttsEntries := uint32(0)
+	for idx := 0; idx < len(samples); {
+		end := idx + 1
+		for end < len(samples) && samples[end].duration == samples[idx].duration {
+			end++
+		}
+		stts = binary.BigEndian.AppendUint32(stts, uint32(end-idx))
+		stts = binary.BigEndian.AppendUint32(stts, samples[idx].duration)
+		sttsEntries++
+		idx = end
+	}
+	boxes := [][]byte{
+		mp4FullBox("stsd", 0, 0, track.stsd),
+		mp4FullBox("stts", 0, 0, binary.BigEndian.AppendUint32(nil, sttsEntries), stts),
+	}
+
+	// composition offsets, signed offsets need version 1
+	reordered, negative := false, false
+	for _, sample := range samples {
+		reordered = reordered || sample.cto != 0
+		negative = negative || sample.cto < 0
+	}
+	if reordered {
+		ctts := []byte{}
+		cttsEntries := uint32(0)
+		for idx := 0; idx < len(samples); {
+			end := idx + 1
+			for end < len(samples) && samples[end].cto == samples[idx].cto {
+				end++
+			}
+			ctts = binary.BigEndian.AppendUint32(ctts, uint32(end-idx))
+			ctts = binary.BigEndian.AppendUint32(ctts, uint32(int32(samples[idx].cto)))
+			cttsEntries++
+			idx = end
+		}
+		version := byte(0)
+		if negative {
+			version = 1
+		}
+		boxes = append(boxes, mp4FullBox("ctts", version, 0, binary.BigEndian.AppendUint32(nil, cttsEntries), ctts))
+	}
+
+	// sync samples, omitted when every sample is one
+	stss := []byte{}
+	syncCount := uint32(0)
+	for idx, sample := range samples {
+		if sample.sync {
+			stss = binary.BigEndian.AppendUint32(stss, uint32(idx+1))
+			syncCount++
+		}
+	}
+	if int(syncCount) != len(samples) {
+		boxes = append(boxes, mp4FullBox("stss", 0, 0, binary.BigEndian.AppendUint32(nil, syncCount), stss))
+	}
+
+	// samples per chunk as runs of equal counts
+	stsc := []byte{}
+	stscEntries := uint32(0)
+	for idx, chunk := range chunks {
+		if idx > 0 && chunks[idx-1].count == chunk.count {
+			continue
+		}
+		stsc = binary.BigEndian.AppendUint32(stsc, uint32(idx+1))
+		stsc = binary.BigEndian.AppendUint32(stsc, uint32(chunk.count))
+		stsc = binary.BigEndian.AppendUint32(stsc, 1)
+		stscEntries++
+	}
+	boxes = append(boxes, mp4FullBox("stsc", 0, 0, binary.BigEndian.AppendUint32(nil, stscEntries), stsc))
+
+	stsz := binary.BigEndian.AppendUint32(nil, 0)
+	stsz = binary.BigEndian.AppendUint32(stsz, uint32(len(samples)))
+	for _, sample := range samples {
+		stsz = binary.BigEndian.AppendUint32(stsz, sample.size)
+	}
+	boxes = append(boxes, mp4FullBox("stsz", 0, 0, stsz))
+
+	offsets := binary.BigEndian.AppendUint32(nil, uint32(len(chunks)))
+	for _, chunk := range chunks {
+		if largeOffsets {
+			offsets = binary.BigEndian.AppendUint64(offsets, uint64(dataStart+chunk.offset))
+		} else {
+			offsets = binary.BigEndian.AppendUint32(offsets, uint32(dataStart+chunk.offset))
+		}
+	}
+	if largeOffsets {
+		boxes = append(boxes, mp4FullBox("co64", 0, 0, offsets))
+	} else {
+		boxes = append(boxes, mp4FullBox("stco", 0, 0, offsets))
+	}
+	return mp4Box("stbl", boxes...)
+}
+
+// unityMatrix is the identity transformation of mvhd and tkhd boxes
+func unityMatrix() []byte {
+	matrix := []byte{}
+	for _, value := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		matrix = binary.BigEndian.AppendUint32(matrix, value)
+	}
+	return matrix
+}
+
+// subtitleMuxTrack converts a stitched WebVTT file into a 3GPP timed text
+// (mov_text) track. Overlapping cues are shown together and the gaps
+// between cues are filled with empty samples
+func subtitleMuxTrack(subtitle mediaTrack, width, height uint32) (*muxTrack, error) {
+	data, err := os.ReadFile(subtitle.Path)
+	if err != nil {
+		return nil, err
+	}
+	cues := []webVTTCue{}
+	for _, block := range webVTTBlocks(string(data)) {
+		if !strings.Contains(block, "-->") {
+			continue
+		}
+		cue, err := parseWebVTTCue(block)
+		if err != nil {
+			return nil, err
+		}
+		if cue.End > cue.Start {
+			cues = append(cues, cue)
+		}
+	}
+
+	boundaries := []int64{0}
+	for _, cue := range cues {
+		boundaries = append(boundaries, int64(math.Round(cue.Start*movieTimescale)), int64(math.Round(cue.End*movieTimescale)))
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+
+	track := &muxTrack{
+		handler:   HANDLER_SUBTITLES,
+		timescale: movieTimescale,
+		language:  mp4Language(subtitle.Language),
+		name:      subtitle.Name,
+		width:     width,
+		height:    height,
+		stsd:      append(binary.BigEndian.AppendUint32(nil, 1), timedTextSampleEntry()...),
+	}
+	sampleData := bytes.Buffer{}
+	for idx := 0; idx+1 < len(boundaries); idx++ {
+		start, end := boundaries[idx], boundaries[idx+1]
+		if end <= start {
+			continue
+		}
+		lines := []string{}
+		for _, cue := range cues {
+			if int64(math.Round(cue.Start*movieTimescale)) <= start && int64(math.Round(cue.End*movieTimescale)) >= end {
+				lines = append(lines, plainCueText(cue.Payload))
+			}
+		}
+		text := strings.Join(lines, "\n")
+		if len(text) > math.MaxUint16 {
+			text = text[:math.MaxUint16]
+		}
+
+		offset := int64(sampleData.Len())
+		sampleData.Write(binary.BigEndian.AppendUint16(nil, uint16(len(text))))
+		sampleData.WriteString(text)
+		track.samples = append(track.samples, muxSample{
+			offset:   offset,
+			size:     uint32(2 + len(text)),
+			duration: uint32(end - start),
+			sync:     true,
+		})
+	}
+	if len(track.samples) == 0 {
+		return nil, errors.New("no cues found")
+	}
+	track.source = bytes.NewReader(sampleData.Bytes())
+	return track, nil
+}
+
+// plainCueText removes the WebVTT markup tags that mov_text can't represent
+func plainCueText(payload string) string {
+	text := strings.Builder{}
+	inTag := false
+	for _, r := range payload {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>' && inTag:
+			inTag = false
+		case !inTag:
+			text.WriteRune(r)
+		}
+	}
+	return strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&nbsp;", " ", "&lrm;", "\u200e", "&rlm;", "\u200f").Replace(text.String())
+}
+
+// timedTextSampleEntry is a tx3g sample description with bottom centred
+// white text on a transparent background
+func timedTextSampleEntry() []byte {
+	entry := make([]byte, 6)                        // reserved
+	entry = binary.BigEndian.AppendUint16(entry, 1) // data reference index
+	entry = binary.BigEndian.AppendUint32(entry, 0) // display flags
+	entry = append(entry, 1, 0xff)                  // centred horizontally, bottom aligned
+	entry = append(entry, 0, 0, 0, 0)               // background colour
+	entry = append(entry, make([]byte, 8)...)       // default text box
+	entry = binary.BigEndian.AppendUint16(entry, 0) // style start
+	entry = binary.BigEndian.AppendUint16(entry, 0) // style end
+	entry = binary.BigEndian.AppendUint16(entry, 1) // font ID
+	entry = append(entry, 0, 18)                    // face style, font size
+	entry = append(entry, 0xff, 0xff, 0xff, 0xff)   // text colour
+	fontTable := binary.BigEndian.AppendUint16(nil, 1)
+	fontTable = binary.BigEndian.AppendUint16(fontTable, 1)
+	fontTable = append(fontTable, byte(len("Serif")))
+	fontTable = append(fontTable, "Serif"...)
+	return mp4Box("tx3g", entry, mp4Box("ftab", fontTable))
+}
+
+// isTransportStream reports whether the file at filePath holds MPEG-TS packets
+func isTransportStream(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+	return header[0] == TS_SYNC_BYTE
+}
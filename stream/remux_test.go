@@ -0,0 +1,418 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testSPS is a baseline profile SPS for 320x240
+var testSPS = []byte{0x67, 0x42, 0x00, 0x1e, 0xf4, 0x0a, 0x0f, 0xc8}
+
+var testPPS = []byte{0x68, 0xce, 0x38, 0x80}
+
+// sampleTable is the part of an stbl and edts the round trips check
+type sampleTable struct {
+	handler string
+	stts    [][2]uint32
+	ctts    [][2]uint32
+	sizes   []uint32
+	offsets []uint32
+	elst    [][2]int64
+	data    [][]byte
+}
+
+// readSampleTables parses the tracks of a progressive MP4 and reads the data
+// of every sample at the offset its chunk and size give
+func readSampleTables(t *testing.T, path string) []sampleTable {
+	t.Helper()
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moov := findBox(file, "moov")
+	if moov == nil {
+		t.Fatal("no moov box")
+	}
+
+	pairs := func(box []byte) [][2]uint32 {
+		if box == nil {
+			return nil
+		}
+		count := binary.BigEndian.Uint32(box[4:])
+		entries := [][2]uint32{}
+		for i := uint32(0); i < count; i++ {
+			entry := box[8+8*i:]
+			entries = append(entries, [2]uint32{binary.BigEndian.Uint32(entry), binary.BigEndian.Uint32(entry[4:])})
+		}
+		return entries
+	}
+
+	tables := []sampleTable{}
+	for _, trak := range findBoxes(moov, "trak") {
+		stbl := findBox(trak, "mdia", "minf", "stbl")
+		table := sampleTable{
+			handler: string(findBox(trak, "mdia", "hdlr")[8:12]),
+			stts:    pairs(findBox(stbl, "stts")),
+			ctts:    pairs(findBox(stbl, "ctts")),
+		}
+
+		stsz := findBox(stbl, "stsz")
+		for i := uint32(0); i < binary.BigEndian.Uint32(stsz[8:]); i++ {
+			table.sizes = append(table.sizes, binary.BigEndian.Uint32(stsz[12+4*i:]))
+		}
+		stco := findBox(stbl, "stco")
+		for i := uint32(0); i < binary.BigEndian.Uint32(stco[4:]); i++ {
+			table.offsets = append(table.offsets, binary.BigEndian.Uint32(stco[8+4*i:]))
+		}
+		// elst entries are (segment duration, media time, rate)
+		elst := findBox(trak, "edts", "elst")
+		for i := uint32(0); i < binary.BigEndian.Uint32(elst[4:]); i++ {
+			entry := elst[8+12*i:]
+			table.elst = append(table.elst, [2]int64{int64(binary.BigEndian.Uint32(entry)), int64(int32(binary.BigEndian.Uint32(entry[4:])))})
+		}
+
+		// stsc entries are (first chunk, samples per chunk, description), an
+		// entry applies until the next one starts
+		stsc := findBox(stbl, "stsc")
+		sample := 0
+		for chunk, offset := range table.offsets {
+			count := 0
+			for i := uint32(0); i < binary.BigEndian.Uint32(stsc[4:]); i++ {
+				entry := stsc[8+12*i:]
+				if int(binary.BigEndian.Uint32(entry)) <= chunk+1 {
+					count = int(binary.BigEndian.Uint32(entry[4:]))
+				}
+			}
+			for i := 0; i < count; i++ {
+				size := table.sizes[sample]
+				table.data = append(table.data, file[offset:offset+size])
+				offset += size
+				sample++
+			}
+		}
+		if sample != len(table.sizes) {
+			t.Fatalf("%s: chunks hold %d of %d samples", table.handler, sample, len(table.sizes))
+		}
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// testFragmentedMP4 builds an fMP4 rendition of one video track at a 1000
+// timescale whose samples are split over two fragments
+func testFragmentedMP4(samples [][]byte, duration, cto uint32) []byte {
+	tkhd := make([]byte, 80)
+	binary.BigEndian.PutUint32(tkhd[8:], 1) // track ID
+	binary.BigEndian.PutUint32(tkhd[72:], 320<<16)
+	binary.BigEndian.PutUint32(tkhd[76:], 240<<16)
+	mdhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mdhd[8:], 1000)
+	binary.BigEndian.PutUint16(mdhd[16:], packLanguage("und"))
+	hdlr := append(make([]byte, 4), HANDLER_VIDEO...)
+	hdlr = append(hdlr, make([]byte, 13)...)
+	stsd := append(binary.BigEndian.AppendUint32(nil, 1), avcSampleEntry(testSPS, testPPS, 320, 240)...)
+	trex := binary.BigEndian.AppendUint32(nil, 1)
+	trex = append(trex, make([]byte, 16)...)
+
+	out := mp4Box("ftyp", []byte("iso6"), make([]byte, 4))
+	out = append(out, mp4Box("moov",
+		mp4Box("trak",
+			mp4FullBox("tkhd", 0, 3, tkhd),
+			mp4Box("mdia",
+				mp4FullBox("mdhd", 0, 0, mdhd),
+				mp4FullBox("hdlr", 0, 0, hdlr),
+				mp4Box("minf", mp4Box("stbl", mp4FullBox("stsd", 0, 0, stsd))),
+			),
+		),
+		mp4Box("mvex", mp4FullBox("trex", 0, 0, trex)),
+	)...)
+
+	half := len(samples) / 2
+	for fragment, fragmentSamples := range [][][]byte{samples[:half], samples[half:]} {
+		moof := func(dataOffset uint32) []byte {
+			trun := binary.BigEndian.AppendUint32(nil, uint32(len(fragmentSamples)))
+			trun = binary.BigEndian.AppendUint32(trun, dataOffset)
+			for idx, sample := range fragmentSamples {
+				flags := uint32(0x10000) // non-sync
+				if fragment == 0 && idx == 0 {
+					flags = 0
+				}
+				trun = binary.BigEndian.AppendUint32(trun, duration)
+				trun = binary.BigEndian.AppendUint32(trun, uint32(len(sample)))
+				trun = binary.BigEndian.AppendUint32(trun, flags)
+				trun = binary.BigEndian.AppendUint32(trun, cto)
+			}
+			tfdt := binary.BigEndian.AppendUint64(nil, uint64(fragment*half)*uint64(duration))
+			return mp4Box("moof",
+				mp4FullBox("mfhd", 0, 0, binary.BigEndian.AppendUint32(nil, uint32(fragment+1))),
+				mp4Box("traf",
+					mp4FullBox("tfhd", 0, 0, binary.BigEndian.AppendUint32(nil, 1)),
+					mp4FullBox("tfdt", 1, 0, tfdt),
+					mp4FullBox("trun", 0, 0xf01, trun),
+				),
+			)
+		}
+		box := moof(uint32(len(moof(0)) + 8))
+		out = append(out, box...)
+		out = append(out, mp4Box("mdat", bytes.Join(fragmentSamples, nil))...)
+	}
+	return out
+}
+
+func TestRemuxFragmentedMP4(t *testing.T) {
+	samples := [][]byte{
+		bytes.Repeat([]byte{0xa0}, 100),
+		bytes.Repeat([]byte{0xa1}, 37),
+		bytes.Repeat([]byte{0xa2}, 61),
+		bytes.Repeat([]byte{0xa3}, 12),
+	}
+	dir := t.TempDir()
+	input := filepath.Join(dir, "video.mp4")
+	if err := os.WriteFile(input, testFragmentedMP4(samples, 40, 40), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "output.mp4")
+	if err := remuxMP4(output, mediaTrack{Path: input}, nil, nil, Clip{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := readSampleTables(t, output)
+	if len(tables) != 1 {
+		t.Fatalf("got %d tracks, want 1", len(tables))
+	}
+	video := tables[0]
+	if want := [][2]uint32{{4, 40}}; !reflect.DeepEqual(video.stts, want) {
+		t.Errorf("stts = %v, want %v", video.stts, want)
+	}
+	if want := [][2]uint32{{4, 40}}; !reflect.DeepEqual(video.ctts, want) {
+		t.Errorf("ctts = %v, want %v", video.ctts, want)
+	}
+	if want := []uint32{100, 37, 61, 12}; !reflect.DeepEqual(video.sizes, want) {
+		t.Errorf("stsz = %v, want %v", video.sizes, want)
+	}
+	if !reflect.DeepEqual(video.data, samples) {
+		t.Error("sample data at the stco offsets differs from the fragments")
+	}
+	// the composition offset of the first sample is skipped by the edit
+	if want := [][2]int64{{120, 40}}; !reflect.DeepEqual(video.elst, want) {
+		t.Errorf("elst = %v, want %v", video.elst, want)
+	}
+}
+
+// testTimestamp encodes a PTS or DTS field with its 4 bit prefix
+func testTimestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0e | 1,
+		byte(ts >> 22),
+		byte(ts>>14)&0xfe | 1,
+		byte(ts >> 7),
+		byte(ts<<1)&0xfe | 1,
+	}
+}
+
+// testPES builds a PES packet, with PTS and DTS when pts is not negative
+func testPES(streamID byte, pts, dts int64, payload []byte) []byte {
+	header := []byte{0x80, 0x00, 0x00}
+	switch {
+	case pts < 0:
+	case dts < 0:
+		header = append([]byte{0x80, 0x80, 5}, testTimestamp(0x2, pts)...)
+	default:
+		header = append([]byte{0x80, 0xc0, 10}, testTimestamp(0x3, pts)...)
+		header = append(header, testTimestamp(0x1, dts)...)
+	}
+	pes := []byte{0, 0, 1, streamID, 0, 0}
+	if streamID != 0xe0 {
+		binary.BigEndian.PutUint16(pes[4:], uint16(len(header)+len(payload)))
+	}
+	return append(append(pes, header...), payload...)
+}
+
+// testPSI builds the packet of a PAT or PMT section, the CRC is not checked
+func testPSI(pid uint16, tableID byte, body []byte) []byte {
+	section := []byte{tableID, 0, 0, 0, 1, 0xc1, 0, 0}
+	section = append(section, body...)
+	section = append(section, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(section[1:], 0xb000|uint16(len(section)-3))
+
+	packet := bytes.Repeat([]byte{0xff}, TS_PACKET_SIZE)
+	copy(packet, []byte{TS_SYNC_BYTE, 0x40 | byte(pid>>8), byte(pid), 0x10, 0})
+	copy(packet[5:], section)
+	return packet
+}
+
+// testADTS builds an AAC LC stereo 48kHz frame
+func testADTS(payload []byte) []byte {
+	length := 7 + len(payload)
+	header := []byte{0xff, 0xf1, 1<<6 | 3<<2, 2<<6 | byte(length>>11), byte(length >> 3), byte(length&7)<<5 | 0x1f, 0xfc}
+	return append(header, payload...)
+}
+
+const testVideoPID, testAudioPID = 0x100, 0x101
+
+// testProgram writes the PAT and a PMT with an H.264 and an AAC stream
+func testProgram(ts *bytes.Buffer) {
+	ts.Write(testPSI(0, 0x00, []byte{0, 1, 0xf0, 0x00}))
+	ts.Write(testPSI(0x1000, 0x02, []byte{
+		0xe1, 0x00, 0xf0, 0x00,
+		STREAM_TYPE_H264, 0xe1, 0x00, 0xf0, 0x00,
+		STREAM_TYPE_AAC, 0xe1, 0x01, 0xf0, 0x00,
+	}))
+}
+
+// testAnnexB joins NAL units with 4 byte start codes
+func testAnnexB(nals ...[]byte) []byte {
+	out := []byte{}
+	for _, nal := range nals {
+		out = append(append(out, 0, 0, 0, 1), nal...)
+	}
+	return out
+}
+
+// testLengthPrefixed joins NAL units as an MP4 sample does
+func testLengthPrefixed(nals ...[]byte) []byte {
+	out := []byte{}
+	for _, nal := range nals {
+		out = binary.BigEndian.AppendUint32(out, uint32(len(nal)))
+		out = append(out, nal...)
+	}
+	return out
+}
+
+func TestRemuxTransportStream(t *testing.T) {
+	const videoPID, audioPID = testVideoPID, testAudioPID
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xb0}, 300)...)
+	slice := append([]byte{0x41}, bytes.Repeat([]byte{0xb1}, 250)...)
+	secondSlice := append([]byte{0x01}, bytes.Repeat([]byte{0xb2}, 20)...)
+	last := append([]byte{0x41}, bytes.Repeat([]byte{0xb3}, 40)...)
+	secondUnit := testAnnexB(slice, secondSlice)
+	frames := [][]byte{
+		bytes.Repeat([]byte{0xc0}, 90),
+		bytes.Repeat([]byte{0xc1}, 110),
+		bytes.Repeat([]byte{0xc2}, 70),
+	}
+
+	var ts bytes.Buffer
+	testProgram(&ts)
+	continuity := map[uint16]byte{}
+	write := func(pid uint16, pes []byte) {
+		continuity[pid] = packetizePES(&ts, &pesAssembly{pid: pid}, pes, continuity[pid])
+	}
+	write(videoPID, testPES(0xe0, 12000, 9000, testAnnexB([]byte{0x09, 0xf0}, testSPS, testPPS, idr)))
+	// the second access unit continues in a PES packet without timestamp,
+	// in the middle of a NAL unit and after audio of the same time
+	write(videoPID, testPES(0xe0, 18000, 12000, secondUnit[:100]))
+	write(audioPID, testPES(0xc0, 21000, -1, append(testADTS(frames[0]), testADTS(frames[1])...)))
+	write(videoPID, testPES(0xe0, -1, -1, secondUnit[100:]))
+	write(audioPID, testPES(0xc0, 21000+2*1920, -1, testADTS(frames[2])))
+	write(videoPID, testPES(0xe0, 15000, 15000, testAnnexB(last)))
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "video.ts")
+	if err := os.WriteFile(input, ts.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "output.mp4")
+	if err := remuxMP4(output, mediaTrack{Path: input}, nil, nil, Clip{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := readSampleTables(t, output)
+	if len(tables) != 2 || tables[0].handler != HANDLER_VIDEO || tables[1].handler != HANDLER_AUDIO {
+		t.Fatalf("got %d tracks, want video and audio", len(tables))
+	}
+
+	video := tables[0]
+	wantVideo := [][]byte{
+		testLengthPrefixed(testSPS, testPPS, idr),
+		testLengthPrefixed(slice, secondSlice),
+		testLengthPrefixed(last),
+	}
+	if !reflect.DeepEqual(video.data, wantVideo) {
+		t.Errorf("video samples = %x, want %x", video.data, wantVideo)
+	}
+	if want := [][2]uint32{{3, 3000}}; !reflect.DeepEqual(video.stts, want) {
+		t.Errorf("video stts = %v, want %v", video.stts, want)
+	}
+	if want := [][2]uint32{{1, 3000}, {1, 6000}, {1, 0}}; !reflect.DeepEqual(video.ctts, want) {
+		t.Errorf("video ctts = %v, want %v", video.ctts, want)
+	}
+	if want := [][2]int64{{66, 3000}}; !reflect.DeepEqual(video.elst, want) {
+		t.Errorf("video elst = %v, want %v", video.elst, want)
+	}
+
+	audio := tables[1]
+	if !reflect.DeepEqual(audio.data, frames) {
+		t.Errorf("audio samples = %x, want %x", audio.data, frames)
+	}
+	if want := [][2]uint32{{3, 1024}}; !reflect.DeepEqual(audio.stts, want) {
+		t.Errorf("audio stts = %v, want %v", audio.stts, want)
+	}
+	if want := []uint32{90, 110, 70}; !reflect.DeepEqual(audio.sizes, want) {
+		t.Errorf("audio stsz = %v, want %v", audio.sizes, want)
+	}
+	// the audio starts 100ms after the first video frame is shown
+	if want := [][2]int64{{100, -1}, {64, 0}}; !reflect.DeepEqual(audio.elst, want) {
+		t.Errorf("audio elst = %v, want %v", audio.elst, want)
+	}
+}
+
+func TestRemuxTransportStreamRestart(t *testing.T) {
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xd0}, 50)...)
+	slice := append([]byte{0x41}, bytes.Repeat([]byte{0xd1}, 30)...)
+
+	// segment writes two frames and an audio frame starting at start
+	segment := func(start int64) []byte {
+		var ts bytes.Buffer
+		testProgram(&ts)
+		packetizePES(&ts, &pesAssembly{pid: testVideoPID}, testPES(0xe0, start, start, testAnnexB(testSPS, testPPS, idr)), 0)
+		packetizePES(&ts, &pesAssembly{pid: testAudioPID}, testPES(0xc0, start, -1, testADTS(make([]byte, 20))), 0)
+		packetizePES(&ts, &pesAssembly{pid: testVideoPID}, testPES(0xe0, start+3000, start+3000, testAnnexB(slice)), 1)
+		return ts.Bytes()
+	}
+	// the second segment follows 10s of expired segments
+	first := segment(900000)
+	input := append(first, segment(900000+6000+10*tsClockRate)...)
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "video.ts")
+	if err := os.WriteFile(inputPath, input, 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "output.mp4")
+	if err := remuxMP4(output, mediaTrack{Path: inputPath, restarts: []int64{int64(len(first))}}, nil, nil, Clip{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := readSampleTables(t, output)
+	if len(tables) != 2 {
+		t.Fatalf("got %d tracks, want 2", len(tables))
+	}
+	video, audio := tables[0], tables[1]
+	wantVideo := [][]byte{
+		testLengthPrefixed(testSPS, testPPS, idr),
+		testLengthPrefixed(slice),
+		testLengthPrefixed(testSPS, testPPS, idr),
+		testLengthPrefixed(slice),
+	}
+	if !reflect.DeepEqual(video.data, wantVideo) {
+		t.Errorf("video samples = %x, want %x", video.data, wantVideo)
+	}
+	// the gap is removed from the timeline
+	if want := [][2]uint32{{4, 3000}}; !reflect.DeepEqual(video.stts, want) {
+		t.Errorf("video stts = %v, want %v", video.stts, want)
+	}
+	if want := [][2]int64{{133, 0}}; !reflect.DeepEqual(video.elst, want) {
+		t.Errorf("video elst = %v, want %v", video.elst, want)
+	}
+	if want := [][2]uint32{{2, 1024}}; !reflect.DeepEqual(audio.stts, want) {
+		t.Errorf("audio stts = %v, want %v", audio.stts, want)
+	}
+	if want := [][2]int64{{42, 0}}; !reflect.DeepEqual(audio.elst, want) {
+		t.Errorf("audio elst = %v, want %v", audio.elst, want)
+	}
+}
@@ -0,0 +1,119 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/grafov/m3u8"
+)
+
+// outputRoot returns the name of the video used for {uid} in the output
+// template
+func (v *Video) outputRoot() string {
+	if root := safeName(v.VideoUID); root != "" {
+		return root
+	}
+	return "video"
+}
+
+// downloadAllRenditions downloads every variant of the master playlist and
+// merges a MP4 for each of them, by default into <uid>/<resolution>/. The
+// audio tracks of an audio group are downloaded once, into the directory of
+// resolution audio_<group>, and shared by every variant referencing the group.
+// Subtitles groups are shared the same way from subtitles_<group>, where the
+// sidecar files stay. The directories of the variants are returned
+func (v *Video) downloadAllRenditions(ctx context.Context, opts DownloadOptions) ([]string, error) {
+	if opts.Template == "" {
+		opts.Template = VIDEO_OUTPUT_TEMPLATE
+	}
+
+	variants := []*m3u8.Variant{}
+	seen := make(map[string]bool)
+	for _, variant := range v.MasterPlaylist.Variants {
+		if variant == nil || variant.Iframe || seen[variant.URI] {
+			continue
+		}
+		seen[variant.URI] = true
+		variants = append(variants, variant)
+	}
+	v.printf("📚 Downloading all %d renditions\n", len(variants))
+	defer v.beginTransfer()()
+
+	audioGroups := make(map[string][]mediaTrack)
+	subtitleGroups := make(map[string][]mediaTrack)
+	claimed := make(map[string]bool)
+	var sharedTracks []mediaTrack
+	directories := []string{}
+	for _, variant := range variants {
+		audioTracks, downloaded := audioGroups[variant.Audio]
+		if !downloaded && variant.Audio != "" {
+			renditions, err := opts.Audio.selectTracks(v.groupRenditions("AUDIO", variant.Audio))
+			if err != nil {
+				return nil, fmt.Errorf("there was a problem selecting the audio tracks of group %s: %w", variant.Audio, err)
+			}
+			output := v.renditionOutput(opts, "audio_"+variant.Audio, nil, claimed)
+			audioTracks, err = v.downloadAudioTracks(ctx, renditions, output, opts.Clip)
+			if err != nil {
+				return nil, fmt.Errorf("there was a problem downloading the audio tracks of group %s: %w", variant.Audio, err)
+			}
+			for idx := range audioTracks {
+				audioTracks[idx].shared = true
+			}
+			audioGroups[variant.Audio] = audioTracks
+			sharedTracks = append(sharedTracks, audioTracks...)
+		}
+
+		subtitles, downloaded := subtitleGroups[variant.Subtitles]
+		if !downloaded && opts.Subtitles != SUBTITLES_NONE {
+			renditions := v.alternativeRenditions("SUBTITLES", variant)
+			if len(renditions) > 0 {
+				var err error
+				output := v.renditionOutput(opts, subtitlesGroupName(variant.Subtitles), nil, claimed)
+				subtitles, err = v.downloadSubtitles(ctx, renditions, output, opts.Clip)
+				if err != nil {
+					return nil, fmt.Errorf("there was a problem downloading the subtitles of group %s: %w", variant.Subtitles, err)
+				}
+				for idx := range subtitles {
+					subtitles[idx].shared = true
+				}
+			}
+			subtitleGroups[variant.Subtitles] = subtitles
+			if opts.Subtitles == SUBTITLES_EMBED {
+				sharedTracks = append(sharedTracks, subtitles...)
+			}
+		}
+
+		// variants of the same resolution with another codec or frame rate
+		// get a numbered directory
+		output := v.renditionOutput(opts, variant.Resolution, variant, claimed)
+		directories = append(directories, output.directory)
+
+		renditionURL, err := resolveURL(v.MasterManifestURL, variant.URI)
+		if err != nil {
+			return nil, fmt.Errorf("there was a problem resolving the rendition manifest: %w", err)
+		}
+		v.printf("🎞 %s\n", VariantDescription(variant))
+		if err := v.downloadRendition(ctx, v.signedURL(renditionURL), output, opts, audioTracks, subtitles); err != nil {
+			return nil, err
+		}
+	}
+
+	// the shared audio tracks and embedded subtitles are part of every merged
+	// file by now
+	for _, track := range sharedTracks {
+		if err := os.RemoveAll(track.Path); err != nil {
+			return nil, err
+		}
+	}
+	return directories, nil
+}
+
+// subtitlesGroupName returns the resolution naming the directory of a
+// subtitles group, variants without a group use every subtitles rendition
+func subtitlesGroupName(group string) string {
+	if group == "" {
+		return "subtitles"
+	}
+	return "subtitles_" + group
+}
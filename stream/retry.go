@@ -0,0 +1,178 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_RETRIES         = 5                      // number of retries after the first failed attempt
+	DEFAULT_RETRY_DELAY     = 500 * time.Millisecond // delay before the first retry, doubled on every attempt
+	DEFAULT_RETRY_MAX_DELAY = 30 * time.Second       // upper bound for the backoff delay
+)
+
+// errTruncated marks a body that ended before the length announced by the
+// server
+var errTruncated = errors.New("truncated")
+
+// HTTPStatusError is returned when a server answers with a non-2xx status
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d for %s", e.StatusCode, e.URL)
+}
+
+// SegmentError reports a segment that could not be downloaded after all retries
+type SegmentError struct {
+	Index    int
+	URL      string
+	Attempts int
+	Err      error
+}
+
+func (e *SegmentError) Error() string {
+	return fmt.Sprintf("segment %d (%s) failed after %d attempt(s): %v", e.Index, e.URL, e.Attempts, e.Err)
+}
+
+func (e *SegmentError) Unwrap() error {
+	return e.Err
+}
+
+// checkResponse validates the status code of a response
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return statusError(resp)
+}
+
+// statusError describes the unexpected status of a response
+func statusError(resp *http.Response) error {
+	return &HTTPStatusError{
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter understands both forms of the Retry-After header: delay in
+// seconds and an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// isRetryable reports whether a failed attempt may succeed when tried again.
+// Only network failures, truncated bodies and some status codes are
+// transient, other errors such as a full disk or a wrong key fail the same
+// way every time
+func isRetryable(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusRequestTimeout ||
+			statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode >= 500
+	}
+	// syscall.Errno is a net.Error too, so only timeouts and the errors of
+	// the net and net/url packages count as network failures
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	var urlErr *url.Error
+	return errors.As(err, &opErr) || errors.As(err, &urlErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errTruncated)
+}
+
+// backoffDelay returns the jittered exponential delay before retry number
+// attempt, preferring the server's Retry-After hint when present. Neither
+// waits longer than RetryMaxDelay
+func (c *Client) backoffDelay(attempt int, err error) time.Duration {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		if c.RetryMaxDelay > 0 && statusErr.RetryAfter > c.RetryMaxDelay {
+			return c.RetryMaxDelay
+		}
+		return statusErr.RetryAfter
+	}
+
+	delay := c.RetryDelay << attempt
+	if delay <= 0 || delay > c.RetryMaxDelay {
+		delay = c.RetryMaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// withRetry runs fn until it succeeds, fails permanently, runs out of
+// retries or ctx is done and returns the number of attempts made
+func (c *Client) withRetry(ctx context.Context, fn func() error) (int, error) {
+	attempts := 0
+	for {
+		attempts++
+		err := fn()
+		if err == nil {
+			return attempts, nil
+		}
+		if ctx.Err() != nil {
+			return attempts, ctx.Err()
+		}
+		if attempts > c.Retries || !isRetryable(err) {
+			return attempts, err
+		}
+
+		timer := time.NewTimer(c.backoffDelay(attempts-1, err))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempts, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// fetchURL downloads a small resource such as a playlist into memory
+func (c *Client) fetchURL(ctx context.Context, url string) ([]byte, error) {
+	var body []byte
+	_, err := c.withRetry(ctx, func() error {
+		resp, err := c.request(ctx, http.MethodGet, url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if err := checkResponse(resp); err != nil {
+			return err
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	return body, err
+}
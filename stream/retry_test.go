@@ -0,0 +1,54 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &HTTPStatusError{StatusCode: 503}, true},
+		{"rate limited", &HTTPStatusError{StatusCode: 429}, true},
+		{"not found", &HTTPStatusError{StatusCode: 404}, false},
+		{"connection refused", &url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, true},
+		{"connection reset", &net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{"unexpected EOF", fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), true},
+		{"truncated segment", fmt.Errorf("segment seg_1.ts %w: received 1 of 2 bytes", errTruncated), true},
+		{"full disk", &os.PathError{Op: "write", Path: "seg_1.ts", Err: syscall.ENOSPC}, false},
+		{"wrong key", errors.New("invalid PKCS7 padding, is the key correct?"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRetryable(test.err); got != test.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDelayCapsRetryAfter(t *testing.T) {
+	client := &Client{RetryDelay: time.Second, RetryMaxDelay: 30 * time.Second}
+	tests := []struct {
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{10 * time.Second, 10 * time.Second},
+		{time.Hour, 30 * time.Second},
+	}
+	for _, test := range tests {
+		if got := client.backoffDelay(0, &HTTPStatusError{StatusCode: 503, RetryAfter: test.retryAfter}); got != test.want {
+			t.Errorf("backoffDelay() with Retry-After %s = %s, want %s", test.retryAfter, got, test.want)
+		}
+	}
+}
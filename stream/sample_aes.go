@@ -0,0 +1,497 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+)
+
+const (
+	TS_PACKET_SIZE = 188
+	TS_SYNC_BYTE   = 0x47
+
+	STREAM_TYPE_AAC              = 0x0f
+	STREAM_TYPE_H264             = 0x1b
+	STREAM_TYPE_AAC_SAMPLE_AES   = 0xcf
+	STREAM_TYPE_H264_SAMPLE_AES  = 0xdb
+	STREAM_TYPE_AC3_SAMPLE_AES   = 0xc1
+	STREAM_TYPE_EAC3_SAMPLE_AES  = 0xc2
+	sampleAESClearLeader         = 32
+	sampleAESAudioClearLeader    = 16
+	sampleAESSkippedBytesPerSpan = 144
+)
+
+// tsPacketInfo holds the header fields of a transport stream packet
+type tsPacketInfo struct {
+	pid           uint16
+	payloadStart  bool
+	payloadOffset int
+	hasPayload    bool
+	adaptation    []byte // adaptation field without its length byte
+	continuity    byte
+}
+
+// pesAssembly collects the packets carrying one PES packet of an encrypted stream
+type pesAssembly struct {
+	pid        uint16
+	streamType byte
+	first      tsPacketInfo
+	data       []byte
+}
+
+// decryptSampleAESTransportStream decrypts the H.264 and AAC samples of an
+// MPEG-TS segment encrypted with SAMPLE-AES and returns a clear transport
+// stream with the PMT updated to the clear stream types
+func decryptSampleAESTransportStream(data, key, iv []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != TS_SYNC_BYTE {
+		return nil, errors.New("SAMPLE-AES is only supported for MPEG-TS segments")
+	}
+	if len(data)%TS_PACKET_SIZE != 0 {
+		return nil, fmt.Errorf("transport stream length %d is not a multiple of %d", len(data), TS_PACKET_SIZE)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	pmtPIDs := map[uint16]bool{}
+	streamTypes := map[uint16]byte{}
+	assemblies := map[uint16]*pesAssembly{}
+	counters := map[uint16]byte{}
+	out := bytes.Buffer{}
+
+	flush := func(pid uint16) error {
+		assembly := assemblies[pid]
+		if assembly == nil {
+			return nil
+		}
+		delete(assemblies, pid)
+		pes, err := decryptPES(assembly, block, iv)
+		if err != nil {
+			return err
+		}
+		counters[pid] = packetizePES(&out, assembly, pes, counters[pid])
+		return nil
+	}
+
+	for offset := 0; offset < len(data); offset += TS_PACKET_SIZE {
+		packet := append([]byte{}, data[offset:offset+TS_PACKET_SIZE]...)
+		info, err := parseTSPacket(packet)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case info.pid == 0 && info.hasPayload:
+			for _, pid := range parsePAT(packet[info.payloadOffset:]) {
+				pmtPIDs[pid] = true
+			}
+		case pmtPIDs[info.pid] && info.hasPayload:
+			if err := rewritePMT(packet[info.payloadOffset:], streamTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		streamType, encrypted := streamTypes[info.pid]
+		if !encrypted || !info.hasPayload {
+			out.Write(packet)
+			continue
+		}
+		if info.payloadStart {
+			if err := flush(info.pid); err != nil {
+				return nil, err
+			}
+			assemblies[info.pid] = &pesAssembly{
+				pid:        info.pid,
+				streamType: streamType,
+				first:      info,
+			}
+			if _, ok := counters[info.pid]; !ok {
+				counters[info.pid] = info.continuity
+			}
+		}
+
+		assembly := assemblies[info.pid]
+		if assembly == nil {
+			// the tail of a PES packet that started in the previous segment
+			out.Write(packet)
+			continue
+		}
+		assembly.data = append(assembly.data, packet[info.payloadOffset:]...)
+	}
+
+	for pid := range assemblies {
+		if err := flush(pid); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// parseTSPacket reads the header and adaptation field of a packet
+func parseTSPacket(packet []byte) (tsPacketInfo, error) {
+	if packet[0] != TS_SYNC_BYTE {
+		return tsPacketInfo{}, errors.New("lost transport stream sync")
+	}
+	info := tsPacketInfo{
+		pid:          uint16(packet[1]&0x1f)<<8 | uint16(packet[2]),
+		payloadStart: packet[1]&0x40 != 0,
+		continuity:   packet[3] & 0x0f,
+	}
+	control := (packet[3] >> 4) & 0x03
+	info.payloadOffset = 4
+	if control&0x02 != 0 {
+		length := int(packet[4])
+		if 5+length > TS_PACKET_SIZE {
+			return tsPacketInfo{}, errors.New("invalid adaptation field length")
+		}
+		info.adaptation = packet[5 : 5+length]
+		info.payloadOffset += 1 + length
+	}
+	info.hasPayload = control&0x01 != 0 && info.payloadOffset < TS_PACKET_SIZE
+	return info, nil
+}
+
+// parsePAT returns the PMT PIDs announced in a program association table
+func parsePAT(payload []byte) []uint16 {
+	section := psiSection(payload)
+	if len(section) < 12 {
+		return nil
+	}
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	end := 3 + length - 4
+	if end > len(section) {
+		end = len(section)
+	}
+
+	var pids []uint16
+	for i := 8; i+4 <= end; i += 4 {
+		program := uint16(section[i])<<8 | uint16(section[i+1])
+		if program != 0 {
+			pids = append(pids, uint16(section[i+2]&0x1f)<<8|uint16(section[i+3]))
+		}
+	}
+	return pids
+}
+
+// rewritePMT records the elementary streams of a program map table and
+// replaces the SAMPLE-AES stream types with their clear equivalents in place
+func rewritePMT(payload []byte, streamTypes map[uint16]byte) error {
+	section := psiSection(payload)
+	if len(section) < 16 {
+		return nil
+	}
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	if 3+length > len(section) {
+		return errors.New("PMT spanning several packets is not supported")
+	}
+	end := 3 + length - 4
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+
+	changed := false
+	for i := 12 + programInfoLength; i+5 <= end; {
+		pid := uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2])
+		infoLength := int(section[i+3]&0x0f)<<8 | int(section[i+4])
+		switch section[i] {
+		case STREAM_TYPE_H264_SAMPLE_AES:
+			section[i] = STREAM_TYPE_H264
+			streamTypes[pid] = STREAM_TYPE_H264
+			changed = true
+		case STREAM_TYPE_AAC_SAMPLE_AES:
+			section[i] = STREAM_TYPE_AAC
+			streamTypes[pid] = STREAM_TYPE_AAC
+			changed = true
+		case STREAM_TYPE_AC3_SAMPLE_AES, STREAM_TYPE_EAC3_SAMPLE_AES:
+			return errors.New("SAMPLE-AES encrypted AC-3 audio is not supported")
+		}
+		i += 5 + infoLength
+	}
+
+	if changed {
+		crc := mpegCRC32(section[:end])
+		section[end] = byte(crc >> 24)
+		section[end+1] = byte(crc >> 16)
+		section[end+2] = byte(crc >> 8)
+		section[end+3] = byte(crc)
+	}
+	return nil
+}
+
+// psiSection skips the pointer field in front of a PSI section
+func psiSection(payload []byte) []byte {
+	if len(payload) == 0 || 1+int(payload[0]) >= len(payload) {
+		return nil
+	}
+	return payload[1+int(payload[0]):]
+}
+
+// decryptPES decrypts the elementary stream payload of a PES packet and
+// returns the PES packet with its length field updated
+func decryptPES(assembly *pesAssembly, block cipher.Block, iv []byte) ([]byte, error) {
+	pes := assembly.data
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return nil, fmt.Errorf("invalid PES packet on PID %d", assembly.pid)
+	}
+	headerLength := 9 + int(pes[8])
+	if headerLength > len(pes) {
+		return nil, fmt.Errorf("truncated PES header on PID %d", assembly.pid)
+	}
+
+	var payload []byte
+	switch assembly.streamType {
+	case STREAM_TYPE_H264:
+		payload = decryptH264Samples(pes[headerLength:], block, iv)
+	case STREAM_TYPE_AAC:
+		payload = decryptAACSamples(pes[headerLength:], block, iv)
+	default:
+		payload = pes[headerLength:]
+	}
+
+	result := append(append([]byte{}, pes[:headerLength]...), payload...)
+	if pes[4] != 0 || pes[5] != 0 {
+		length := len(result) - 6
+		if length > 0xffff {
+			length = 0
+		}
+		result[4] = byte(length >> 8)
+		result[5] = byte(length)
+	}
+	return result, nil
+}
+
+// decryptH264Samples decrypts the slice NAL units of an Annex B byte stream.
+// Each slice keeps its first 32 bytes clear, then one encrypted block is
+// followed by up to nine clear blocks. Emulation prevention bytes are added
+// after encryption, so they are removed before and restored after decrypting
+func decryptH264Samples(stream []byte, block cipher.Block, iv []byte) []byte {
+	out := make([]byte, 0, len(stream))
+	for _, unit := range splitAnnexB(stream) {
+		out = append(out, unit.prefix...)
+		nalType := byte(0)
+		if len(unit.nal) > 0 {
+			nalType = unit.nal[0] & 0x1f
+		}
+		if nalType != 1 && nalType != 5 {
+			out = append(out, unit.nal...)
+			continue
+		}
+
+		rbsp := removeEmulationPrevention(unit.nal)
+		if len(rbsp) <= sampleAESClearLeader+16 {
+			out = append(out, unit.nal...)
+			continue
+		}
+
+		mode := cipher.NewCBCDecrypter(block, iv)
+		data := rbsp[sampleAESClearLeader:]
+		for len(data) > 0 {
+			if len(data) > aes.BlockSize {
+				mode.CryptBlocks(data[:aes.BlockSize], data[:aes.BlockSize])
+				data = data[aes.BlockSize:]
+			}
+			skip := sampleAESSkippedBytesPerSpan
+			if skip > len(data) {
+				skip = len(data)
+			}
+			data = data[skip:]
+		}
+		out = append(out, addEmulationPrevention(rbsp)...)
+	}
+	return out
+}
+
+// decryptAACSamples decrypts ADTS frames. The header and the following 16
+// bytes are clear, every complete block after that is encrypted
+func decryptAACSamples(stream []byte, block cipher.Block, iv []byte) []byte {
+	out := append([]byte{}, stream...)
+	for offset := 0; offset+7 <= len(out); {
+		frame := out[offset:]
+		if frame[0] != 0xff || frame[1]&0xf0 != 0xf0 {
+			break
+		}
+		headerLength := 7
+		if frame[1]&0x01 == 0 {
+			headerLength = 9
+		}
+		frameLength := int(frame[3]&0x03)<<11 | int(frame[4])<<3 | int(frame[5])>>5
+		if frameLength < headerLength || offset+frameLength > len(out) {
+			break
+		}
+
+		encrypted := frame[headerLength+sampleAESAudioClearLeader : frameLength]
+		if headerLength+sampleAESAudioClearLeader < frameLength {
+			blocks := len(encrypted) / aes.BlockSize * aes.BlockSize
+			if blocks > 0 {
+				cipher.NewCBCDecrypter(block, iv).CryptBlocks(encrypted[:blocks], encrypted[:blocks])
+			}
+		}
+		offset += frameLength
+	}
+	return out
+}
+
+// annexBUnit is a NAL unit together with the start code in front of it
+type annexBUnit struct {
+	prefix []byte
+	nal    []byte
+}
+
+// splitAnnexB splits a byte stream on its 3 and 4 byte start codes
+func splitAnnexB(stream []byte) []annexBUnit {
+	var units []annexBUnit
+	start, prefixStart := -1, 0
+	for i := 0; i+2 < len(stream); i++ {
+		if stream[i] != 0 || stream[i+1] != 0 || stream[i+2] != 1 {
+			continue
+		}
+		codeStart := i
+		if i > 0 && stream[i-1] == 0 {
+			codeStart = i - 1
+		}
+		if start >= 0 {
+			units = append(units, annexBUnit{prefix: stream[prefixStart:start], nal: stream[start:codeStart]})
+		} else if codeStart > 0 {
+			units = append(units, annexBUnit{nal: stream[:codeStart]})
+		}
+		prefixStart = codeStart
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 {
+		units = append(units, annexBUnit{prefix: stream[prefixStart:start], nal: stream[start:]})
+	} else if len(stream) > 0 {
+		units = append(units, annexBUnit{nal: stream})
+	}
+	return units
+}
+
+// removeEmulationPrevention drops the 0x03 bytes inserted after 0x0000
+func removeEmulationPrevention(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// addEmulationPrevention inserts 0x03 wherever 0x0000 is followed by a byte
+// that could be mistaken for a start code
+func addEmulationPrevention(rbsp []byte) []byte {
+	out := make([]byte, 0, len(rbsp)+len(rbsp)/64)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 0x03 {
+			out = append(out, 0x03)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// packetizePES splits a PES packet into transport stream packets for the PID
+// of the assembly, keeping the PCR and flags of the original first packet. It
+// returns the continuity counter for the next packet of the PID
+func packetizePES(out *bytes.Buffer, assembly *pesAssembly, pes []byte, continuity byte) byte {
+	first := true
+	for len(pes) > 0 {
+		packet := make([]byte, TS_PACKET_SIZE)
+		packet[0] = TS_SYNC_BYTE
+		packet[1] = byte(assembly.pid>>8) & 0x1f
+		if first {
+			packet[1] |= 0x40
+		}
+		packet[2] = byte(assembly.pid)
+		packet[3] = 0x10 | continuity&0x0f
+
+		var adaptation []byte
+		if first {
+			adaptation = essentialAdaptation(assembly.first.adaptation)
+		}
+
+		space := TS_PACKET_SIZE - 4
+		if adaptation != nil {
+			space -= 1 + len(adaptation)
+		}
+		if len(pes) < space {
+			// stuff the adaptation field so the payload fills the packet
+			if adaptation == nil {
+				adaptation = []byte{}
+				space--
+			}
+			stuffing := space - len(pes)
+			if len(adaptation) == 0 && stuffing > 0 {
+				adaptation = append(adaptation, 0x00)
+				stuffing--
+			}
+			for i := 0; i < stuffing; i++ {
+				adaptation = append(adaptation, 0xff)
+			}
+			space = len(pes)
+		}
+
+		offset := 4
+		if adaptation != nil {
+			packet[3] |= 0x20
+			packet[4] = byte(len(adaptation))
+			copy(packet[5:], adaptation)
+			offset += 1 + len(adaptation)
+		}
+		copy(packet[offset:], pes[:space])
+		out.Write(packet)
+
+		pes = pes[space:]
+		continuity = (continuity + 1) & 0x0f
+		first = false
+	}
+	return continuity
+}
+
+// essentialAdaptation keeps the flags and PCR of an adaptation field and drops
+// its optional fields and stuffing
+func essentialAdaptation(adaptation []byte) []byte {
+	if len(adaptation) == 0 {
+		return nil
+	}
+	flags := adaptation[0] & 0xf0
+	result := []byte{flags}
+	if flags&0x10 != 0 && len(adaptation) >= 7 {
+		result = append(result, adaptation[1:7]...)
+	} else {
+		result[0] &^= 0x10
+	}
+	return result
+}
+
+// mpegCRC32 computes the CRC used by PSI sections
+func mpegCRC32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,321 @@
+package stream
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	SELECT_BEST  = "best"
+	SELECT_WORST = "worst"
+)
+
+var (
+	heightRule     = regexp.MustCompile(`^(<=|>=|<|>|=)?(\d+)p$`)
+	resolutionRule = regexp.MustCompile(`^(\d+)x(\d+)$`)
+	attributeRule  = regexp.MustCompile(`^(bandwidth|bw|fps)(<=|>=|<|>|=)(\d+(?:\.\d+)?)([km]?)$`)
+)
+
+// codecAliases maps the codec names accepted in rules to the sample entry
+// types found in the CODECS attribute
+var codecAliases = map[string][]string{
+	"avc1": {"avc1", "avc3"},
+	"avc3": {"avc3"},
+	"h264": {"avc1", "avc3"},
+	"hvc1": {"hvc1", "hev1"},
+	"hev1": {"hev1"},
+	"hevc": {"hvc1", "hev1"},
+	"h265": {"hvc1", "hev1"},
+	"av01": {"av01"},
+	"av1":  {"av01"},
+	"vp09": {"vp09"},
+}
+
+// variantFilter keeps the variants matching a single rule
+type variantFilter struct {
+	rule  string
+	match func(variant *m3u8.Variant) bool
+}
+
+// renditionPolicy picks a variant of the master playlist from rules such as
+// "best", "<=720p,avc1" or "worst,fps>=50"
+type renditionPolicy struct {
+	expression string
+	worst      bool
+	filters    []variantFilter
+	codecs     []string
+}
+
+// parseRenditionPolicy parses comma separated selection rules:
+// best, worst, an exact WxH, a height such as 720p or <=720p, bandwidth<=3m,
+// fps<=30 and a preferred codec (avc1, hvc1, av01, ...)
+func parseRenditionPolicy(expression string) (*renditionPolicy, error) {
+	policy := &renditionPolicy{expression: expression}
+	for _, rule := range strings.FieldsFunc(strings.ToLower(expression), func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		rule := rule
+		if rule == SELECT_BEST || rule == SELECT_WORST {
+			policy.worst = rule == SELECT_WORST
+			continue
+		}
+		if match := resolutionRule.FindStringSubmatch(rule); match != nil {
+			policy.filters = append(policy.filters, variantFilter{rule, func(variant *m3u8.Variant) bool {
+				return strings.EqualFold(variant.Resolution, rule)
+			}})
+			continue
+		}
+		if match := heightRule.FindStringSubmatch(rule); match != nil {
+			height, _ := strconv.ParseFloat(match[2], 64)
+			operator := match[1]
+			policy.filters = append(policy.filters, variantFilter{rule, func(variant *m3u8.Variant) bool {
+				_, variantHeight := variantSize(variant)
+				return compare(float64(variantHeight), operator, height)
+			}})
+			continue
+		}
+		if match := attributeRule.FindStringSubmatch(rule); match != nil {
+			value, _ := strconv.ParseFloat(match[3], 64)
+			switch match[4] {
+			case "k":
+				value *= 1000
+			case "m":
+				value *= 1000000
+			}
+			attribute, operator := match[1], match[2]
+			policy.filters = append(policy.filters, variantFilter{rule, func(variant *m3u8.Variant) bool {
+				if attribute == "fps" {
+					return variant.FrameRate > 0 && compare(variant.FrameRate, operator, value)
+				}
+				return compare(float64(variant.Bandwidth), operator, value)
+			}})
+			continue
+		}
+		if _, ok := codecAliases[rule]; ok {
+			policy.codecs = append(policy.codecs, rule)
+			continue
+		}
+		return nil, fmt.Errorf("unknown rendition rule %q, use best, worst, WxH, <=720p, bandwidth<=3m, fps<=30 or a codec such as avc1 or hvc1", rule)
+	}
+	return policy, nil
+}
+
+// choose returns the variant picked by the policy along with the reason
+func (p *renditionPolicy) choose(variants []*m3u8.Variant) (*m3u8.Variant, string, error) {
+	candidates := []*m3u8.Variant{}
+	for _, variant := range variants {
+		if variant != nil && !variant.Iframe {
+			candidates = append(candidates, variant)
+		}
+	}
+
+	matched := []string{}
+	for _, filter := range p.filters {
+		remaining := []*m3u8.Variant{}
+		for _, variant := range candidates {
+			if filter.match(variant) {
+				remaining = append(remaining, variant)
+			}
+		}
+		candidates = remaining
+		matched = append(matched, filter.rule)
+	}
+	if len(candidates) == 0 {
+		available := []string{}
+		for _, variant := range variants {
+			if variant != nil && !variant.Iframe {
+				available = append(available, VariantDescription(variant))
+			}
+		}
+		return nil, "", fmt.Errorf("%w %s, choose from: %s", ErrNoRendition, p.expression, strings.Join(available, "; "))
+	}
+
+	// codec preferences only narrow the choice when a variant has the codec
+	notes := []string{}
+	for _, codec := range p.codecs {
+		preferred := []*m3u8.Variant{}
+		for _, variant := range candidates {
+			if hasCodec(variant, codecAliases[codec]) {
+				preferred = append(preferred, variant)
+			}
+		}
+		if len(preferred) == 0 {
+			notes = append(notes, fmt.Sprintf("no %s rendition", codec))
+			continue
+		}
+		candidates = preferred
+		matched = append(matched, codec)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if p.worst {
+			return variantRank(candidates[i], candidates[j])
+		}
+		return variantRank(candidates[j], candidates[i])
+	})
+
+	order := "highest"
+	if p.worst {
+		order = "lowest"
+	}
+	reason := fmt.Sprintf("%s of %d renditions", order, len(candidates))
+	if len(candidates) == 1 {
+		reason = "only rendition"
+	}
+	if len(matched) > 0 {
+		reason += " matching " + strings.Join(matched, ", ")
+	}
+	if len(notes) > 0 {
+		reason += " (" + strings.Join(notes, ", ") + ")"
+	}
+	return candidates[0], reason, nil
+}
+
+// compare applies a comparison operator of a rule, no operator means equal
+func compare(value float64, operator string, limit float64) bool {
+	switch operator {
+	case "<=":
+		return value <= limit
+	case ">=":
+		return value >= limit
+	case "<":
+		return value < limit
+	case ">":
+		return value > limit
+	}
+	return value == limit
+}
+
+// variantRank reports whether variant a ranks below b by pixel count, then
+// frame rate and then bandwidth
+func variantRank(a, b *m3u8.Variant) bool {
+	aWidth, aHeight := variantSize(a)
+	bWidth, bHeight := variantSize(b)
+	if aWidth*aHeight != bWidth*bHeight {
+		return aWidth*aHeight < bWidth*bHeight
+	}
+	if a.FrameRate != b.FrameRate {
+		return a.FrameRate < b.FrameRate
+	}
+	return a.Bandwidth < b.Bandwidth
+}
+
+// variantSize parses the RESOLUTION attribute of a variant
+func variantSize(variant *m3u8.Variant) (int, int) {
+	match := resolutionRule.FindStringSubmatch(strings.ToLower(variant.Resolution))
+	if match == nil {
+		return 0, 0
+	}
+	width, _ := strconv.Atoi(match[1])
+	height, _ := strconv.Atoi(match[2])
+	return width, height
+}
+
+// hasCodec reports whether the CODECS attribute of a variant lists one of
+// the sample entry types
+func hasCodec(variant *m3u8.Variant, types []string) bool {
+	for _, codec := range strings.Split(variant.Codecs, ",") {
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		for _, sampleEntry := range types {
+			if strings.HasPrefix(codec, sampleEntry) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// VariantDescription formats a variant for menus and messages, e.g.
+// 1280x720 (avc1.4d401f,mp4a.40.2, 2000 kbps, 30 fps)
+func VariantDescription(variant *m3u8.Variant) string {
+	details := []string{}
+	if variant.Codecs != "" {
+		details = append(details, variant.Codecs)
+	}
+	if variant.Bandwidth > 0 {
+		details = append(details, fmt.Sprintf("%d kbps", variant.Bandwidth/1000))
+	}
+	if variant.FrameRate > 0 {
+		details = append(details, fmt.Sprintf("%s fps", strconv.FormatFloat(variant.FrameRate, 'f', -1, 64)))
+	}
+	resolution := variant.Resolution
+	if resolution == "" {
+		resolution = "audio only"
+	}
+	if len(details) == 0 {
+		return resolution
+	}
+	return fmt.Sprintf("%s (%s)", resolution, strings.Join(details, ", "))
+}
+
+// Variants returns the variants of the master playlist, without the I-frame
+// only ones
+func (v *Video) Variants() []*m3u8.Variant {
+	variants := []*m3u8.Variant{}
+	for _, variant := range v.MasterPlaylist.Variants {
+		if variant != nil && !variant.Iframe {
+			variants = append(variants, variant)
+		}
+	}
+	return variants
+}
+
+// ChooseVariant returns the variant picked by selection rules such as best,
+// <=720p or worst,fps>=50 along with the reason for picking it
+func (v *Video) ChooseVariant(rules string) (*m3u8.Variant, string, error) {
+	policy, err := parseRenditionPolicy(rules)
+	if err != nil {
+		return nil, "", err
+	}
+	return policy.choose(v.MasterPlaylist.Variants)
+}
+
+// SelectVariant picks a variant with the selection rules, with
+// Client.PromptVariant when no rules are given or else the best one, and
+// sends the choice as an EVENT_SELECTED
+func (v *Video) SelectVariant(rules string) (*m3u8.Variant, error) {
+	var variant *m3u8.Variant
+	var reason string
+	var err error
+	switch {
+	case rules != "":
+		variant, reason, err = v.ChooseVariant(rules)
+	case v.client.PromptVariant != nil:
+		variant, reason, err = v.client.PromptVariant(v)
+	default:
+		variant, reason, err = v.ChooseVariant(SELECT_BEST)
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.emit(Event{Type: EVENT_SELECTED, Message: fmt.Sprintf("🎯 Selected %s: %s", VariantDescription(variant), reason)})
+	return variant, nil
+}
+
+// VariantManifestURL returns the signed manifest URL of variant
+func (v *Video) VariantManifestURL(variant *m3u8.Variant) (string, error) {
+	manifestURL, err := resolveURL(v.MasterManifestURL, variant.URI)
+	if err != nil {
+		return "", err
+	}
+	return v.signedURL(manifestURL), nil
+}
+
+// selectManifest returns the manifest URL and the variant picked by
+// SelectVariant
+func (v *Video) selectManifest(rules string) (string, *m3u8.Variant, error) {
+	variant, err := v.SelectVariant(rules)
+	if err != nil {
+		return "", nil, err
+	}
+	manifestURL, err := v.VariantManifestURL(variant)
+	if err != nil {
+		return "", nil, err
+	}
+	return manifestURL, variant, nil
+}
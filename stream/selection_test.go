@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+// testVariant returns a variant with the given attributes
+func testVariant(uri, resolution, codecs string, bandwidth uint32, frameRate float64) *m3u8.Variant {
+	return &m3u8.Variant{URI: uri, VariantParams: m3u8.VariantParams{
+		Resolution: resolution,
+		Codecs:     codecs,
+		Bandwidth:  bandwidth,
+		FrameRate:  frameRate,
+	}}
+}
+
+func TestParseRenditionPolicy(t *testing.T) {
+	tests := []struct {
+		expression string
+		worst      bool
+		filters    int
+		codecs     []string
+		wantErr    bool
+	}{
+		{"", false, 0, nil, false},
+		{"best", false, 0, nil, false},
+		{"WORST", true, 0, nil, false},
+		{"1280x720", false, 1, nil, false},
+		{"<=720p, avc1", false, 1, []string{"avc1"}, false},
+		{"worst,fps>=50,bandwidth<=3m", true, 2, nil, false},
+		{"bw>500k,hevc,av1", false, 1, []string{"hevc", "av1"}, false},
+		{"720", false, 0, nil, true},
+		{"fps~30", false, 0, nil, true},
+		{"vp8", false, 0, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			policy, err := parseRenditionPolicy(test.expression)
+			if test.wantErr {
+				if err == nil {
+					t.Error("parseRenditionPolicy() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy.worst != test.worst || len(policy.filters) != test.filters || len(policy.codecs) != len(test.codecs) {
+				t.Errorf("parseRenditionPolicy() = worst %v, %d filters, codecs %v, want worst %v, %d filters, codecs %v",
+					policy.worst, len(policy.filters), policy.codecs, test.worst, test.filters, test.codecs)
+			}
+			for idx, codec := range test.codecs {
+				if idx < len(policy.codecs) && policy.codecs[idx] != codec {
+					t.Errorf("codec %d = %s, want %s", idx, policy.codecs[idx], codec)
+				}
+			}
+		})
+	}
+}
+
+func TestChoose(t *testing.T) {
+	variants := []*m3u8.Variant{
+		testVariant("360.m3u8", "640x360", "avc1.4d401e,mp4a.40.2", 800000, 30),
+		testVariant("1080.m3u8", "1920x1080", "avc1.640028,mp4a.40.2", 5000000, 30),
+		testVariant("1080hevc.m3u8", "1920x1080", "hvc1.1.6.L120.90,mp4a.40.2", 3000000, 30),
+		testVariant("1080hfr.m3u8", "1920x1080", "avc1.640028,mp4a.40.2", 6000000, 60),
+		testVariant("480.m3u8", "854x480", "avc1.4d401e,mp4a.40.2", 1200000, 30),
+		{URI: "iframes.m3u8", VariantParams: m3u8.VariantParams{Iframe: true, Resolution: "3840x2160", Bandwidth: 100000}},
+		nil,
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		want       string
+	}{
+		{"highest", "best", "1080hfr.m3u8"},
+		{"no rules", "", "1080hfr.m3u8"},
+		{"lowest", "worst", "360.m3u8"},
+		{"exact resolution", "854x480", "480.m3u8"},
+		{"exact height", "=360p", "360.m3u8"},
+		{"closest below a height", "<=720p", "480.m3u8"},
+		{"closest above a height", "worst,>=720p", "1080hevc.m3u8"},
+		{"frame rate", "fps<=30", "1080.m3u8"},
+		{"bandwidth", "bandwidth<=1500k", "480.m3u8"},
+		{"preferred codec", "hevc", "1080hevc.m3u8"},
+		{"missing preferred codec", "1080p,av01", "1080hfr.m3u8"},
+		{"bandwidth breaks a tie on size and frame rate", "best,fps<=30,avc1", "1080.m3u8"},
+		{"lowest bandwidth breaks a tie on size and frame rate", "worst,1080p,fps<=30", "1080hevc.m3u8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := parseRenditionPolicy(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			variant, reason, err := policy.choose(variants)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if variant.URI != test.want {
+				t.Errorf("choose(%q) = %s (%s), want %s", test.expression, variant.URI, reason, test.want)
+			}
+		})
+	}
+
+	t.Run("equal variants keep the playlist order", func(t *testing.T) {
+		tied := []*m3u8.Variant{
+			testVariant("a.m3u8", "1280x720", "avc1", 2000000, 30),
+			testVariant("b.m3u8", "1280x720", "avc1", 2000000, 30),
+		}
+		for _, expression := range []string{"best", "worst"} {
+			policy, err := parseRenditionPolicy(expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if variant, _, err := policy.choose(tied); err != nil || variant.URI != "a.m3u8" {
+				t.Errorf("choose(%q) = %v, %v, want a.m3u8", expression, variant, err)
+			}
+		}
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		policy, err := parseRenditionPolicy("2160p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := policy.choose(variants); !errors.Is(err, ErrNoRendition) {
+			t.Errorf("choose() error = %v, want ErrNoRendition", err)
+		}
+	})
+}
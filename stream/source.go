@@ -0,0 +1,251 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	STREAM_DEFAULT_HOST  = "videodelivery.net"
+	STREAM_CUSTOMER_HOST = "cloudflarestream.com"
+)
+
+var (
+	// videoIDPattern matches a video UID or a signed token used in its place
+	videoIDPattern = regexp.MustCompile(`^[A-Za-z0-9_\-.]+$`)
+	// bareUIDPattern matches a video UID given without any URL around it
+	bareUIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+	// embedURLPattern finds Stream URLs inside an HTML page
+	embedURLPattern = regexp.MustCompile(`https?://[A-Za-z0-9.\-]*(?:cloudflarestream\.com|videodelivery\.net)/[^"'\s<>\\]+`)
+	// streamElementPattern finds the src of a <stream> element from the Stream web component
+	streamElementPattern = regexp.MustCompile(`<stream[^>]*\ssrc=["']([^"']+)["']`)
+)
+
+// Source is a video normalised from any of the supported input forms
+type Source struct {
+	ManifestURL string
+	BaseURL     string
+	UID         string
+	Token       string
+}
+
+// resolveStreamSource turns a bare UID, an embed, watch or thumbnail URL, a
+// DASH or HLS manifest URL or an HTML page embedding a Stream player into the
+// HLS manifest URL of the video. customer is the optional customer subdomain
+// used for bare UIDs and iframe.videodelivery.net embeds
+func (c *Client) resolveStreamSource(ctx context.Context, input, customer string) (*Source, error) {
+	return c.resolveStreamSourceDepth(ctx, strings.TrimSpace(input), customer, 0)
+}
+
+// resolveStreamSourceDepth guards against HTML pages pointing at other pages
+func (c *Client) resolveStreamSourceDepth(ctx context.Context, input, customer string, depth int) (*Source, error) {
+	if input == "" {
+		return nil, fmt.Errorf("%w: empty video URL", ErrInvalidInput)
+	}
+
+	if bareUIDPattern.MatchString(input) {
+		return cloudflareSource(customerOrigin(customer), input, ""), nil
+	}
+
+	parsedURL, err := url.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	if !parsedURL.IsAbs() || parsedURL.Host == "" {
+		return nil, fmt.Errorf("%w: %s is neither a video UID nor an absolute URL", ErrInvalidInput, input)
+	}
+
+	host := strings.ToLower(parsedURL.Hostname())
+	elements := strings.Split(strings.Trim(parsedURL.Path, "/"), "/")
+
+	switch {
+	case isStreamPlayerHost(host):
+		// iframe.videodelivery.net/<uid> and watch.cloudflarestream.com/<uid>
+		if id := findVideoID(elements); id != "" {
+			return cloudflareSource(customerOrigin(customer), id, ""), nil
+		}
+	case isStreamHost(host):
+		// <customer>.cloudflarestream.com/<uid>/{manifest,thumbnails,iframe,watch,...}
+		if id := findVideoID(elements); id != "" {
+			origin := fmt.Sprintf("%s://%s", parsedURL.Scheme, parsedURL.Host)
+			query := ""
+			if strings.HasSuffix(parsedURL.Path, ".m3u8") {
+				query = parsedURL.RawQuery
+			}
+			return cloudflareSource(origin, id, query), nil
+		}
+	case strings.HasSuffix(parsedURL.Path, ".m3u8"):
+		return genericManifestSource(parsedURL)
+	case strings.HasSuffix(parsedURL.Path, "/manifest/video.mpd"):
+		parsedURL.Path = strings.TrimSuffix(parsedURL.Path, ".mpd") + ".m3u8"
+		return genericManifestSource(parsedURL)
+	}
+
+	if depth > 0 {
+		return nil, fmt.Errorf("%w: no Stream video found at %s", ErrInvalidInput, input)
+	}
+	return c.resolveEmbeddingPage(ctx, input, customer, depth)
+}
+
+// resolveEmbeddingPage downloads an HTML page and resolves the first Stream
+// embed found in it
+func (c *Client) resolveEmbeddingPage(ctx context.Context, pageURL, customer string, depth int) (*Source, error) {
+	body, err := c.fetchURL(ctx, pageURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load page %s: %w", pageURL, err)
+	}
+	page := string(body)
+
+	var candidates []string
+	for _, match := range streamElementPattern.FindAllStringSubmatch(page, -1) {
+		candidates = append(candidates, match[1])
+	}
+	candidates = append(candidates, embedURLPattern.FindAllString(page, -1)...)
+
+	for _, candidate := range candidates {
+		candidate = strings.ReplaceAll(candidate, "&amp;", "&")
+		if source, err := c.resolveStreamSourceDepth(ctx, candidate, customer, depth+1); err == nil {
+			return source, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no Stream embed found on %s", ErrInvalidInput, pageURL)
+}
+
+// cloudflareSource builds the HLS manifest location for a video on a Stream host
+func cloudflareSource(origin, id, query string) *Source {
+	manifestURL := fmt.Sprintf("%s/%s/manifest/video.m3u8", origin, id)
+	if query != "" {
+		manifestURL += "?" + query
+	}
+	return withVideoID(&Source{
+		ManifestURL: manifestURL,
+		BaseURL:     origin,
+	}, id)
+}
+
+// genericManifestSource accepts manifests that don't follow Cloudflare's
+// layout, using the playlist's directory as base URL and the closest path
+// element as UID
+func genericManifestSource(parsedURL *url.URL) (*Source, error) {
+	origin := fmt.Sprintf("%s://%s", parsedURL.Scheme, parsedURL.Host)
+	regex := regexp.MustCompile(`^(.*)/([^/]+)/manifest/video\.m3u8$`)
+	if matches := regex.FindStringSubmatch(parsedURL.Path); len(matches) == 3 {
+		return withVideoID(&Source{
+			ManifestURL: parsedURL.String(),
+			BaseURL:     origin + matches[1],
+		}, matches[2]), nil
+	}
+
+	dir, file := path.Split(parsedURL.Path)
+	dir = strings.TrimSuffix(dir, "/")
+	uid := strings.TrimSuffix(file, path.Ext(file))
+	if parent := path.Base(dir); parent != "/" && parent != "." {
+		uid = parent
+	}
+	if uid == "" {
+		return nil, fmt.Errorf("%w: unable to derive a video UID", ErrInvalidInput)
+	}
+	return &Source{
+		ManifestURL: parsedURL.String(),
+		BaseURL:     origin + dir,
+		UID:         uid,
+	}, nil
+}
+
+// withVideoID sets the UID of a source, unpacking it from the sub claim when
+// the URL carries a signed token in place of the UID
+func withVideoID(source *Source, id string) *Source {
+	source.UID = id
+	if isSignedToken(id) {
+		if uid := uidFromToken(id); uid != "" {
+			source.UID = uid
+			source.Token = id
+		}
+	}
+	return source
+}
+
+// withToken returns a copy of the source whose manifest URL carries the
+// signed token in place of the video UID
+func (s *Source) withToken(token string) (*Source, error) {
+	parsedURL, err := url.Parse(s.ManifestURL)
+	if err != nil {
+		return nil, err
+	}
+
+	current := s.UID
+	if s.Token != "" {
+		current = s.Token
+	}
+	elements := strings.Split(parsedURL.Path, "/")
+	replaced := false
+	for idx, element := range elements {
+		if element == current {
+			elements[idx] = token
+			replaced = true
+		}
+	}
+	if !replaced {
+		return nil, fmt.Errorf("unable to place the token in %s: video UID %s not found in path", s.ManifestURL, s.UID)
+	}
+	parsedURL.Path = strings.Join(elements, "/")
+	parsedURL.RawPath = ""
+
+	return &Source{
+		ManifestURL: parsedURL.String(),
+		BaseURL:     s.BaseURL,
+		UID:         s.UID,
+		Token:       token,
+	}, nil
+}
+
+// customerOrigin expands a customer code, subdomain or domain into the origin
+// serving its videos
+func customerOrigin(customer string) string {
+	customer = strings.TrimSuffix(strings.TrimSpace(customer), "/")
+	switch {
+	case customer == "":
+		return "https://" + STREAM_DEFAULT_HOST
+	case strings.HasPrefix(customer, "http://"), strings.HasPrefix(customer, "https://"):
+		return customer
+	case strings.Contains(customer, "."):
+		return "https://" + customer
+	case strings.HasPrefix(customer, "customer-"):
+		return fmt.Sprintf("https://%s.%s", customer, STREAM_CUSTOMER_HOST)
+	default:
+		return fmt.Sprintf("https://customer-%s.%s", customer, STREAM_CUSTOMER_HOST)
+	}
+}
+
+// findVideoID returns the first path element that looks like a video UID
+func findVideoID(elements []string) string {
+	for _, element := range elements {
+		if element == "embed" || element == "" {
+			continue
+		}
+		if videoIDPattern.MatchString(element) && (bareUIDPattern.MatchString(element) || isSignedToken(element)) {
+			return element
+		}
+	}
+	return ""
+}
+
+// isStreamPlayerHost reports whether host only serves the Stream player
+func isStreamPlayerHost(host string) bool {
+	for _, prefix := range []string{"iframe.", "watch.", "embed."} {
+		if strings.HasPrefix(host, prefix) && isStreamHost(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStreamHost reports whether host belongs to Cloudflare Stream
+func isStreamHost(host string) bool {
+	return host == STREAM_DEFAULT_HOST || strings.HasSuffix(host, "."+STREAM_DEFAULT_HOST) ||
+		host == STREAM_CUSTOMER_HOST || strings.HasSuffix(host, "."+STREAM_CUSTOMER_HOST)
+}
@@ -0,0 +1,221 @@
+package stream
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+const (
+	testUID      = "0123456789abcdef0123456789abcdef"
+	testOtherUID = "fedcba9876543210fedcba9876543210"
+)
+
+// testToken is a signed token for testUID, its signature is never checked
+var testToken = "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"`+testUID+`"}`)) + ".c2lnbmF0dXJl"
+
+func TestResolveStreamSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		customer string
+		want     *Source
+	}{
+		{
+			"bare UID",
+			testUID, "",
+			&Source{ManifestURL: "https://videodelivery.net/" + testUID + "/manifest/video.m3u8", BaseURL: "https://videodelivery.net", UID: testUID},
+		},
+		{
+			"bare UID with a customer code",
+			" " + testUID + "\n", "abc123",
+			&Source{ManifestURL: "https://customer-abc123.cloudflarestream.com/" + testUID + "/manifest/video.m3u8", BaseURL: "https://customer-abc123.cloudflarestream.com", UID: testUID},
+		},
+		{
+			"bare UID with a custom domain",
+			testUID, "videos.example.com",
+			&Source{ManifestURL: "https://videos.example.com/" + testUID + "/manifest/video.m3u8", BaseURL: "https://videos.example.com", UID: testUID},
+		},
+		{
+			"watch URL",
+			"https://customer-abc123.cloudflarestream.com/" + testUID + "/watch", "",
+			&Source{ManifestURL: "https://customer-abc123.cloudflarestream.com/" + testUID + "/manifest/video.m3u8", BaseURL: "https://customer-abc123.cloudflarestream.com", UID: testUID},
+		},
+		{
+			"watch host",
+			"https://watch.cloudflarestream.com/" + testUID, "",
+			&Source{ManifestURL: "https://videodelivery.net/" + testUID + "/manifest/video.m3u8", BaseURL: "https://videodelivery.net", UID: testUID},
+		},
+		{
+			"iframe embed with a customer code",
+			"https://iframe.videodelivery.net/embed/" + testUID + "?autoplay=true", "abc123",
+			&Source{ManifestURL: "https://customer-abc123.cloudflarestream.com/" + testUID + "/manifest/video.m3u8", BaseURL: "https://customer-abc123.cloudflarestream.com", UID: testUID},
+		},
+		{
+			"iframe URL on a customer subdomain",
+			"https://customer-abc123.cloudflarestream.com/" + testUID + "/iframe", "",
+			&Source{ManifestURL: "https://customer-abc123.cloudflarestream.com/" + testUID + "/manifest/video.m3u8", BaseURL: "https://customer-abc123.cloudflarestream.com", UID: testUID},
+		},
+		{
+			"manifest URL keeps its query",
+			"https://customer-abc123.cloudflarestream.com/" + testUID + "/manifest/video.m3u8?clientBandwidthHint=10", "",
+			&Source{ManifestURL: "https://customer-abc123.cloudflarestream.com/" + testUID + "/manifest/video.m3u8?clientBandwidthHint=10", BaseURL: "https://customer-abc123.cloudflarestream.com", UID: testUID},
+		},
+		{
+			"thumbnail URL drops its query",
+			"https://videodelivery.net/" + testUID + "/thumbnails/thumbnail.jpg?time=1s", "",
+			&Source{ManifestURL: "https://videodelivery.net/" + testUID + "/manifest/video.m3u8", BaseURL: "https://videodelivery.net", UID: testUID},
+		},
+		{
+			"DASH manifest",
+			"https://videos.example.com/" + testUID + "/manifest/video.mpd", "",
+			&Source{ManifestURL: "https://videos.example.com/" + testUID + "/manifest/video.m3u8", BaseURL: "https://videos.example.com", UID: testUID},
+		},
+		{
+			"manifest on a custom domain",
+			"https://videos.example.com/stream/" + testUID + "/manifest/video.m3u8", "",
+			&Source{ManifestURL: "https://videos.example.com/stream/" + testUID + "/manifest/video.m3u8", BaseURL: "https://videos.example.com/stream", UID: testUID},
+		},
+		{
+			"signed token manifest URL",
+			"https://customer-abc123.cloudflarestream.com/" + testToken + "/manifest/video.m3u8", "",
+			&Source{ManifestURL: "https://customer-abc123.cloudflarestream.com/" + testToken + "/manifest/video.m3u8", BaseURL: "https://customer-abc123.cloudflarestream.com", UID: testUID, Token: testToken},
+		},
+		{
+			"signed token iframe embed",
+			"https://iframe.videodelivery.net/" + testToken, "",
+			&Source{ManifestURL: "https://videodelivery.net/" + testToken + "/manifest/video.m3u8", BaseURL: "https://videodelivery.net", UID: testUID, Token: testToken},
+		},
+		{
+			"signed token manifest on a custom domain",
+			"https://videos.example.com/" + testToken + "/manifest/video.m3u8", "",
+			&Source{ManifestURL: "https://videos.example.com/" + testToken + "/manifest/video.m3u8", BaseURL: "https://videos.example.com", UID: testUID, Token: testToken},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NewClient().resolveStreamSource(context.Background(), test.input, test.customer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("resolveStreamSource() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveStreamSourceInvalid(t *testing.T) {
+	for _, input := range []string{"", "   ", "not-a-uid", "/relative/manifest/video.m3u8"} {
+		if source, err := NewClient().resolveStreamSource(context.Background(), input, ""); err == nil {
+			t.Errorf("resolveStreamSource(%q) = %+v, want an error", input, source)
+		}
+	}
+}
+
+func TestCustomerOrigin(t *testing.T) {
+	tests := []struct {
+		customer string
+		want     string
+	}{
+		{"", "https://videodelivery.net"},
+		{"abc123", "https://customer-abc123.cloudflarestream.com"},
+		{"customer-abc123", "https://customer-abc123.cloudflarestream.com"},
+		{"customer-abc123.cloudflarestream.com", "https://customer-abc123.cloudflarestream.com"},
+		{"videos.example.com", "https://videos.example.com"},
+		{" https://videos.example.com/ ", "https://videos.example.com"},
+		{"http://localhost:8080", "http://localhost:8080"},
+	}
+	for _, test := range tests {
+		if got := customerOrigin(test.customer); got != test.want {
+			t.Errorf("customerOrigin(%q) = %s, want %s", test.customer, got, test.want)
+		}
+	}
+}
+
+func TestFindVideoID(t *testing.T) {
+	tests := []struct {
+		name     string
+		elements []string
+		want     string
+	}{
+		{"UID", []string{testUID, "manifest", "video.m3u8"}, testUID},
+		{"embed prefix", []string{"embed", testUID}, testUID},
+		{"first UID wins", []string{testUID, testOtherUID}, testUID},
+		{"signed token", []string{testToken, "manifest", "video.m3u8"}, testToken},
+		{"UID after other elements", []string{"", "stream", testUID, "watch"}, testUID},
+		{"short hex", []string{"0123456789abcdef", "watch"}, ""},
+		{"no UID", []string{"manifest", "video.m3u8"}, ""},
+		{"empty", nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := findVideoID(test.elements); got != test.want {
+				t.Errorf("findVideoID(%v) = %q, want %q", test.elements, got, test.want)
+			}
+		})
+	}
+}
+
+func TestGenericManifestSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     *Source
+		wantErr  bool
+	}{
+		{
+			"Stream layout",
+			"https://cdn.example.com/videos/" + testUID + "/manifest/video.m3u8?token=1",
+			&Source{ManifestURL: "https://cdn.example.com/videos/" + testUID + "/manifest/video.m3u8?token=1", BaseURL: "https://cdn.example.com/videos", UID: testUID},
+			false,
+		},
+		{
+			"Stream layout with a signed token",
+			"https://cdn.example.com/" + testToken + "/manifest/video.m3u8",
+			&Source{ManifestURL: "https://cdn.example.com/" + testToken + "/manifest/video.m3u8", BaseURL: "https://cdn.example.com", UID: testUID, Token: testToken},
+			false,
+		},
+		{
+			"playlist directory",
+			"https://cdn.example.com/live/event42/index.m3u8",
+			&Source{ManifestURL: "https://cdn.example.com/live/event42/index.m3u8", BaseURL: "https://cdn.example.com/live/event42", UID: "event42"},
+			false,
+		},
+		{
+			"playlist at the root",
+			"https://cdn.example.com/show.m3u8",
+			&Source{ManifestURL: "https://cdn.example.com/show.m3u8", BaseURL: "https://cdn.example.com", UID: "show"},
+			false,
+		},
+		{
+			"no name",
+			"https://cdn.example.com/.m3u8",
+			nil,
+			true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsedURL, err := url.Parse(test.manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := genericManifestSource(parsedURL)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("genericManifestSource() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("genericManifestSource() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	SUBTITLES_SIDECAR = "sidecar"
+	SUBTITLES_EMBED   = "embed"
+	SUBTITLES_NONE    = "none"
+)
+
+// webVTTCue is a single cue of a WebVTT segment with its timing in seconds
+type webVTTCue struct {
+	Start    float64
+	End      float64
+	Settings string
+	Payload  string
+}
+
+// webVTTTimestampMap is the X-TIMESTAMP-MAP header HLS adds to WebVTT segments
+// to map their cue times onto the MPEG-2 timestamps of the media
+var webVTTTimestampMap = regexp.MustCompile(`MPEGTS:(\d+)`)
+var webVTTTimestampLocal = regexp.MustCompile(`LOCAL:([0-9:.]+)`)
+
+// webVTTBlockSeparator splits WebVTT files on blank lines
+var webVTTBlockSeparator = regexp.MustCompile(`\n{2,}`)
+
+// downloadSubtitles downloads the subtitles renditions and stitches their
+// WebVTT segments into one file per language in the output directory
+func (v *Video) downloadSubtitles(ctx context.Context, renditions []*m3u8.Alternative, output renditionOutput, clip Clip) ([]mediaTrack, error) {
+	tracks := []mediaTrack{}
+	for _, rendition := range renditionNames("subtitles", renditions) {
+		media, label := rendition.media, rendition.label
+		v.printf("💬 Downloading %s subtitles (%s)\n", media.Name, label)
+
+		manifestURL, err := resolveURL(v.MasterManifestURL, media.URI)
+		if err != nil {
+			return nil, fmt.Errorf("there was a problem resolving the subtitles manifest: %w", err)
+		}
+		segmentPaths, err := v.downloadSubtitleSegments(ctx, v.signedURL(manifestURL), output.directory, label, clip)
+		if err != nil {
+			return nil, err
+		}
+
+		outputPath := output.path("subtitles."+label, "vtt")
+		if err := stitchWebVTT(segmentPaths, outputPath, clip); err != nil {
+			return nil, fmt.Errorf("there was a problem stitching the %s subtitles: %w", label, err)
+		}
+		tracks = append(tracks, mediaTrack{
+			Language: media.Language,
+			Name:     media.Name,
+			Path:     outputPath,
+		})
+	}
+	return tracks, nil
+}
+
+// downloadSubtitleSegments downloads the WebVTT segments of a subtitles
+// playlist covering clip and returns their local paths in playlist order
+func (v *Video) downloadSubtitleSegments(ctx context.Context, manifestURL, directory, label string, clip Clip) ([]string, error) {
+	body, err := v.fetchURL(ctx, manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(body), false)
+	if err != nil {
+		return nil, err
+	}
+	if listType != m3u8.MEDIA {
+		return nil, errors.New("expected a subtitles media playlist")
+	}
+	mediaPlaylist := playlist.(*m3u8.MediaPlaylist)
+
+	segmentURLs := []string{}
+	segmentPaths := []string{}
+	segmentKeys := []*segmentEncryption{}
+	var currentKey *m3u8.Key
+	var segmentStart float64
+	for idx, segment := range mediaPlaylist.Segments {
+		if segment == nil {
+			continue
+		}
+		if segment.Key != nil {
+			currentKey = segment.Key
+		}
+		segmentStart += segment.Duration
+		if clip.IsSet() && !clip.covers(segmentStart-segment.Duration, segment.Duration) {
+			continue
+		}
+		segmentURL, err := resolveURL(manifestURL, segment.URI)
+		if err != nil {
+			return nil, err
+		}
+		sequence := mediaPlaylist.SeqNo + uint64(idx)
+		encryption, err := v.segmentEncryption(ctx, currentKey, manifestURL, sequence)
+		if err != nil {
+			return nil, err
+		}
+		segmentURLs = append(segmentURLs, v.signedURL(segmentURL))
+		segmentPaths = append(segmentPaths, fmt.Sprintf("%s/segments/subtitles_%s_seg_%d.vtt", directory, label, sequence))
+		segmentKeys = append(segmentKeys, encryption)
+	}
+
+	if err := v.fetchSegments(ctx, segmentIndexes(len(segmentURLs)), segmentURLs, segmentPaths, segmentKeys, nil, nil); err != nil {
+		return nil, err
+	}
+	return segmentPaths, nil
+}
+
+// stitchWebVTT joins WebVTT segments into a single file. Cue times are moved
+// onto the timeline of the first segment when the X-TIMESTAMP-MAP changes,
+// and cues repeated in neighbouring segments are written only once. When clip
+// is set the cues are cut to it and start at its beginning
+func stitchWebVTT(segmentPaths []string, outputPath string, clip Clip) error {
+	cues := []webVTTCue{}
+	headerBlocks := []string{}
+	seen := make(map[webVTTCue]bool)
+	var baseOffset float64
+	for idx, segmentPath := range segmentPaths {
+		data, err := os.ReadFile(segmentPath)
+		if err != nil {
+			return err
+		}
+		blocks := webVTTBlocks(string(data))
+		if len(blocks) == 0 || !strings.HasPrefix(blocks[0], "WEBVTT") {
+			return fmt.Errorf("%s is not a WebVTT file", segmentPath)
+		}
+
+		offset, err := webVTTOffset(blocks[0])
+		if err != nil {
+			return fmt.Errorf("%s: %v", segmentPath, err)
+		}
+		if idx == 0 {
+			baseOffset = offset
+		}
+		shift := offset - baseOffset
+
+		for _, block := range blocks[1:] {
+			if !strings.Contains(block, "-->") {
+				// STYLE and REGION blocks have to precede the first cue
+				if idx == 0 && (strings.HasPrefix(block, "STYLE") || strings.HasPrefix(block, "REGION")) {
+					headerBlocks = append(headerBlocks, block)
+				}
+				continue
+			}
+			cue, err := parseWebVTTCue(block)
+			if err != nil {
+				return fmt.Errorf("%s: %v", segmentPath, err)
+			}
+			cue.Start += shift
+			cue.End += shift
+			if clip.IsSet() {
+				if !clip.covers(cue.Start, cue.End-cue.Start) {
+					continue
+				}
+				cue.Start = math.Max(cue.Start-clip.Start, 0)
+				cue.End -= clip.Start
+				if clip.End > 0 {
+					cue.End = math.Min(cue.End, clip.End-clip.Start)
+				}
+			}
+			if seen[cue] {
+				continue
+			}
+			seen[cue] = true
+			cues = append(cues, cue)
+		}
+	}
+	sort.SliceStable(cues, func(i, j int) bool {
+		return cues[i].Start < cues[j].Start
+	})
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	writer := bufio.NewWriter(out)
+	fmt.Fprint(writer, "WEBVTT\n\n")
+	for _, block := range headerBlocks {
+		fmt.Fprintf(writer, "%s\n\n", block)
+	}
+	for _, cue := range cues {
+		timing := fmt.Sprintf("%s --> %s", formatWebVTTTime(cue.Start), formatWebVTTTime(cue.End))
+		if cue.Settings != "" {
+			timing += " " + cue.Settings
+		}
+		fmt.Fprintf(writer, "%s\n%s\n\n", timing, cue.Payload)
+	}
+	return writer.Flush()
+}
+
+// webVTTBlocks splits a WebVTT file into its blank line separated blocks
+func webVTTBlocks(data string) []string {
+	data = strings.TrimPrefix(data, "\ufeff")
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+
+	blocks := []string{}
+	for _, block := range webVTTBlockSeparator.Split(data, -1) {
+		block = strings.Trim(block, "\n")
+		if block != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// webVTTOffset returns the media time in seconds at which the cue times of a
+// segment start, based on its X-TIMESTAMP-MAP header
+func webVTTOffset(header string) (float64, error) {
+	for _, line := range strings.Split(header, "\n") {
+		if !strings.HasPrefix(line, "X-TIMESTAMP-MAP=") {
+			continue
+		}
+		var mpegts, local float64
+		if match := webVTTTimestampMap.FindStringSubmatch(line); match != nil {
+			value, err := strconv.ParseUint(match[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			mpegts = float64(value) / 90000
+		}
+		if match := webVTTTimestampLocal.FindStringSubmatch(line); match != nil {
+			value, err := parseWebVTTTime(match[1])
+			if err != nil {
+				return 0, err
+			}
+			local = value
+		}
+		return mpegts - local, nil
+	}
+	return 0, nil
+}
+
+// parseWebVTTCue parses the optional identifier, timing line and payload of
+// a cue block. The identifier is dropped since segments reuse them
+func parseWebVTTCue(block string) (webVTTCue, error) {
+	lines := strings.Split(block, "\n")
+	if !strings.Contains(lines[0], "-->") {
+		lines = lines[1:]
+	}
+
+	timing := strings.Fields(lines[0])
+	if len(timing) < 3 || timing[1] != "-->" {
+		return webVTTCue{}, fmt.Errorf("invalid cue timing %q", lines[0])
+	}
+	start, err := parseWebVTTTime(timing[0])
+	if err != nil {
+		return webVTTCue{}, err
+	}
+	end, err := parseWebVTTTime(timing[2])
+	if err != nil {
+		return webVTTCue{}, err
+	}
+	return webVTTCue{
+		Start:    start,
+		End:      end,
+		Settings: strings.Join(timing[3:], " "),
+		Payload:  strings.Join(lines[1:], "\n"),
+	}, nil
+}
+
+// parseWebVTTTime parses a hh:mm:ss.ttt or mm:ss.ttt timestamp into seconds
+func parseWebVTTTime(value string) (float64, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+	var seconds float64
+	for _, part := range parts {
+		number, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+		seconds = seconds*60 + number
+	}
+	return seconds, nil
+}
+
+// formatWebVTTTime formats seconds as a hh:mm:ss.ttt timestamp
+func formatWebVTTTime(seconds float64) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	millis := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
@@ -0,0 +1,346 @@
+package stream
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_TOKEN_EXPIRES_IN is the lifetime of a minted token when
+	// TokenOptions.ExpiresIn isn't set
+	DEFAULT_TOKEN_EXPIRES_IN = time.Hour
+	// TOKEN_RENEW_MARGIN is how long before its exp claim a minted token is
+	// replaced, at most a quarter of its lifetime
+	TOKEN_RENEW_MARGIN = 5 * time.Minute
+)
+
+// TokenOptions gives access to videos that require signed URLs. Token is
+// placed in the URLs as is, otherwise a token is minted locally when the
+// signing key is set
+type TokenOptions struct {
+	Token string
+	// SigningKeyID and SigningKeyPEM are the ID and the key returned by the
+	// Stream signing keys API. The key can be base64 encoded PEM, a PEM
+	// string or a path to a PEM file
+	SigningKeyID  string
+	SigningKeyPEM string
+	// ExpiresIn and NotBefore set the exp and nbf claims relative to now,
+	// ExpiresIn is DEFAULT_TOKEN_EXPIRES_IN when 0
+	ExpiresIn time.Duration
+	NotBefore time.Duration
+	// AccessRules is a JSON array of access rules, or @path to a JSON file
+	AccessRules  string
+	Downloadable bool
+}
+
+// streamTokenClaims is the payload of a Stream signed URL token
+type streamTokenClaims struct {
+	Sub          string            `json:"sub"`
+	Kid          string            `json:"kid"`
+	Exp          int64             `json:"exp,omitempty"`
+	Nbf          int64             `json:"nbf,omitempty"`
+	AccessRules  []json.RawMessage `json:"accessRules,omitempty"`
+	Downloadable bool              `json:"downloadable,omitempty"`
+}
+
+// apply returns source with the video UID replaced by the given token or by
+// a token minted with the signing key
+func (o TokenOptions) apply(source *Source) (*Source, error) {
+	token := o.Token
+	if token == "" && o.SigningKeyID == "" && o.SigningKeyPEM == "" {
+		return source, nil
+	}
+
+	if token == "" {
+		if o.SigningKeyID == "" || o.SigningKeyPEM == "" {
+			return nil, errors.New("both a signing key ID and a signing key are required to mint a token")
+		}
+		minted, err := o.mint(source.UID)
+		if err != nil {
+			return nil, fmt.Errorf("there was a problem minting the signed URL token: %w", err)
+		}
+		token = minted
+	}
+	return source.withToken(token)
+}
+
+// renewer returns the renewer of the token minted for source, nil when the
+// token of source is not minted with the signing key
+func (o TokenOptions) renewer(source *Source) *tokenRenewer {
+	if o.Token != "" || o.SigningKeyID == "" || o.SigningKeyPEM == "" || source.Token == "" {
+		return nil
+	}
+	renewer := &tokenRenewer{options: o, uid: source.UID}
+	renewer.use(source.Token)
+	return renewer
+}
+
+// expiresIn returns the lifetime of a minted token
+func (o TokenOptions) expiresIn() time.Duration {
+	if o.ExpiresIn == 0 {
+		return DEFAULT_TOKEN_EXPIRES_IN
+	}
+	return o.ExpiresIn
+}
+
+// mint creates an RS256 Stream token for the video UID
+func (o TokenOptions) mint(uid string) (string, error) {
+	key, err := parseSigningKey(o.SigningKeyPEM)
+	if err != nil {
+		return "", err
+	}
+
+	expiresIn := o.expiresIn()
+	if expiresIn < 0 {
+		return "", fmt.Errorf("the token lifetime must be positive, got %s", expiresIn)
+	}
+
+	now := time.Now()
+	claims := streamTokenClaims{
+		Sub:          uid,
+		Kid:          o.SigningKeyID,
+		Exp:          now.Add(expiresIn).Unix(),
+		Downloadable: o.Downloadable,
+	}
+	if o.NotBefore != 0 {
+		claims.Nbf = now.Add(o.NotBefore).Unix()
+	}
+	if o.AccessRules != "" {
+		rules := []byte(o.AccessRules)
+		if strings.HasPrefix(o.AccessRules, "@") {
+			rules, err = os.ReadFile(strings.TrimPrefix(o.AccessRules, "@"))
+			if err != nil {
+				return "", err
+			}
+		}
+		if err := json.Unmarshal(rules, &claims.AccessRules); err != nil {
+			return "", fmt.Errorf("invalid access rules: %v", err)
+		}
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": o.SigningKeyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseSigningKey loads an RSA private key from a file path, a PEM string or
+// the base64 encoded PEM returned by the Stream signing keys API
+func parseSigningKey(value string) (*rsa.PrivateKey, error) {
+	data := []byte(strings.TrimSpace(value))
+	if info, err := os.Stat(value); err == nil && !info.IsDir() {
+		contents, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		data = []byte(strings.TrimSpace(string(contents)))
+	}
+	if !strings.HasPrefix(string(data), "-----BEGIN") {
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return nil, errors.New("signing key is neither PEM nor base64 encoded PEM")
+		}
+		data = decoded
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found in signing key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse signing key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an RSA key")
+	}
+	return key, nil
+}
+
+// isSignedToken reports whether id is a JWT rather than a plain video UID
+func isSignedToken(id string) bool {
+	return strings.Count(id, ".") == 2
+}
+
+// uidFromToken extracts the video UID from the sub claim of a token without
+// verifying its signature
+func uidFromToken(token string) string {
+	return tokenClaims(token).Sub
+}
+
+// tokenClaims decodes the claims of a token without verifying its
+// signature, the claims are empty when token is not a JWT
+func tokenClaims(token string) streamTokenClaims {
+	claims := streamTokenClaims{}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return claims
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return streamTokenClaims{}
+	}
+	return claims
+}
+
+// tokenRenewer mints a new token for a video before the current one expires,
+// or when the server rejects it, so downloads and recordings can outlive the
+// lifetime of a token
+type tokenRenewer struct {
+	options TokenOptions
+	uid     string
+
+	mu      sync.Mutex
+	token   string
+	renewAt time.Time
+}
+
+// current returns the token to sign the next request with, renewing it when
+// it is about to expire
+func (r *tokenRenewer) current() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.renewAt.IsZero() && time.Now().After(r.renewAt) {
+		// a failed renewal keeps the token, the request fails on its own
+		// when it expired
+		r.mint()
+	}
+	return r.token
+}
+
+// renew replaces the token rejected by the server, it reports whether a
+// token other than rejected can be used. Requests failing together with the
+// same token renew it only once
+func (r *tokenRenewer) renew(rejected string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.token == rejected {
+		r.mint()
+	}
+	return r.token != rejected
+}
+
+// mint replaces the token with a new one, it is called with mu held
+func (r *tokenRenewer) mint() {
+	token, err := r.options.mint(r.uid)
+	if err != nil {
+		return
+	}
+	r.use(token)
+}
+
+// use sets the token and the time to renew it from its exp claim
+func (r *tokenRenewer) use(token string) {
+	r.token = token
+	r.renewAt = time.Time{}
+	if exp := tokenClaims(token).Exp; exp > 0 {
+		margin := r.options.expiresIn() / 4
+		if margin > TOKEN_RENEW_MARGIN {
+			margin = TOKEN_RENEW_MARGIN
+		}
+		r.renewAt = time.Unix(exp, 0).Add(-margin)
+	}
+}
+
+// token returns the token signing the requests of the video
+func (v *Video) token() string {
+	if v.tokens != nil {
+		return v.tokens.current()
+	}
+	return v.Token
+}
+
+// signedURL replaces the video UID in a request URL with the signed token so
+// every manifest, key and segment request is authorised
+func (v *Video) signedURL(requestURL string) string {
+	return v.signURL(requestURL, v.token())
+}
+
+// signURL places token in requestURL in place of the video UID or of an
+// earlier token of the video
+func (v *Video) signURL(requestURL, token string) string {
+	if token == "" {
+		return requestURL
+	}
+	parsedURL, err := url.Parse(requestURL)
+	if err != nil {
+		return requestURL
+	}
+
+	elements := strings.Split(parsedURL.Path, "/")
+	for idx, element := range elements {
+		if element == v.VideoUID || (isSignedToken(element) && uidFromToken(element) == v.VideoUID) {
+			elements[idx] = token
+		}
+	}
+	parsedURL.Path = strings.Join(elements, "/")
+	parsedURL.RawPath = ""
+	return parsedURL.String()
+}
+
+// authorized runs request with requestURL signed by the current token. When
+// the server rejects a minted token, request runs once more with a new one
+func (v *Video) authorized(requestURL string, request func(signedURL string) error) error {
+	token := v.token()
+	err := request(v.signURL(requestURL, token))
+
+	var statusErr *HTTPStatusError
+	if v.tokens == nil || !errors.As(err, &statusErr) {
+		return err
+	}
+	if statusErr.StatusCode != http.StatusUnauthorized && statusErr.StatusCode != http.StatusForbidden {
+		return err
+	}
+	if !v.tokens.renew(token) {
+		return err
+	}
+	return request(v.signURL(requestURL, v.tokens.current()))
+}
+
+// fetchURL downloads a small resource of the video such as a playlist or a
+// key into memory
+func (v *Video) fetchURL(ctx context.Context, requestURL string) ([]byte, error) {
+	var body []byte
+	err := v.authorized(requestURL, func(signedURL string) error {
+		var err error
+		body, err = v.client.fetchURL(ctx, signedURL)
+		return err
+	})
+	return body, err
+}
@@ -0,0 +1,242 @@
+package stream
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigningKey returns an RSA key along with its PKCS1 PEM encoding
+func testSigningKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	return key, string(pem.EncodeToMemory(block))
+}
+
+// decodeTokenPart decodes the base64url JSON of a token part into value
+func decodeTokenPart(t *testing.T, part string, value interface{}) {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMint(t *testing.T) {
+	key, keyPEM := testSigningKey(t)
+	opts := TokenOptions{
+		SigningKeyID:  "key-id",
+		SigningKeyPEM: keyPEM,
+		ExpiresIn:     10 * time.Minute,
+		NotBefore:     -time.Minute,
+		AccessRules:   `[{"type":"ip.geoip.country","action":"allow","country":["US"]}]`,
+		Downloadable:  true,
+	}
+	now := time.Now()
+	token, err := opts.mint("video-uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token has %d parts, want 3", len(parts))
+	}
+	header := map[string]string{}
+	decodeTokenPart(t, parts[0], &header)
+	if header["alg"] != "RS256" || header["kid"] != "key-id" {
+		t.Errorf("header = %v, want alg RS256 and kid key-id", header)
+	}
+
+	claims := streamTokenClaims{}
+	decodeTokenPart(t, parts[1], &claims)
+	if claims.Sub != "video-uid" || claims.Kid != "key-id" || !claims.Downloadable {
+		t.Errorf("claims = %+v, want sub video-uid, kid key-id and downloadable", claims)
+	}
+	if exp := time.Unix(claims.Exp, 0); exp.Sub(now.Add(10*time.Minute)).Abs() > 2*time.Second {
+		t.Errorf("exp = %s, want about %s", exp, now.Add(10*time.Minute))
+	}
+	if nbf := time.Unix(claims.Nbf, 0); nbf.Sub(now.Add(-time.Minute)).Abs() > 2*time.Second {
+		t.Errorf("nbf = %s, want about %s", nbf, now.Add(-time.Minute))
+	}
+	if len(claims.AccessRules) != 1 {
+		t.Errorf("accessRules has %d rules, want 1", len(claims.AccessRules))
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("signature doesn't verify with the public key: %v", err)
+	}
+}
+
+func TestParseSigningKey(t *testing.T) {
+	key, keyPEM := testSigningKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8PEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	keyPath := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyPath, []byte(keyPEM), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"PEM", keyPEM, false},
+		{"PEM with surrounding whitespace", "\n  " + keyPEM + "\n", false},
+		{"base64 encoded PEM", base64.StdEncoding.EncodeToString([]byte(keyPEM)), false},
+		{"PKCS8 PEM", pkcs8PEM, false},
+		{"file", keyPath, false},
+		{"neither PEM nor base64", "not a key!", true},
+		{"base64 without a PEM block", base64.StdEncoding.EncodeToString([]byte("not a key")), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := parseSigningKey(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Error("parseSigningKey() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !parsed.Equal(key) {
+				t.Error("parseSigningKey() returned another key")
+			}
+		})
+	}
+}
+
+func TestUIDFromToken(t *testing.T) {
+	_, keyPEM := testSigningKey(t)
+	token, err := TokenOptions{SigningKeyID: "key-id", SigningKeyPEM: keyPEM}.mint("video-uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"minted token", token, "video-uid"},
+		{"padded payload", "a." + base64.URLEncoding.EncodeToString([]byte(`{"sub":"padded"}`)) + ".c", "padded"},
+		{"plain UID", "video-uid", ""},
+		{"payload not base64", "a.!!!.c", ""},
+		{"payload not JSON", "a." + base64.RawURLEncoding.EncodeToString([]byte("sub")) + ".c", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := uidFromToken(test.token); got != test.want {
+				t.Errorf("uidFromToken() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	_, keyPEM := testSigningKey(t)
+	earlier, err := TokenOptions{SigningKeyID: "key-id", SigningKeyPEM: keyPEM, ExpiresIn: time.Minute}.mint("video-uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := &Video{VideoUID: "video-uid", Token: "header.payload.signature"}
+
+	tests := []struct {
+		name       string
+		video      *Video
+		requestURL string
+		want       string
+	}{
+		{"UID in the path", video, "https://example.com/video-uid/manifest/video.m3u8", "https://example.com/header.payload.signature/manifest/video.m3u8"},
+		{"query is kept", video, "https://example.com/video-uid/seg_1.ts?clientBandwidthHint=1", "https://example.com/header.payload.signature/seg_1.ts?clientBandwidthHint=1"},
+		{"earlier token of the video", video, "https://example.com/" + earlier + "/seg_1.ts", "https://example.com/header.payload.signature/seg_1.ts"},
+		{"another video", video, "https://example.com/other-uid/seg_1.ts", "https://example.com/other-uid/seg_1.ts"},
+		{"no token", &Video{VideoUID: "video-uid"}, "https://example.com/video-uid/seg_1.ts", "https://example.com/video-uid/seg_1.ts"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.video.signedURL(test.requestURL); got != test.want {
+				t.Errorf("signedURL() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTokenRenewal(t *testing.T) {
+	_, keyPEM := testSigningKey(t)
+	opts := TokenOptions{SigningKeyID: "key-id", SigningKeyPEM: keyPEM}
+	// the token expires within the renewal margin of a one hour token
+	expiring, err := TokenOptions{SigningKeyID: "key-id", SigningKeyPEM: keyPEM, ExpiresIn: time.Minute}.mint("video-uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewer := opts.renewer(&Source{UID: "video-uid", Token: expiring})
+	renewed := renewer.current()
+	if renewed == expiring || uidFromToken(renewed) != "video-uid" {
+		t.Fatalf("current() = %s, want a new token for video-uid", renewed)
+	}
+	if renewer.current() != renewed {
+		t.Error("current() renewed a fresh token")
+	}
+
+	t.Run("given tokens are not renewed", func(t *testing.T) {
+		if renewer := (TokenOptions{Token: expiring}).renewer(&Source{UID: "video-uid", Token: expiring}); renewer != nil {
+			t.Error("renewer() = non-nil, want nil without a signing key")
+		}
+	})
+
+	t.Run("rejected token", func(t *testing.T) {
+		renewer := opts.renewer(&Source{UID: "video-uid", Token: expiring})
+		renewer.renewAt = time.Time{}
+		video := &Video{VideoUID: "video-uid", Token: expiring, tokens: renewer}
+
+		var requested []string
+		err := video.authorized("https://example.com/video-uid/seg_1.ts", func(signedURL string) error {
+			requested = append(requested, signedURL)
+			if strings.Contains(signedURL, expiring) {
+				return &HTTPStatusError{URL: signedURL, StatusCode: http.StatusForbidden}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(requested) != 2 || strings.Contains(requested[1], expiring) {
+			t.Errorf("requested %v, want the rejected URL followed by one with a new token", requested)
+		}
+		// a request that failed with the rejected token uses the new one
+		if !renewer.renew(expiring) || renewer.current() == expiring {
+			t.Error("renew() of the rejected token didn't keep the new token")
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_CHUNK_SIZE = int64(5) * 1024 * 1024 // 5MB
+	STREAM_API_URL     = "https://api.cloudflare.com/client/v4/accounts/%s/stream"
+)
+
+// UploadOptions are the credentials and settings of a TUS upload
+type UploadOptions struct {
+	AccountID string
+	APIToken  string
+	// Endpoint replaces the Stream API URL of AccountID when set
+	Endpoint string
+	// ChunkSize is the size of every PATCH request, DEFAULT_CHUNK_SIZE when 0
+	ChunkSize int64
+	// UploadURL resumes the upload of the same file at this URL, as returned
+	// by an interrupted Upload, instead of creating a new one
+	UploadURL string
+	// OnEvent receives the progress of this upload instead of
+	// Client.OnEvent when set
+	OnEvent func(event Event)
+}
+
+// Upload invokes a TUS upload against Cloudflare Stream with a given local
+// file path and returns the URL of the upload. An EVENT_UPLOAD_PROGRESS is
+// sent after every chunk. When the upload fails or ctx is cancelled the URL is
+// returned along with the error, so it can be resumed with
+// UploadOptions.UploadURL
+func (c *Client) Upload(ctx context.Context, filePath string, opts UploadOptions) (string, error) {
+	if opts.AccountID == "" && opts.Endpoint == "" && opts.UploadURL == "" {
+		return "", fmt.Errorf("%w: an account ID is required", ErrMissingCredentials)
+	}
+	if opts.APIToken == "" {
+		return "", fmt.Errorf("%w: an API token is required", ErrMissingCredentials)
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DEFAULT_CHUNK_SIZE
+	}
+	events := opts.OnEvent
+	if events == nil {
+		events = c.OnEvent
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	filename := filepath.Base(file.Name())
+	encodedFileName := base64.StdEncoding.EncodeToString([]byte(filename))
+
+	uploadURL := opts.UploadURL
+	if uploadURL == "" {
+		uploadURL, err = c.createUpload(ctx, opts, fileInfo.Size(), encodedFileName)
+		if err != nil {
+			return "", fmt.Errorf("there was a problem creating the upload: %w", err)
+		}
+	}
+
+	start := time.Now()
+	chunkCount := int((fileInfo.Size() + opts.ChunkSize - 1) / opts.ChunkSize)
+	var transferred int64
+	for {
+		// the server tells where to continue, which also resumes an upload
+		// interrupted in an earlier run
+		uploadOffset, err := c.getUploadOffset(ctx, opts, uploadURL)
+		if err != nil {
+			return uploadURL, fmt.Errorf("there was a problem reading the upload offset: %w", err)
+		}
+		if uploadOffset >= fileInfo.Size() {
+			return uploadURL, nil
+		}
+		n, err := c.uploadChunk(ctx, opts, file, uploadURL, uploadOffset)
+		if err != nil {
+			return uploadURL, fmt.Errorf("there was a problem uploading the chunk at offset %d: %w", uploadOffset, err)
+		}
+		if n == 0 {
+			return uploadURL, fmt.Errorf("%s is shorter than the upload, it changed since the upload started", filePath)
+		}
+		transferred += int64(n)
+		if events != nil {
+			events(Event{Type: EVENT_UPLOAD_PROGRESS, Progress: &Progress{
+				Stage:       filename,
+				Bytes:       uploadOffset + int64(n),
+				Transferred: transferred,
+				Total:       fileInfo.Size(),
+				Done:        int((uploadOffset + int64(n) + opts.ChunkSize - 1) / opts.ChunkSize),
+				Planned:     chunkCount,
+				Elapsed:     time.Since(start),
+			}})
+		}
+	}
+}
+
+// uploadRequest prepares a TUS request with the credentials of opts
+func uploadRequest(ctx context.Context, opts UploadOptions, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", opts.APIToken))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	return req, nil
+}
+
+func (c *Client) createUpload(ctx context.Context, opts UploadOptions, fileSize int64, encodedFilename string) (string, error) {
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf(STREAM_API_URL, opts.AccountID)
+	}
+	req, err := uploadRequest(ctx, opts, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Length", fmt.Sprintf("%d", fileSize))
+	req.Header.Set("Upload-Metadata", fmt.Sprintf("name %s", encodedFilename))
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", statusError(resp)
+	}
+	return resp.Header.Get("Location"), nil
+}
+
+func (c *Client) getUploadOffset(ctx context.Context, opts UploadOptions, uploadURL string) (int64, error) {
+	req, err := uploadRequest(ctx, opts, http.MethodHead, uploadURL, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return -1, statusError(resp)
+	}
+
+	uploadOffset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return -1, err
+	}
+	return uploadOffset, nil
+}
+
+func (c *Client) uploadChunk(ctx context.Context, opts UploadOptions, file *os.File, uploadURL string, uploadOffset int64) (int, error) {
+	buf := make([]byte, opts.ChunkSize)
+	n, err := file.ReadAt(buf, uploadOffset)
+	if err != nil && err != io.EOF {
+		return -1, err
+	}
+
+	req, err := uploadRequest(ctx, opts, http.MethodPatch, uploadURL, bytes.NewReader(buf[:n]))
+	if err != nil {
+		return -1, err
+	}
+
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", fmt.Sprintf("%d", uploadOffset))
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return -1, statusError(resp)
+	}
+
+	return n, nil
+}
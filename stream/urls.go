@@ -0,0 +1,21 @@
+package stream
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// resolveURL resolves a URI found in a playlist against the URL of the
+// playlist containing it, as described in RFC 3986 section 5.2. Absolute
+// URIs are returned unchanged and query strings on the reference are kept
+func resolveURL(playlistURL, uri string) (string, error) {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid playlist URL %s: %v", playlistURL, err)
+	}
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid URI %s in playlist %s: %v", uri, playlistURL, err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
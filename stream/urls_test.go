@@ -0,0 +1,34 @@
+package stream
+
+import "testing"
+
+func TestResolveURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		playlistURL string
+		uri         string
+		want        string
+	}{
+		{"sibling", "https://example.com/uid/manifest/video.m3u8", "stream_720.m3u8?p=1", "https://example.com/uid/manifest/stream_720.m3u8?p=1"},
+		{"parent directory", "https://example.com/uid/manifest/stream_720.m3u8", "../seg_1.ts", "https://example.com/uid/seg_1.ts"},
+		{"absolute path", "https://example.com/uid/manifest/video.m3u8?token=1", "/other/seg_1.ts", "https://example.com/other/seg_1.ts"},
+		{"absolute URL", "https://example.com/uid/manifest/video.m3u8", "https://cdn.example.com/seg_1.ts", "https://cdn.example.com/seg_1.ts"},
+		{"query of the playlist is dropped", "https://example.com/uid/manifest/video.m3u8?token=1", "seg_1.ts", "https://example.com/uid/manifest/seg_1.ts"},
+		{"signed token in the path", "https://example.com/" + testToken + "/manifest/video.m3u8", "stream_720.m3u8", "https://example.com/" + testToken + "/manifest/stream_720.m3u8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolveURL(test.playlistURL, test.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("resolveURL() = %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	if _, err := resolveURL("https://example.com/video.m3u8", "%zz"); err == nil {
+		t.Error("resolveURL() of an invalid URI succeeded, want an error")
+	}
+}
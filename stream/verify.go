@@ -0,0 +1,340 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+const (
+	// DURATION_TOLERANCE is how many seconds a segment or the output may
+	// deviate from the #EXTINF durations before it counts as a mismatch
+	DURATION_TOLERANCE = 0.5
+	// VERIFY_ATTEMPTS bounds how often a segment is downloaded until it passes
+	// verification
+	VERIFY_ATTEMPTS = 3
+)
+
+// segmentCheck is the verification result of a downloaded segment
+type segmentCheck struct {
+	Path      string  `json:"path"`
+	Expected  float64 `json:"expectedDuration,omitempty"`
+	Measured  float64 `json:"measuredDuration,omitempty"`
+	Downloads int     `json:"downloads"`
+	Problem   string  `json:"problem,omitempty"`
+
+	init       bool
+	structural bool
+}
+
+// outputCheck compares the duration of the final file with the playlist
+type outputCheck struct {
+	Path     string  `json:"path"`
+	Expected float64 `json:"expectedDuration"`
+	Measured float64 `json:"measuredDuration"`
+	Problem  string  `json:"problem,omitempty"`
+}
+
+// verificationReport is written next to the journal of a rendition once its
+// segments are verified, the video report also covers the final file
+type verificationReport struct {
+	Rendition  string         `json:"rendition"`
+	Resolution string         `json:"resolution"`
+	Duration   float64        `json:"playlistDuration"`
+	Segments   []segmentCheck `json:"segments"`
+	Output     *outputCheck   `json:"output,omitempty"`
+
+	path string
+}
+
+// reportPath returns where the verification report of a rendition is stored
+func reportPath(directory, rendition string) string {
+	return fmt.Sprintf("%s/%s_verification.json", directory, rendition)
+}
+
+// newVerificationReport prepares the checks of the segments. durations holds
+// the #EXTINF duration of every segment, 0 for an initialization section
+func newVerificationReport(directory, resolution, rendition string, segmentPaths []string, durations []float64, hasInit bool) *verificationReport {
+	report := &verificationReport{
+		Rendition:  rendition,
+		Resolution: resolution,
+		Segments:   make([]segmentCheck, len(segmentPaths)),
+		path:       reportPath(directory, rendition),
+	}
+	for idx, segmentPath := range segmentPaths {
+		report.Segments[idx] = segmentCheck{
+			Path:      segmentPath,
+			Expected:  durations[idx],
+			Downloads: 1,
+			init:      hasInit && idx == 0,
+		}
+		report.Duration += durations[idx]
+	}
+	return report
+}
+
+// verify checks every segment and returns the indexes of the segments that
+// failed and should be downloaded again
+func (r *verificationReport) verify() []int {
+	var initSection []byte
+	if len(r.Segments) > 0 && r.Segments[0].init {
+		initSection, _ = os.ReadFile(r.Segments[0].Path)
+	}
+
+	failed := []int{}
+	for idx := range r.Segments {
+		check := &r.Segments[idx]
+		check.structural, check.Problem = false, ""
+		measured, err := checkSegment(check.Path, initSection, check.init)
+		switch {
+		case err != nil:
+			check.structural, check.Problem = true, err.Error()
+		case measured > 0 && check.Expected > 0 && math.Abs(measured-check.Expected) > DURATION_TOLERANCE:
+			check.Problem = fmt.Sprintf("lasts %.3fs instead of %.3fs", measured, check.Expected)
+		}
+		check.Measured = roundDuration(measured)
+		if check.Problem != "" {
+			failed = append(failed, idx)
+		}
+	}
+	return failed
+}
+
+// problems returns the segments still failing, split into broken segments and
+// segments with an unexpected duration
+func (r *verificationReport) problems() ([]segmentCheck, []segmentCheck) {
+	var broken, mismatched []segmentCheck
+	for _, check := range r.Segments {
+		switch {
+		case check.structural:
+			broken = append(broken, check)
+		case check.Problem != "":
+			mismatched = append(mismatched, check)
+		}
+	}
+	return broken, mismatched
+}
+
+// verifyOutput compares the duration of the final file with the playlist
+// durations of the segments, cut to clip when it is set
+func (r *verificationReport) verifyOutput(outputPath string, clip Clip) {
+	expected := r.Duration
+	if clip.End > 0 && clip.End < expected {
+		expected = clip.End
+	}
+	expected -= clip.Start
+
+	check := &outputCheck{Path: outputPath, Expected: roundDuration(expected)}
+	measured, err := mediaDuration(outputPath)
+	switch {
+	case err != nil:
+		check.Problem = err.Error()
+	case math.Abs(measured-expected) > DURATION_TOLERANCE:
+		check.Problem = fmt.Sprintf("lasts %.3fs instead of %.3fs", measured, expected)
+	}
+	check.Measured = roundDuration(measured)
+	r.Output = check
+}
+
+// save writes the report to disk
+func (r *verificationReport) save() error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, data, 0644)
+}
+
+// checkSegment checks the structure of a downloaded segment and returns its
+// measured duration in seconds, 0 when it can't be measured
+func checkSegment(segmentPath string, initSection []byte, isInit bool) (float64, error) {
+	data, err := os.ReadFile(segmentPath)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, errors.New("empty segment")
+	}
+	if isFragmentedMP4(data) {
+		return checkFragmentedSegment(data, initSection, isInit)
+	}
+	if data[0] == TS_SYNC_BYTE {
+		return checkTransportSegment(data)
+	}
+	return 0, errors.New("neither MPEG-TS nor fragmented MP4")
+}
+
+// checkFragmentedSegment checks the box tree of an initialization section
+// (ftyp and moov) or of a media segment (moof and mdat) and measures the
+// duration of a media segment with the track defaults of initSection
+func checkFragmentedSegment(data, initSection []byte, isInit bool) (float64, error) {
+	atoms, err := parseBoxes(data)
+	if err != nil {
+		return 0, err
+	}
+	found := map[string][]byte{}
+	for _, atom := range atoms {
+		if _, ok := found[atom.Type]; !ok {
+			found[atom.Type] = atom.Body
+		}
+	}
+
+	if isInit {
+		if found["moov"] == nil {
+			return 0, errors.New("initialization section without moov box")
+		}
+		_, err := parseInitSection(found["moov"], nil)
+		return 0, err
+	}
+	if found["moof"] == nil || found["mdat"] == nil {
+		return 0, errors.New("media segment without moof and mdat boxes")
+	}
+	if _, err := parseBoxes(found["moof"]); err != nil {
+		return 0, fmt.Errorf("invalid moof box: %v", err)
+	}
+	if findBox(found["moof"], "traf") == nil {
+		return 0, errors.New("moof box without track fragment")
+	}
+
+	moov := findBox(initSection, "moov")
+	if moov == nil {
+		return 0, nil
+	}
+	tracks, err := parseInitSection(moov, nil)
+	if err != nil {
+		return 0, nil
+	}
+	for _, atom := range atoms {
+		if atom.Type == "moof" {
+			if err := parseFragment(atom.Body, 0, tracks); err != nil {
+				return 0, fmt.Errorf("invalid moof box: %v", err)
+			}
+		}
+	}
+	for _, track := range tracks {
+		if len(track.samples) > 0 && track.timescale > 0 {
+			return float64(sampleDuration(track.muxTrack)) / float64(track.timescale), nil
+		}
+	}
+	return 0, nil
+}
+
+// checkTransportSegment checks the sync byte of every MPEG-TS packet and
+// measures the duration from the presentation timestamps of the first
+// elementary stream
+func checkTransportSegment(data []byte) (float64, error) {
+	if len(data)%TS_PACKET_SIZE != 0 {
+		return 0, fmt.Errorf("%d bytes is not a whole number of %d byte packets", len(data), TS_PACKET_SIZE)
+	}
+
+	var pid uint16
+	var first, last int64
+	count := 0
+	for offset := 0; offset < len(data); offset += TS_PACKET_SIZE {
+		packet := data[offset : offset+TS_PACKET_SIZE]
+		info, err := parseTSPacket(packet)
+		if err != nil {
+			return 0, fmt.Errorf("packet at offset %d: %v", offset, err)
+		}
+
+		// PES packets starting in this TS packet carry the timestamps
+		if !info.payloadStart || !info.hasPayload || (count > 0 && info.pid != pid) {
+			continue
+		}
+		payload := packet[info.payloadOffset:]
+		if len(payload) < 14 || !bytes.Equal(payload[:3], []byte{0, 0, 1}) || payload[3] < 0xc0 || payload[3] > 0xef || payload[7]&0x80 == 0 {
+			continue
+		}
+		pts := parseTimestamp(payload[9:14])
+		if count == 0 {
+			pid, first, last = info.pid, pts, pts
+		}
+		// B-frames go back in time a little, a large jump is a wrap of the
+		// 33 bit clock
+		if pts < first-tsClockRate*10 {
+			pts += 1 << 33
+		}
+		if pts < first {
+			first = pts
+		}
+		if pts > last {
+			last = pts
+		}
+		count++
+	}
+	if count < 2 {
+		return 0, nil
+	}
+
+	// the last frame lasts as long as the average frame
+	span := float64(last-first) / tsClockRate
+	return span * float64(count) / float64(count-1), nil
+}
+
+// mediaDuration returns the duration of a progressive or fragmented MP4
+func mediaDuration(filePath string) (float64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	for offset := int64(0); offset < info.Size(); {
+		boxType, headerSize, size, err := readTopLevelBox(file, offset, info.Size())
+		if err != nil {
+			return 0, err
+		}
+		if boxType == "moov" {
+			body := make([]byte, size-headerSize)
+			if _, err := file.ReadAt(body, offset+headerSize); err != nil {
+				return 0, err
+			}
+			mvhd := findBox(body, "mvhd")
+			var timescale uint32
+			var duration uint64
+			switch {
+			case len(mvhd) >= 32 && mvhd[0] == 1:
+				timescale, duration = binary.BigEndian.Uint32(mvhd[20:]), binary.BigEndian.Uint64(mvhd[24:])
+			case len(mvhd) >= 20:
+				timescale, duration = binary.BigEndian.Uint32(mvhd[12:]), uint64(binary.BigEndian.Uint32(mvhd[16:]))
+			}
+			if timescale > 0 && duration > 0 {
+				return float64(duration) / float64(timescale), nil
+			}
+			break
+		}
+		offset += size
+	}
+
+	// fragmented files leave the duration of the movie header empty
+	tracks, err := demuxFragmentedMP4(file)
+	if err != nil {
+		return 0, err
+	}
+	if tracks[0].timescale == 0 {
+		return 0, errors.New("track without timescale")
+	}
+	return float64(sampleDuration(tracks[0])) / float64(tracks[0].timescale), nil
+}
+
+// sampleDuration sums the sample durations of a track in its timescale
+func sampleDuration(track *muxTrack) uint64 {
+	var total uint64
+	for _, sample := range track.samples {
+		total += uint64(sample.duration)
+	}
+	return total
+}
+
+// roundDuration rounds seconds to milliseconds for the report
+func roundDuration(seconds float64) float64 {
+	return math.Round(seconds*1000) / 1000
+}
@@ -0,0 +1,626 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/grafov/m3u8"
+)
+
+// Video is a video opened by Client.Open, with its master playlist and the
+// manifest URL of every rendition
+type Video struct {
+	BaseURL            string
+	MasterManifestURL  string
+	VideoUID           string
+	Token              string
+	RenditionManifests map[string]string
+
+	MasterPlaylist m3u8.MasterPlaylist
+
+	client *Client
+	keys   *keyCache
+	// tokens renews the token when it is minted with the signing key
+	tokens *tokenRenewer
+
+	// transfer counts the progress of the running segment downloads
+	transfer *transferProgress
+
+	// events receives the messages and the progress of the operations
+	events func(event Event)
+}
+
+// DownloadOptions are the settings of a download, a mirror or a recording.
+// Every file is written below OutputPath, the working directory when empty,
+// following Template
+type DownloadOptions struct {
+	OutputPath string
+	Template   string
+	// Resolution holds the selection rules picking a variant, such as best
+	// or <=720p. Client.PromptVariant, or else the best variant, is used when
+	// it is empty
+	Resolution string
+	// Subtitles is SUBTITLES_SIDECAR, SUBTITLES_EMBED or SUBTITLES_NONE
+	Subtitles string
+	Audio     AudioSelection
+	// Clip keeps only part of the video when set
+	Clip Clip
+	// AllRenditions downloads every variant instead of the selected one
+	AllRenditions bool
+	// OnEvent receives the events of this operation instead of
+	// Client.OnEvent when set
+	OnEvent func(event Event)
+}
+
+// Download downloads the chosen rendition, or every rendition with
+// opts.AllRenditions, and returns the directories holding the results.
+// Subtitles are written next to the video, embedded into it or skipped
+// depending on opts.Subtitles. When opts.Clip is set only that part of the
+// video is downloaded and kept
+func (v *Video) Download(ctx context.Context, opts DownloadOptions) ([]string, error) {
+	defer v.useEvents(opts.OnEvent)()
+	if opts.AllRenditions {
+		return v.downloadAllRenditions(ctx, opts)
+	}
+
+	chosenManifest, chosenVariant, err := v.selectManifest(opts.Resolution)
+	if err != nil {
+		return nil, fmt.Errorf("there was a problem selecting a download option: %w", err)
+	}
+
+	audioRenditions, err := opts.Audio.selectTracks(v.alternativeRenditions("AUDIO", chosenVariant))
+	if err != nil {
+		return nil, fmt.Errorf("there was a problem selecting the audio tracks: %w", err)
+	}
+
+	output := v.renditionOutput(opts, chosenVariant.Resolution, chosenVariant, nil)
+
+	// one progress line covers the audio and video segments
+	defer v.beginTransfer()()
+	if err := v.planTransfer(ctx, output, RENDITION_VIDEO, chosenManifest, opts.Clip); err != nil {
+		return nil, fmt.Errorf("there was a problem reading the video playlist: %w", err)
+	}
+	for _, rendition := range renditionNames(RENDITION_AUDIO, audioRenditions) {
+		audioManifest, err := resolveURL(v.MasterManifestURL, rendition.media.URI)
+		if err != nil {
+			return nil, err
+		}
+		if err := v.planTransfer(ctx, output, rendition.name, v.signedURL(audioManifest), opts.Clip); err != nil {
+			return nil, fmt.Errorf("there was a problem reading the audio playlist: %w", err)
+		}
+	}
+
+	audioTracks, err := v.downloadAudioTracks(ctx, audioRenditions, output, opts.Clip)
+	if err != nil {
+		return nil, fmt.Errorf("there was a problem downloading the audio tracks: %w", err)
+	}
+	var subtitles []mediaTrack
+	if opts.Subtitles != SUBTITLES_NONE {
+		subtitles, err = v.downloadSubtitles(ctx, v.alternativeRenditions("SUBTITLES", chosenVariant), output, opts.Clip)
+		if err != nil {
+			return nil, fmt.Errorf("there was a problem downloading the subtitles: %w", err)
+		}
+	}
+	if err := v.downloadRendition(ctx, chosenManifest, output, opts, audioTracks, subtitles); err != nil {
+		return nil, err
+	}
+	return []string{output.directory}, nil
+}
+
+// downloadAudioTracks downloads and concatenates the audio renditions into
+// the output directory
+func (v *Video) downloadAudioTracks(ctx context.Context, renditions []*m3u8.Alternative, output renditionOutput, clip Clip) ([]mediaTrack, error) {
+	audioTracks := []mediaTrack{}
+	for _, rendition := range renditionNames(RENDITION_AUDIO, renditions) {
+		manifestForResolution, err := resolveURL(v.MasterManifestURL, rendition.media.URI)
+		if err != nil {
+			return nil, err
+		}
+		segmentPaths, _, _, err := v.downloadSegmentsFromManifest(ctx, v.signedURL(manifestForResolution), output, rendition.name, clip)
+		if err != nil {
+			return nil, err
+		}
+
+		storedPath, err := v.concatenateTSFiles(segmentPaths, output, rendition.name)
+		if err != nil {
+			return nil, err
+		}
+		audioTracks = append(audioTracks, mediaTrack{
+			Language: rendition.media.Language,
+			Name:     rendition.media.Name,
+			Path:     storedPath,
+		})
+	}
+	return audioTracks, nil
+}
+
+// downloadRendition downloads the video of a variant into the output
+// directory and merges it with the audio tracks and, with SUBTITLES_EMBED,
+// the subtitles
+func (v *Video) downloadRendition(ctx context.Context, manifestURL string, output renditionOutput, opts DownloadOptions, audioTracks, subtitles []mediaTrack) error {
+	segmentPaths, videoClip, report, err := v.downloadSegmentsFromManifest(ctx, manifestURL, output, RENDITION_VIDEO, opts.Clip)
+	if err != nil {
+		return fmt.Errorf("there was a problem downloading the segments: %w", err)
+	}
+
+	storedPath, err := v.concatenateTSFiles(segmentPaths, output, RENDITION_VIDEO)
+	if err != nil {
+		return fmt.Errorf("there was a problem concatenating the segments: %w", err)
+	}
+
+	var embedded []mediaTrack
+	if opts.Subtitles == SUBTITLES_EMBED {
+		embedded = subtitles
+	}
+
+	// merge potential audio, video and subtitle files together, MPEG-TS video
+	// is remuxed into MP4 and clips are trimmed even on their own
+	finalPath := storedPath
+	if len(audioTracks) > 0 || len(embedded) > 0 || opts.Clip.IsSet() || isTransportStream(storedPath) {
+		switch {
+		case len(embedded) > 0:
+			v.printf("🌱 audio, video and subtitles are being merged...")
+		case len(audioTracks) > 0:
+			v.printf("🌱 audio and video are being merged...")
+		case opts.Clip.IsSet():
+			v.printf("🌱 video is being trimmed...")
+		default:
+			v.printf("🌱 video is being remuxed into MP4...")
+		}
+		finalPath = output.path("merged", "mp4")
+		if err := v.mergeMP4FilesInDir(ctx, finalPath, mediaTrack{Path: storedPath}, audioTracks, embedded, videoClip); err != nil {
+			return fmt.Errorf("there was a problem merging the audio and video files: %w", err)
+		}
+	}
+
+	report.verifyOutput(finalPath, videoClip)
+	if err := report.save(); err != nil {
+		return err
+	}
+	if report.Output.Problem != "" {
+		v.printf("⚠️ WARNING: %s %s (see %s)\n", finalPath, report.Output.Problem, report.path)
+	}
+	return nil
+}
+
+// downloadSegmentsFromManifest will download a complete video and individual segments
+// from a particular manifest into the segments directory of output and returns
+// the list of segment paths along with their verification report. rendition
+// names the track in segment, journal and output file names. When clip is set
+// only the segments covering it are downloaded, and the range relative to the
+// first of them is returned
+func (v *Video) downloadSegmentsFromManifest(ctx context.Context, manifestURL string, output renditionOutput, rendition string, clip Clip) ([]string, Clip, *verificationReport, error) {
+	v.printf("🌱 Beginning %s download for [%s]\n", rendition, output.resolution)
+	defer v.beginTransfer()()
+	body, err := v.fetchURL(ctx, manifestURL)
+	if err != nil {
+		return nil, Clip{}, nil, err
+	}
+
+	mediaPlaylist, err := decodeMediaPlaylist(body)
+	if err != nil {
+		return nil, Clip{}, nil, fmt.Errorf("there was a problem reading the %s playlist %s: %w", rendition, manifestURL, err)
+	}
+
+	var relativeClip Clip
+	localSegmentPaths := []string{}
+	segmentDurations := []float64{}
+	segmentURLs := []string{}
+	segmentKeys := []*segmentEncryption{}
+	hasInit := false
+	if mediaPlaylist.Map != nil {
+		hasInit = true
+		completeSegmentURL, err := resolveURL(manifestURL, mediaPlaylist.Map.URI)
+		if err != nil {
+			return nil, Clip{}, nil, err
+		}
+		segmentName, err := getSegmentName(completeSegmentURL, "init")
+		if err != nil {
+			return nil, Clip{}, nil, err
+		}
+		// the initialization section is decrypted with the key declared before it
+		var initKey *m3u8.Key
+		if keys := mapKeys(body); len(keys) > 0 {
+			initKey = keys[0]
+		}
+		encryption, err := v.segmentEncryption(ctx, initKey, manifestURL, mediaPlaylist.SeqNo)
+		if err != nil {
+			return nil, Clip{}, nil, err
+		}
+		localSegmentPath := fmt.Sprintf("%s/segments/%s_%s", output.directory, rendition, segmentName)
+		localSegmentPaths = append(localSegmentPaths, localSegmentPath)
+		segmentDurations = append(segmentDurations, 0)
+		segmentURLs = append(segmentURLs, v.signedURL(completeSegmentURL))
+		segmentKeys = append(segmentKeys, encryption)
+	}
+
+	// an EXT-X-KEY applies to every following segment until the next one
+	var currentKey *m3u8.Key
+	var segmentStart float64
+	covered, total := 0, 0
+	for idx, segment := range mediaPlaylist.Segments {
+		if segment != nil {
+			if segment.Key != nil {
+				currentKey = segment.Key
+			}
+			total++
+			segmentStart += segment.Duration
+			if clip.IsSet() && !clip.covers(segmentStart-segment.Duration, segment.Duration) {
+				continue
+			}
+			if covered == 0 {
+				relativeClip = clip.relativeTo(segmentStart - segment.Duration)
+			}
+			covered++
+			completeSegmentURL, err := resolveURL(manifestURL, segment.URI)
+			if err != nil {
+				return nil, Clip{}, nil, err
+			}
+			segmentName, err := getSegmentName(completeSegmentURL, fmt.Sprintf("seg_%d", mediaPlaylist.SeqNo+uint64(idx)))
+			if err != nil {
+				return nil, Clip{}, nil, err
+			}
+			localSegmentPath := fmt.Sprintf("%s/segments/%s_%s", output.directory, rendition, segmentName)
+			localSegmentPaths = append(localSegmentPaths, localSegmentPath)
+			segmentDurations = append(segmentDurations, segment.Duration)
+			segmentURLs = append(segmentURLs, v.signedURL(completeSegmentURL))
+
+			encryption, err := v.segmentEncryption(ctx, currentKey, manifestURL, mediaPlaylist.SeqNo+uint64(idx))
+			if err != nil {
+				return nil, Clip{}, nil, err
+			}
+			segmentKeys = append(segmentKeys, encryption)
+		}
+	}
+
+	if clip.IsSet() {
+		if covered == 0 {
+			return nil, Clip{}, nil, fmt.Errorf("the %s playlist has no segments covering %s", rendition, clip)
+		}
+		v.printf("✂️ Keeping %d of %d segments covering %s\n", covered, total, clip)
+	}
+
+	journal, err := v.openDownloadJournal(journalPath(output.directory, rendition), manifestURL, output.resolution, rendition, segmentURLs, localSegmentPaths)
+	if err != nil {
+		return nil, Clip{}, nil, err
+	}
+	if completed := journal.completedCount(); completed > 0 {
+		v.printf("♻️ Resuming download, %d of %d segments already on disk\n", completed, len(segmentURLs))
+	}
+
+	progressKey := journalPath(output.directory, rendition)
+	v.transfer.plan(progressKey, len(segmentURLs))
+	v.transfer.describe(fmt.Sprintf("%s [%s]", rendition, output.resolution))
+	pending := []int{}
+	for idx := range segmentURLs {
+		if journal.isComplete(idx) {
+			var size int64
+			if info, err := os.Stat(localSegmentPaths[idx]); err == nil {
+				size = info.Size()
+			}
+			v.transfer.resume(size)
+			continue
+		}
+		pending = append(pending, idx)
+	}
+	if err := v.fetchSegments(ctx, pending, segmentURLs, localSegmentPaths, segmentKeys, journal, v.transfer); err != nil {
+		return nil, Clip{}, nil, err
+	}
+
+	// segments failing verification are downloaded again
+	report := newVerificationReport(output.directory, output.resolution, rendition, localSegmentPaths, segmentDurations, hasInit)
+	for attempt := 1; ; attempt++ {
+		failed := report.verify()
+		if len(failed) == 0 || attempt == VERIFY_ATTEMPTS {
+			break
+		}
+		v.printf("🔁 Downloading %d %s segments again that failed verification\n", len(failed), rendition)
+		for _, idx := range failed {
+			report.Segments[idx].Downloads++
+		}
+		v.transfer.replan(progressKey, len(failed))
+		if err := v.fetchSegments(ctx, failed, segmentURLs, localSegmentPaths, segmentKeys, journal, v.transfer); err != nil {
+			return nil, Clip{}, nil, err
+		}
+	}
+	if err := report.save(); err != nil {
+		return nil, Clip{}, nil, err
+	}
+
+	broken, mismatched := report.problems()
+	if len(broken) > 0 {
+		return nil, Clip{}, nil, &VerificationError{
+			Rendition: rendition,
+			Failed:    len(broken),
+			Path:      broken[0].Path,
+			Problem:   broken[0].Problem,
+			Report:    report.path,
+		}
+	}
+	if len(mismatched) > 0 {
+		v.printf("⚠️ WARNING: %d %s segments don't match their #EXTINF duration (see %s)\n", len(mismatched), rendition, report.path)
+	}
+	return localSegmentPaths, relativeClip, report, nil
+}
+
+// segmentIndexes returns the indexes of count segments
+func segmentIndexes(count int) []int {
+	indexes := make([]int, count)
+	for idx := range indexes {
+		indexes[idx] = idx
+	}
+	return indexes
+}
+
+// fetchSegments downloads the segments at indexes in parallel and records
+// every finished one in the journal, which is flushed before it returns. The
+// received bytes are counted by transfer when it is set. The segments still
+// running are aborted and no more are started when ctx is done or a segment
+// fails for good
+func (v *Video) fetchSegments(ctx context.Context, indexes []int, segmentURLs, segmentPaths []string, segmentKeys []*segmentEncryption, journal *downloadJournal, transfer *transferProgress) error {
+	c := v.client
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	errChan := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errChan <- err:
+		default:
+		}
+		cancel()
+	}
+
+	for _, idx := range indexes {
+		// parallelization for segment downloads
+		if err := c.acquireDownloadSlot(ctx); err != nil {
+			fail(err)
+			break
+		}
+		wg.Add(1)
+		go func(idx int) {
+			defer func() {
+				c.releaseDownloadSlot()
+				wg.Done()
+			}()
+			var size int64
+			var verified bool
+			progress := transfer.segment()
+			var attempts int
+			err := v.authorized(segmentURLs[idx], func(segmentURL string) error {
+				var err error
+				attempts, err = c.withRetry(ctx, func() error {
+					var err error
+					progress.attempt()
+					size, verified, err = c.downloadFile(ctx, segmentURL, segmentPaths[idx], segmentKeys[idx], progress)
+					return err
+				})
+				return err
+			})
+			if err != nil && ctx.Err() != nil {
+				err = ctx.Err()
+			} else if err != nil {
+				err = &SegmentError{Index: idx, URL: segmentURLs[idx], Attempts: attempts, Err: err}
+			} else {
+				progress.finish()
+				err = journal.markComplete(idx, size, verified)
+			}
+			if err != nil {
+				fail(err)
+			}
+		}(idx)
+	}
+
+	wg.Wait()
+	close(errChan)
+	// the segments finished since the last flush are kept on errors and
+	// cancellation as well
+	saveErr := journal.save()
+	if err := <-errChan; err != nil {
+		return err
+	}
+	return saveErr
+}
+
+// newVideo retrieves the master playlist of source along with the manifest
+// URL of every rendition
+func (c *Client) newVideo(ctx context.Context, source *Source) (*Video, error) {
+	manifestURL := source.ManifestURL
+
+	video := &Video{
+		MasterManifestURL:  manifestURL,
+		BaseURL:            source.BaseURL,
+		VideoUID:           source.UID,
+		Token:              source.Token,
+		RenditionManifests: make(map[string]string),
+		client:             c,
+		tokens:             c.Tokens.renewer(source),
+		events:             c.OnEvent,
+	}
+	video.keys = newKeyCache(video.fetchURL)
+
+	masterPlaylist, err := video.retrieveMasterPlaylist(ctx, video.signedURL(manifestURL))
+	if err != nil {
+		return nil, fmt.Errorf("there was a problem retrieving master playlist: %w", err)
+	}
+	video.MasterPlaylist = *masterPlaylist
+
+	for _, variant := range video.MasterPlaylist.Variants {
+		renditionURL, err := resolveURL(manifestURL, variant.URI)
+		if err != nil {
+			return nil, err
+		}
+		video.RenditionManifests[variant.Resolution] = video.signedURL(renditionURL)
+	}
+	return video, nil
+}
+
+// retrieveMasterPlaylist gets the master m3u8
+func (v *Video) retrieveMasterPlaylist(ctx context.Context, url string) (*m3u8.MasterPlaylist, error) {
+	body, err := v.fetchURL(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	dataBuf := bytes.NewBuffer(body)
+	playlist, _, err := m3u8.Decode(*dataBuf, false)
+	if err != nil {
+		return nil, err
+	}
+
+	masterPlaylist, ok := playlist.(*m3u8.MasterPlaylist)
+	if !ok {
+		return nil, fmt.Errorf("%s is a media playlist, use the master playlist (video.m3u8) of the video", url)
+	}
+	return masterPlaylist, nil
+}
+
+// downloadFile will take a URL and download it to a predfined location,
+// decrypting it on the way when the segment is encrypted. It returns the
+// number of bytes written and whether the body matched the Content-Length
+// announced by the server. The received bytes are counted by progress when
+// it is set
+func (c *Client) downloadFile(ctx context.Context, url, relativePath string, encryption *segmentEncryption, progress *segmentProgress) (int64, bool, error) {
+	resp, err := c.request(ctx, http.MethodGet, url)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return 0, false, err
+	}
+
+	targetDir := filepath.Dir(relativePath)
+	err = os.MkdirAll(targetDir, 0755)
+	if err != nil {
+		return 0, false, err
+	}
+
+	progress.begin(resp.ContentLength)
+	body := &countingReader{reader: resp.Body, progress: progress}
+	reader, err := decryptingReader(body, encryption)
+	if err != nil {
+		return 0, false, err
+	}
+
+	out, err := os.Create(relativePath)
+	if err != nil {
+		return 0, false, err
+	}
+
+	written, err := io.Copy(out, reader)
+	if err == nil && resp.ContentLength >= 0 && body.count != resp.ContentLength {
+		err = fmt.Errorf("segment %s %w: received %d of %d bytes", url, errTruncated, body.count, resp.ContentLength)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// the journal only lists finished segments, a partial file is never
+		// kept, e.g. when the download is cancelled halfway
+		os.Remove(relativePath)
+		return written, false, err
+	}
+	return written, resp.ContentLength >= 0, nil
+}
+
+// countingReader counts the bytes read from the wrapped reader
+type countingReader struct {
+	reader   io.Reader
+	count    int64
+	progress *segmentProgress
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	r.progress.read(n)
+	return n, err
+}
+
+// getSegmentName will strip out the unique segment name from a segment
+// request URL. Segments that don't follow Cloudflare's naming are stored as
+// fallback plus the extension of the URL
+func getSegmentName(urlStr, fallback string) (string, error) {
+	parsedURL, err := url.Parse(urlStr)
+	if err != nil {
+		return "", err
+	}
+	base := path.Base(parsedURL.Path)
+	segmentPattern := regexp.MustCompile(`(^seg_\d+|init)\.(ts|mp4)$`)
+	if segmentPattern.MatchString(base) {
+		return base, nil
+	}
+
+	ext := path.Ext(base)
+	if ext == "" {
+		ext = ".ts"
+	}
+	return fallback + ext, nil
+}
+
+// concatenateTSFiles take all downloaded segments and concat into single, playable
+// mp4 named after the rendition
+func (v *Video) concatenateTSFiles(filePaths []string, output renditionOutput, rendition string) (string, error) {
+	outputPath := output.path(rendition, "mp4")
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return "", err
+	}
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return "", err
+	}
+	defer outputFile.Close()
+
+	for _, filePath := range filePaths {
+		inputFile, err := os.Open(filePath)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = io.Copy(outputFile, inputFile)
+		inputFile.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return outputPath, nil
+}
+
+// printf sends a progress message as an EVENT_MESSAGE
+func (v *Video) printf(format string, args ...interface{}) {
+	if message := strings.TrimSpace(fmt.Sprintf(format, args...)); message != "" {
+		v.emit(Event{Type: EVENT_MESSAGE, Message: message})
+	}
+}
+
+// emit hands event to the receiver of the running operation
+func (v *Video) emit(event Event) {
+	if v.events != nil {
+		v.events(event)
+	}
+}
+
+// useEvents sends the events to events until the returned function is
+// called, the receiver is left alone when events is nil
+func (v *Video) useEvents(events func(event Event)) func() {
+	if events == nil {
+		return func() {}
+	}
+	previous := v.events
+	v.events = events
+	return func() {
+		v.events = previous
+	}
+}
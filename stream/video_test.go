@@ -0,0 +1,60 @@
+package stream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testMasterPlaylist = "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=1280x720\nmedia.m3u8\n"
+	testMediaPlaylist  = "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg_0.ts\n#EXT-X-ENDLIST\n"
+)
+
+// testPlaylistServer serves the test master playlist as video.m3u8 and the
+// test media playlist as media.m3u8
+func testPlaylistServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/video.m3u8"):
+			w.Write([]byte(testMasterPlaylist))
+		case strings.HasSuffix(r.URL.Path, "/media.m3u8"):
+			w.Write([]byte(testMediaPlaylist))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOpenSourcePlaylistType(t *testing.T) {
+	server := testPlaylistServer(t)
+	client := NewClient()
+
+	video, err := client.OpenSource(context.Background(), &Source{ManifestURL: server.URL + "/uid/manifest/video.m3u8", UID: "uid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := video.RenditionManifests["1280x720"]; got != server.URL+"/uid/manifest/media.m3u8" {
+		t.Errorf("manifest of 1280x720 = %s, want the media playlist", got)
+	}
+
+	if _, err := client.OpenSource(context.Background(), &Source{ManifestURL: server.URL + "/uid/manifest/media.m3u8", UID: "uid"}); err == nil {
+		t.Error("OpenSource() of a media playlist succeeded, want an error")
+	}
+}
+
+func TestDownloadSegmentsFromMasterPlaylist(t *testing.T) {
+	server := testPlaylistServer(t)
+	video := &Video{VideoUID: "uid", client: NewClient()}
+	output := renditionOutput{resolution: "1280x720", directory: t.TempDir(), file: "{name}.{ext}"}
+
+	_, _, _, err := video.downloadSegmentsFromManifest(context.Background(), server.URL+"/uid/manifest/video.m3u8", output, RENDITION_VIDEO, Clip{})
+	if err == nil || !strings.Contains(err.Error(), "expected a media playlist") {
+		t.Errorf("downloadSegmentsFromManifest() of a master playlist = %v, want an error", err)
+	}
+}